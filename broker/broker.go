@@ -0,0 +1,371 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Broker is an in-process message broker serving the frame protocol over tcp, it is meant for local development
+// and the tests, so messages are kept in memory only. semantics follow amqp closely enough for the queue driver:
+// queues are fifo, consumers of a queue get the messages round robin and unacknowledged messages are requeued
+// as redelivered when the consuming connection is closed
+type Broker struct {
+	logger   *zap.Logger
+	listener net.Listener
+
+	mu     sync.Mutex
+	queues map[string]*brokerQueue
+	conns  map[*conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type message struct {
+	replyTo, correlationID, appID string
+	contentType                   string
+	headers                       map[string]string
+	body                          []byte
+	redelivered                   bool
+	retries                       int
+}
+
+type brokerQueue struct {
+	name      string
+	messages  []message
+	consumers []*consumer
+	next      int   // round robin position
+	exclusive *conn // owner of an exclusive queue
+}
+
+type consumer struct {
+	conn     *conn
+	queue    *brokerQueue
+	prefetch int
+	unacked  int
+}
+
+type delivery struct {
+	consumer *consumer
+	msg      message
+}
+
+// Listen binds the address and serves the connections in the background until the broker is closed
+func Listen(logger *zap.Logger, addr string) (*Broker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %v", err)
+	}
+	b := &Broker{
+		logger:   logger,
+		listener: listener,
+		queues:   make(map[string]*brokerQueue),
+		conns:    make(map[*conn]struct{}),
+	}
+	b.wg.Add(1)
+	go b.serve()
+	logger.Info("embedded broker listening", zap.String("address", listener.Addr().String()))
+	return b, nil
+}
+
+// Addr is the bound address, useful when listening on port 0
+func (b *Broker) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		netConn, err := b.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				b.logger.Error("failed to accept connection", zap.Error(err))
+			}
+			return
+		}
+		c := &conn{
+			broker:    b,
+			conn:      netConn,
+			unacked:   make(map[uint64]delivery),
+			consumers: make(map[string]*consumer),
+			notify:    make(chan struct{}, 1),
+			done:      make(chan struct{}),
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			_ = netConn.Close()
+			return
+		}
+		b.conns[c] = struct{}{}
+		b.mu.Unlock()
+		b.wg.Add(2)
+		go c.readLoop()
+		go c.writeLoop()
+	}
+}
+
+// Close stops accepting, closes the connections and drops the messages
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	conns := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.mu.Unlock()
+	err := b.listener.Close()
+	for _, c := range conns {
+		_ = c.conn.Close()
+	}
+	b.wg.Wait()
+	return err
+}
+
+// queue returns the queue by name, declares it if it does not exist. must be called with the lock held
+func (b *Broker) queue(name string) *brokerQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &brokerQueue{name: name}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// dispatch delivers the messages of the queue to the consumers with free prefetch capacity,
+// must be called with the lock held
+func (b *Broker) dispatch(q *brokerQueue) {
+	for len(q.messages) > 0 {
+		var c *consumer
+		for i := 0; i < len(q.consumers); i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if candidate.prefetch == 0 || candidate.unacked < candidate.prefetch {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+		msg := q.messages[0]
+		q.messages[0] = message{}
+		q.messages = q.messages[1:]
+		c.unacked++
+		c.conn.nextTag++
+		c.conn.unacked[c.conn.nextTag] = delivery{consumer: c, msg: msg}
+		c.conn.send(&Frame{
+			Op:            OpDeliver,
+			Queue:         q.name,
+			Tag:           c.conn.nextTag,
+			Redelivered:   msg.redelivered,
+			Retries:       msg.retries,
+			ReplyTo:       msg.replyTo,
+			CorrelationID: msg.correlationID,
+			AppID:         msg.appID,
+			ContentType:   msg.contentType,
+			Headers:       msg.headers,
+			Body:          msg.body,
+		})
+	}
+}
+
+// settle acknowledges or rejects the delivery, must be called with the lock held
+func (b *Broker) settle(c *conn, tag uint64, requeue bool) error {
+	d, ok := c.unacked[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(c.unacked, tag)
+	d.consumer.unacked--
+	q := d.consumer.queue
+	if requeue {
+		msg := d.msg
+		msg.redelivered = true
+		msg.retries++
+		// requeued message goes back to the head, so it keeps its place in the order as far as possible
+		q.messages = append([]message{msg}, q.messages...)
+	}
+	b.dispatch(q)
+	return nil
+}
+
+// handle applies a frame received from the connection
+func (b *Broker) handle(c *conn, frame *Frame) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch frame.Op {
+	case OpDeclare:
+		b.queue(frame.Queue)
+	case OpPublish:
+		q, ok := b.queues[frame.Queue]
+		if !ok {
+			// same as amqp default exchange, e.g. the response to a requester which is gone already
+			b.logger.Debug("message published to undeclared queue is dropped", zap.String("queue", frame.Queue))
+			return nil
+		}
+		q.messages = append(q.messages, message{
+			replyTo:       frame.ReplyTo,
+			correlationID: frame.CorrelationID,
+			appID:         frame.AppID,
+			contentType:   frame.ContentType,
+			headers:       frame.Headers,
+			body:          frame.Body,
+		})
+		b.dispatch(q)
+	case OpConsume:
+		if _, ok := c.consumers[frame.Queue]; ok {
+			return fmt.Errorf("already consuming %s", frame.Queue)
+		}
+		q := b.queue(frame.Queue)
+		if q.exclusive != nil && q.exclusive != c {
+			return fmt.Errorf("queue %s is exclusive to another connection", frame.Queue)
+		}
+		if frame.Exclusive {
+			q.exclusive = c
+		}
+		cons := &consumer{conn: c, queue: q, prefetch: frame.Prefetch}
+		c.consumers[frame.Queue] = cons
+		q.consumers = append(q.consumers, cons)
+		b.dispatch(q)
+	case OpCancel:
+		if cons, ok := c.consumers[frame.Queue]; ok {
+			delete(c.consumers, frame.Queue)
+			cons.queue.removeConsumer(cons)
+		}
+	case OpAck:
+		return b.settle(c, frame.Tag, false)
+	case OpNack:
+		return b.settle(c, frame.Tag, frame.Requeue)
+	default:
+		return fmt.Errorf("unknown op %q", frame.Op)
+	}
+	return nil
+}
+
+// disconnect requeues the unacknowledged messages of the connection and deletes its exclusive queues
+func (b *Broker) disconnect(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, c)
+	for _, cons := range c.consumers {
+		cons.queue.removeConsumer(cons)
+	}
+	c.consumers = nil
+	// requeued messages go back to the head in delivery order
+	tags := make([]uint64, 0, len(c.unacked))
+	for tag := range c.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	requeued := make(map[*brokerQueue][]message)
+	for _, tag := range tags {
+		d := c.unacked[tag]
+		msg := d.msg
+		msg.redelivered = true
+		requeued[d.consumer.queue] = append(requeued[d.consumer.queue], msg)
+	}
+	c.unacked = nil
+	for q, msgs := range requeued {
+		q.messages = append(msgs, q.messages...)
+	}
+	for name, q := range b.queues {
+		if q.exclusive == c {
+			delete(b.queues, name)
+			delete(requeued, q)
+		}
+	}
+	for q := range requeued {
+		b.dispatch(q)
+	}
+}
+
+func (q *brokerQueue) removeConsumer(c *consumer) {
+	for i, cons := range q.consumers {
+		if cons == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.next >= len(q.consumers) {
+		q.next = 0
+	}
+}
+
+// conn is a client connection, frames to the client are queued and written by the write loop,
+// so a slow client never blocks the broker
+type conn struct {
+	broker *Broker
+	conn   net.Conn
+
+	// guarded by the broker lock
+	nextTag   uint64
+	unacked   map[uint64]delivery
+	consumers map[string]*consumer
+
+	outMu  sync.Mutex
+	out    []*Frame
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func (c *conn) send(frame *Frame) {
+	c.outMu.Lock()
+	c.out = append(c.out, frame)
+	c.outMu.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *conn) readLoop() {
+	defer c.broker.wg.Done()
+	defer func() {
+		close(c.done)
+		_ = c.conn.Close()
+		c.broker.disconnect(c)
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		frame, err := ReadFrame(r)
+		if err != nil {
+			return
+		}
+		if err := c.broker.handle(c, frame); err != nil {
+			c.broker.logger.Warn("frame rejected", zap.String("op", string(frame.Op)), zap.Error(err))
+			c.send(&Frame{Op: OpError, Queue: frame.Queue, Tag: frame.Tag, Error: err.Error()})
+		}
+	}
+}
+
+func (c *conn) writeLoop() {
+	defer c.broker.wg.Done()
+	w := bufio.NewWriter(c.conn)
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.notify:
+		}
+		c.outMu.Lock()
+		out := c.out
+		c.out = nil
+		c.outMu.Unlock()
+		for _, frame := range out {
+			if err := WriteFrame(w, frame); err != nil {
+				_ = c.conn.Close() // read loop cleans up
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, b *Broker) *client {
+	conn, err := net.Dial("tcp", b.Addr().String())
+	assert.Equal(t, nil, err)
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(frame *Frame) {
+	c.t.Helper()
+	assert.Equal(c.t, nil, WriteFrame(c.conn, frame))
+}
+
+func (c *client) receive() *Frame {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	frame, err := ReadFrame(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return frame
+}
+
+// nothing is received within the timeout
+func (c *client) idle() {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if frame, err := ReadFrame(c.r); err == nil {
+		c.t.Fatalf("unexpected frame %+v", frame)
+	}
+}
+
+func TestBroker_Redeliver(t *testing.T) {
+	b, err := Listen(zap.NewNop(), "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer b.Close()
+
+	producer := dial(t, b)
+	producer.send(&Frame{Op: OpPublish, Queue: "queue", Body: []byte(`"dropped"`)})
+	producer.send(&Frame{Op: OpDeclare, Queue: "queue"})
+	for _, body := range []string{`"1"`, `"2"`, `"3"`} {
+		producer.send(&Frame{Op: OpPublish, Queue: "queue", Body: []byte(body)})
+	}
+	// unknown tag is rejected, the error also tells the frames before it are applied
+	producer.send(&Frame{Op: OpAck, Tag: 100})
+	assert.Equal(t, OpError, producer.receive().Op)
+
+	// prefetch holds back the third message until one is settled
+	first := dial(t, b)
+	first.send(&Frame{Op: OpConsume, Queue: "queue", Prefetch: 2})
+	one, two := first.receive(), first.receive()
+	assert.Equal(t, `"1"`, string(one.Body))
+	assert.Equal(t, `"2"`, string(two.Body))
+	first.idle()
+	first.send(&Frame{Op: OpAck, Tag: one.Tag})
+	three := first.receive()
+	assert.Equal(t, `"3"`, string(three.Body))
+	assert.Equal(t, false, three.Redelivered)
+
+	// unacknowledged messages are redelivered in order once the connection is closed
+	second := dial(t, b)
+	second.send(&Frame{Op: OpConsume, Queue: "queue"})
+	second.idle()
+	assert.Equal(t, nil, first.conn.Close())
+	for _, body := range []string{`"2"`, `"3"`} {
+		frame := second.receive()
+		assert.Equal(t, body, string(frame.Body))
+		assert.Equal(t, true, frame.Redelivered)
+		second.send(&Frame{Op: OpAck, Tag: frame.Tag})
+	}
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Op is the operation of a frame
+type Op string
+
+const (
+	// OpDeclare creates the queue if it does not exist
+	OpDeclare Op = "declare"
+	// OpPublish appends the body to the queue, messages published to an undeclared queue are dropped
+	OpPublish Op = "publish"
+	// OpConsume declares the queue and subscribes the connection to it, at most Prefetch messages are
+	// unacknowledged at a time when it is set. exclusive queue is deleted once the connection is closed
+	OpConsume Op = "consume"
+	// OpCancel stops the subscription, unacknowledged messages can still be settled
+	OpCancel Op = "cancel"
+	OpAck    Op = "ack"
+	OpNack   Op = "nack"
+	// OpDeliver is sent by the broker with a message of a subscribed queue
+	OpDeliver Op = "deliver"
+	// OpError is sent by the broker when a frame is rejected
+	OpError Op = "error"
+)
+
+// maxFrameSize guards the reader against corrupted length prefixes
+const maxFrameSize = 16 << 20
+
+var ErrFrameTooLarge = errors.New("frame is too large")
+
+// Frame is the unit of the protocol, frames are sent as a 4 byte big endian length followed by the json encoded frame
+type Frame struct {
+	Op            Op                `json:"op"`
+	Queue         string            `json:"queue,omitempty"`
+	Tag           uint64            `json:"tag,omitempty"` // delivery tag, unique per connection
+	Prefetch      int               `json:"prefetch,omitempty"`
+	Exclusive     bool              `json:"exclusive,omitempty"`
+	Requeue       bool              `json:"requeue,omitempty"`
+	Redelivered   bool              `json:"redelivered,omitempty"`
+	Retries       int               `json:"retries,omitempty"` // times the message was requeued by a nack
+	ReplyTo       string            `json:"replyTo,omitempty"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	AppID         string            `json:"appId,omitempty"`
+	ContentType   string            `json:"contentType,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Body          []byte            `json:"body,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func WriteFrame(w io.Writer, frame *Frame) error {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	_, err = w.Write(buf)
+	return err
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	frame := new(Frame)
+	if err := json.Unmarshal(payload, frame); err != nil {
+		return nil, fmt.Errorf("malformed frame: %v", err)
+	}
+	return frame, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"time"
 
 	"github.com/bhakiyakalimuthu/server-clique/queue"
 	"github.com/bhakiyakalimuthu/server-clique/types"
@@ -14,14 +15,16 @@ import (
 var inputBytes []byte
 
 type Client struct {
-	logger *zap.Logger
-	queue  queue.Queue
+	logger         *zap.Logger
+	queue          queue.Queue
+	requestTimeout time.Duration
 }
 
-func New(logger *zap.Logger, queue queue.Queue) *Client {
+func New(logger *zap.Logger, queue queue.Queue, requestTimeout time.Duration) *Client {
 	return &Client{
-		logger: logger,
-		queue:  queue,
+		logger:         logger,
+		queue:          queue,
+		requestTimeout: requestTimeout,
 	}
 }
 
@@ -37,7 +40,18 @@ func (c *Client) Start(ctx context.Context) error {
 			c.logger.Warn("context cancelled, publish operation aborted")
 			return ctx.Err()
 		default:
-			if err := c.queue.Publish(msg); err != nil {
+			// read actions are useless without the result, so wait for the server response
+			if msg.Action == types.GetItem || msg.Action == types.GetAll {
+				resp, err := c.Request(ctx, msg)
+				if err != nil {
+					c.logger.Error("failed to request message", zap.Any("msg", msg), zap.Error(err))
+					continue
+				}
+				c.logger.Info("received response", zap.Any("response", resp))
+				continue
+			}
+			// trace context of the publish is carried in the message headers, the server continues the trace
+			if err := queue.PublishContext(ctx, c.queue, msg); err != nil {
 				c.logger.Error("failed to publish message", zap.Any("msg", msg), zap.Error(err))
 				continue
 			}
@@ -46,3 +60,11 @@ func (c *Client) Start(ctx context.Context) error {
 
 	return nil
 }
+
+// Request publishes the message and waits for the server response,
+// request timeout is applied unless the given context has an earlier deadline
+func (c *Client) Request(ctx context.Context, msg *types.Message) (*types.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	defer cancel()
+	return queue.RequestContext(ctx, c.queue, msg)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/config"
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+	"go.uber.org/zap"
+)
+
+const dlqUsage = `usage: client dlq inspect|replay|purge [flags]
+
+  inspect  prints the dead lettered messages as json lines, they are left in the dead letter queue
+  replay   publishes the dead lettered messages back to the queue they were dead lettered from
+  purge    removes the dead lettered messages
+
+`
+
+// dlq runs the dead letter queue subcommand, the messages are read until the dead letter queue is idle
+func dlq(l *zap.Logger, cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dlqUsage)
+		return errors.New("missing dead letter queue command")
+	}
+	command := args[0]
+	fs := flag.NewFlagSet("dlq "+command, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), dlqUsage)
+		fs.PrintDefaults()
+	}
+	deadLetterQueue := fs.String("queue", cfg.DeadLetterQueue(), "dead letter queue")
+	reason := fs.String("reason", "", "only the messages dead lettered for the reason, e.g. malformed, unknown_content_type, unknown_action or retries_exceeded")
+	to := fs.String("to", "", "queue the messages are replayed to instead of the queue they were dead lettered from")
+	limit := fs.Int("limit", 0, "max number of messages read, no limit if zero")
+	idle := fs.Duration("idle", time.Second, "messages are read until none is delivered for the duration")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	q, err := queue.Open(cfg.QueueDriver, l, cfg.QueueConnString, cfg.QueueName, appName, cfg.QueueOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to open queue: %w", err)
+	}
+	defer q.Close()
+	raw, ok := q.(queue.RawQueue)
+	if !ok {
+		return fmt.Errorf("queue driver %s does not support reading the dead letter queue", cfg.QueueDriver)
+	}
+	var handle func(*queue.Envelope) error
+	switch command {
+	case "inspect":
+		enc := json.NewEncoder(os.Stdout)
+		// inspected messages are not settled, the broker redelivers them once the connection is closed
+		handle = func(envelope *queue.Envelope) error {
+			return enc.Encode(newDeadLetter(envelope))
+		}
+	case "replay":
+		handle = func(envelope *queue.Envelope) error {
+			return queue.Replay(raw, envelope, *to)
+		}
+	case "purge":
+		handle = func(envelope *queue.Envelope) error {
+			return envelope.Ack()
+		}
+	default:
+		fs.SetOutput(os.Stderr)
+		fs.Usage()
+		return fmt.Errorf("unknown dead letter queue command %q", command)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer cancel()
+	matched := 0
+	read, err := queue.ReadDeadLetters(ctx, raw, *deadLetterQueue, *idle, *limit, func(envelope *queue.Envelope) error {
+		if *reason != "" && envelope.Headers[queue.HeaderDeadLetterReason] != *reason {
+			// left unsettled, it stays in the dead letter queue
+			return nil
+		}
+		matched++
+		return handle(envelope)
+	})
+	l.Info("dead letter queue done", zap.String("command", command), zap.String("queue", *deadLetterQueue), zap.Int("read", read), zap.Int("matched", matched))
+	return err
+}
+
+// deadLetter is a dead lettered message as it is printed by inspect
+type deadLetter struct {
+	Reason        string            `json:"reason"`
+	Error         string            `json:"error,omitempty"`
+	Source        string            `json:"source,omitempty"`
+	ContentType   string            `json:"contentType,omitempty"`
+	AppID         string            `json:"appId,omitempty"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	// Message is the json body as it is, Body is the base64 of the other bodies
+	Message json.RawMessage `json:"message,omitempty"`
+	Body    []byte          `json:"body,omitempty"`
+}
+
+func newDeadLetter(envelope *queue.Envelope) *deadLetter {
+	d := &deadLetter{
+		Reason:        envelope.Headers[queue.HeaderDeadLetterReason],
+		Error:         envelope.Headers[queue.HeaderDeadLetterError],
+		Source:        envelope.Headers[queue.HeaderDeadLetterSource],
+		ContentType:   envelope.ContentType,
+		AppID:         envelope.AppID,
+		CorrelationID: envelope.CorrelationID,
+	}
+	for key, value := range envelope.Headers {
+		switch key {
+		case queue.HeaderDeadLetterReason, queue.HeaderDeadLetterError, queue.HeaderDeadLetterSource:
+			continue
+		}
+		if d.Headers == nil {
+			d.Headers = make(map[string]string, len(envelope.Headers))
+		}
+		d.Headers[key] = value
+	}
+	if isJSON(envelope.ContentType) && json.Valid(envelope.Body) {
+		d.Message = envelope.Body
+	} else {
+		d.Body = envelope.Body
+	}
+	return d
+}
+
+// isJSON is true for the json content type, messages without content type are json
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == queue.ContentTypeJSON
+}
@@ -5,9 +5,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/bhakiyakalimuthu/server-clique/client"
 	"github.com/bhakiyakalimuthu/server-clique/config"
+	"github.com/bhakiyakalimuthu/server-clique/helper"
 	"github.com/bhakiyakalimuthu/server-clique/queue"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -19,13 +21,30 @@ var (
 )
 
 func main() {
-	l := newLogger(appName, buildVersion)
 	cfg := config.NewConfig()
-	q, err := queue.New(l, cfg.QueueConnString, cfg.QueueName, appName)
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		// output of the subcommand goes to stdout, logs go to stderr
+		l := newLogger(appName, buildVersion, os.Stderr)
+		if err := dlq(l, cfg, os.Args[2:]); err != nil {
+			l.Fatal("dead letter queue command failed", zap.Error(err))
+		}
+		return
+	}
+	l := newLogger(appName, buildVersion, os.Stdout)
+	// published messages carry the trace context, spans are exported if the endpoint is set
+	shutdownTracing, err := helper.SetupTracing(context.Background(), appName, cfg.TraceEndpoint)
+	if err != nil {
+		l.Fatal("failed to setup tracing", zap.Error(err))
+	}
+	q, err := queue.Open(cfg.QueueDriver, l, cfg.QueueConnString, cfg.QueueName, appName, cfg.QueueOptions()...)
 	if err != nil {
 		l.Fatal("failed to create new queue", zap.Error(err))
 	}
-	client := client.New(l, q)
+	if cfg.BatchMaxMessages > 0 {
+		// bulk loads are published as batches, the server unpacks them
+		q = queue.NewBatcher(l, q, cfg.BatchOptions())
+	}
+	client := client.New(l, q, cfg.RequestTimeout)
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		shutdown := make(chan os.Signal, 1)
@@ -38,16 +57,21 @@ func main() {
 		l.Fatal("failed to start client", zap.Error(err))
 	}
 	l.Info("client sending messages completed")
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		l.Error("failed to flush spans", zap.Error(err))
+	}
 }
 
-func newLogger(appName, version string) *zap.Logger {
+func newLogger(appName, version string, out *os.File) *zap.Logger {
 	logLevel := zap.DebugLevel
 	var zapCore zapcore.Core
 	level := zap.NewAtomicLevel()
 	level.SetLevel(logLevel)
 	encoderCfg := zap.NewProductionEncoderConfig()
 	encoder := zapcore.NewJSONEncoder(encoderCfg)
-	zapCore = zapcore.NewCore(encoder, zapcore.Lock(os.Stdout), level)
+	zapCore = zapcore.NewCore(encoder, zapcore.Lock(out), level)
 
 	logger := zap.New(zapCore, zap.AddCaller(), zap.ErrorOutput(zapcore.Lock(os.Stderr)))
 	logger = logger.With(zap.String("app", appName), zap.String("buildVersion", version))
@@ -6,12 +6,14 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/bhakiyakalimuthu/server-clique/broker"
 	"github.com/bhakiyakalimuthu/server-clique/config"
 	"github.com/bhakiyakalimuthu/server-clique/helper"
 	"github.com/bhakiyakalimuthu/server-clique/queue"
 	"github.com/bhakiyakalimuthu/server-clique/server"
-	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -27,28 +29,100 @@ func main() {
 	l := newLogger(appName, buildVersion)
 	cfg := config.NewConfig()
 
+	// trace context of the client is continued by the server, spans are exported if the endpoint is set
+	shutdownTracing, err := helper.SetupTracing(context.Background(), appName, cfg.TraceEndpoint)
+	if err != nil {
+		l.Fatal("failed to setup tracing", zap.Error(err))
+	}
+
+	// embedded broker replaces rabbit mq for local development, server connects to it like any client
+	var b *broker.Broker
+	if cfg.BrokerListenAddress != "" {
+		b, err = broker.Listen(l, cfg.BrokerListenAddress)
+		if err != nil {
+			l.Fatal("failed to start embedded broker", zap.Error(err))
+		}
+	}
+
 	// setup queue
-	q, err := queue.New(l, cfg.QueueConnString, cfg.QueueName, appName)
+	// prefetch keeps every worker busy with one message in hand and one waiting
+	q, err := queue.Open(cfg.QueueDriver, l, cfg.QueueConnString, cfg.QueueName, appName, append(cfg.QueueOptions(), queue.WithPrefetch(2*workerPoolSize))...)
 	if err != nil {
 		l.Fatal("failed to create new queue", zap.Error(err))
 	}
 
 	// setup store
-	s := server.NewMemStore(l)
-
-	cChan := make(chan *types.Message, workerPoolSize)
+	var s server.Store = server.NewMemStore(l)
+	if cfg.StoreShards > 0 {
+		s = server.NewShardedStore(l, cfg.StoreShards)
+	}
+	var wal *server.WALStore
+	if cfg.WALFileName != "" {
+		// store is rebuilt from the snapshot and write-ahead log before consuming any message
+		wal, err = server.NewWALStore(l, s, cfg.WALFileName, server.SyncPolicy(cfg.WALSyncPolicy), cfg.WALSyncInterval, cfg.SnapshotInterval)
+		if err != nil {
+			l.Fatal("failed to open write-ahead log", zap.Error(err))
+		}
+		s = wal
+	}
+	if cfg.StoreMaxItems > 0 || cfg.StoreMaxBytes > 0 {
+		// evictions go through the write-ahead log as removes, so they are durable as well
+		s, err = server.NewBoundedStore(l, s, cfg.StoreMaxItems, cfg.StoreMaxBytes, server.EvictionPolicy(cfg.StoreEvictionPolicy))
+		if err != nil {
+			l.Fatal("failed to create bounded store", zap.Error(err))
+		}
+	}
 
 	// output file writer
-	f, err := os.OpenFile(cfg.OutputFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o664)
+	f, err := helper.OpenRotatingFile(l, cfg.OutputFileName, cfg.RotateOptions())
 	if err != nil {
 		l.Fatal("failed to open output file", zap.Error(err))
 	}
+	// external logrotate moves the file and sends SIGHUP, results continue in a new file by the same name
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	go func() {
+		for range reopen {
+			if err := f.Reopen(); err != nil {
+				l.Error("failed to reopen output file", zap.Error(err))
+				continue
+			}
+			l.Info("output file reopened", zap.String("file", cfg.OutputFileName))
+		}
+	}()
 
 	// file server for viewing output.json file, This is just a helper
 	fileServer := helper.NewFileServer(l, cfg.OutputFileName, cfg.FileServerListenAddress)
 	go fileServer.Start()
 
-	server := server.New(l, f, q, s, cChan)
+	results, err := server.NewResultWriter(f, server.OutputFormat(cfg.OutputFormat))
+	if err != nil {
+		l.Fatal("failed to create result writer", zap.Error(err))
+	}
+	srv := server.New(l, results, q, s, workerPoolSize)
+	srv.SetMaxRetries(cfg.MaxRetries)
+	// partition depth and store size are read by the server at scrape time
+	prometheus.MustRegister(srv)
+
+	// change events are published to their own queue, the outbox decouples the publishing from the workers
+	var outbox *server.Outbox
+	var cdcQueue queue.Queue
+	if cfg.CDCTopic != "" {
+		cdcQueue, err = queue.Open(cfg.QueueDriver, l, cfg.QueueConnString, cfg.CDCTopic, appName, cfg.QueueOptions()...)
+		if err != nil {
+			l.Fatal("failed to create change event queue", zap.Error(err))
+		}
+		outbox = server.NewOutbox(l, cdcQueue, cfg.CDCOutboxSize)
+		srv.OnChange(outbox.Capture)
+		go outbox.Run()
+	}
+
+	// http and grpc apis apply the requests through the same workers as the queue messages,
+	// the http api serves the metrics as well
+	api := server.NewAPI(l, srv, cfg.APIListenAddress)
+	go api.Start()
+	grpcServer := server.NewGRPCServer(l, srv, cfg.GRPCListenAddress)
+	go grpcServer.Start()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := new(sync.WaitGroup)
@@ -56,15 +130,18 @@ func main() {
 
 	shutdown := make(chan os.Signal, 1)
 	go func() {
-		if err := server.Start(ctx); err != nil {
+		if err := srv.Start(ctx); err != nil {
 			// queue consume failed,exit the program
 			shutdown <- syscall.SIGQUIT
 		}
 	}()
 
+	// evict expired keys in the background
+	go srv.Sweep(ctx, cfg.SweepInterval)
+
 	// start worker and add worker pool
 	for i := 1; i <= workerPoolSize; i++ {
-		go server.Process(ctx, wg, i)
+		go srv.Process(ctx, wg, i)
 	}
 
 	signal.Notify(shutdown, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -72,11 +149,45 @@ func main() {
 	<-shutdown
 	l.Warn("shutting down server!!!")
 
+	srv.Drain() // readiness fails from now on
+	time.Sleep(cfg.ShutdownDrainDelay)
+	api.Stop()        // stop accepting api requests before the workers exit
+	grpcServer.Stop() // ends the watch streams as well
 	fileServer.Stop() // stop the file server
 	cancel()          // cancel the context
 	// even if cancellation received, current running job will not be interrupted until it completes
 	// wait for all the workers to be completed
 	wg.Wait()
+	if outbox != nil {
+		outbox.Close() // publish the events of the messages applied before the workers exited
+		if err := cdcQueue.Close(); err != nil {
+			l.Error("failed to close change event queue", zap.Error(err))
+		}
+	}
+	// close the connection only after the workers are done, so the in flight messages are acknowledged
+	if err := q.Close(); err != nil {
+		l.Error("failed to close queue", zap.Error(err))
+	}
+	if b != nil {
+		if err := b.Close(); err != nil {
+			l.Error("failed to close embedded broker", zap.Error(err))
+		}
+	}
+	if wal != nil {
+		if err := wal.Close(); err != nil {
+			l.Error("failed to close write-ahead log", zap.Error(err))
+		}
+	}
+	signal.Stop(reopen)
+	// waits for the rotated segments to be compressed
+	if err := f.Close(); err != nil {
+		l.Error("failed to close output file", zap.Error(err))
+	}
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		l.Error("failed to flush spans", zap.Error(err))
+	}
 }
 
 func newLogger(appName, version string) *zap.Logger {
@@ -2,8 +2,11 @@ package helper
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"go.uber.org/zap"
 )
@@ -25,9 +28,12 @@ func NewFileServer(logger *zap.Logger, fileName, listenAddrs string) *FileServer
 
 func (f *FileServer) Start() {
 	path := "./"
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir(path)))
+	mux.HandleFunc("/segments", f.listSegments)
 	f.server = &http.Server{
 		Addr:    f.listenAddrs,
-		Handler: http.FileServer(http.Dir(path)),
+		Handler: mux,
 	}
 	f.logger.Info("Starting file server...,this is just helper to view output.json", zap.String("listeningAddress", f.listenAddrs), zap.String("path", path))
 	err := f.server.ListenAndServe()
@@ -43,3 +49,22 @@ func (f *FileServer) Stop() {
 		_ = f.server.Shutdown(context.Background())
 	}
 }
+
+// listSegments lists the output file followed by its rotated segments, newest first
+func (f *FileServer) listSegments(w http.ResponseWriter, _ *http.Request) {
+	segments, err := Segments(f.fileName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info, err := os.Stat(f.fileName); err == nil {
+		segments = append([]Segment{{Name: filepath.Base(f.fileName), Size: info.Size(), ModTime: info.ModTime()}}, segments...)
+	}
+	if segments == nil {
+		segments = []Segment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(segments); err != nil {
+		f.logger.Debug("failed to write segments", zap.Error(err))
+	}
+}
@@ -0,0 +1,320 @@
+package helper
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// segmentTimeFormat sorts the segments by the rotation time
+const segmentTimeFormat = "20060102T150405.000000000"
+
+// RotateOptions of the rotating file, zero value of a field disables it
+type RotateOptions struct {
+	// MaxSize in bytes, the file is rotated once a write makes it reach the size
+	MaxSize int64
+	// Interval the file is rotated at, checked on the writes so an idle file is not rotated
+	Interval time.Duration
+	// Compress gzips the rotated segments in the background
+	Compress bool
+	// MaxAge and MaxCount are the retention of the segments, older or excess segments are deleted
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// Segment is a rotated file, it is named after the file with the rotation time before the extension,
+// e.g. output-20230507T084640.819582000.json(.gz)
+type Segment struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Compressed bool      `json:"compressed"`
+}
+
+// RotatingFile is an append only file rotated by size and time, it is safe for concurrent use
+type RotatingFile struct {
+	logger *zap.Logger
+	name   string
+	opts   RotateOptions
+
+	mu       sync.Mutex
+	file     *os.File // nil after a failed open, it is opened again on the next write
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	// rotated segments are compressed and the retention is applied by a single background worker
+	cleanup chan struct{}
+	wg      sync.WaitGroup
+}
+
+func OpenRotatingFile(logger *zap.Logger, name string, opts RotateOptions) (*RotatingFile, error) {
+	r := &RotatingFile{
+		logger:  logger,
+		name:    name,
+		opts:    opts,
+		cleanup: make(chan struct{}, 1),
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	go r.cleanupLoop()
+	// segments left uncompressed or beyond the retention by the previous run
+	r.scheduleCleanup()
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o664)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", r.name, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat %s: %v", r.name, err)
+	}
+	r.file, r.size, r.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p in a single write, the file is rotated after the write once it is due,
+// so a record is never split across the segments
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if (r.opts.MaxSize > 0 && r.size >= r.opts.MaxSize) || (r.opts.Interval > 0 && time.Since(r.openedAt) >= r.opts.Interval) {
+		if err := r.rotate(); err != nil {
+			r.logger.Error("failed to rotate output file", zap.String("file", r.name), zap.Error(err))
+		}
+	}
+	return n, nil
+}
+
+// Size of the current file, the result writer uses it to start every segment with a header
+func (r *RotatingFile) Size() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+// Rotate renames the current file to a segment and continues with an empty file
+func (r *RotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	return r.rotate()
+}
+
+// rotate must be called with the lock held
+func (r *RotatingFile) rotate() error {
+	r.closeFile()
+	if r.size > 0 {
+		if err := os.Rename(r.name, segmentName(r.name, time.Now())); err != nil {
+			// keep appending to the same file rather than losing the results
+			if openErr := r.open(); openErr != nil {
+				return openErr
+			}
+			return fmt.Errorf("failed to rename %s: %v", r.name, err)
+		}
+		// the file is renamed, so the size is reset even if the new file fails to open
+		r.size = 0
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.scheduleCleanup()
+	return nil
+}
+
+// Reopen closes and opens the file again by name, used after the file is moved by an external logrotate
+func (r *RotatingFile) Reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closeFile()
+	return r.open()
+}
+
+// closeFile closes the current file if it is open, must be called with the lock held
+func (r *RotatingFile) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		r.logger.Warn("failed to close output file", zap.String("file", r.name), zap.Error(err))
+	}
+	r.file = nil
+}
+
+// Close closes the file and waits for the background compression to finish,
+// the cleanup worker is stopped even if the file failed to open on the last rotation
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return os.ErrClosed
+	}
+	r.closed = true
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	close(r.cleanup)
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+// scheduleCleanup signals the cleanup worker, signals are coalesced since every run handles all the segments
+func (r *RotatingFile) scheduleCleanup() {
+	select {
+	case r.cleanup <- struct{}{}:
+	default:
+	}
+}
+
+func (r *RotatingFile) cleanupLoop() {
+	defer r.wg.Done()
+	for range r.cleanup {
+		if r.opts.Compress {
+			r.compressSegments()
+		}
+		r.applyRetention()
+	}
+}
+
+func (r *RotatingFile) compressSegments() {
+	segments, err := Segments(r.name)
+	if err != nil {
+		r.logger.Error("failed to list segments", zap.String("file", r.name), zap.Error(err))
+		return
+	}
+	dir := filepath.Dir(r.name)
+	for _, segment := range segments {
+		if segment.Compressed {
+			continue
+		}
+		if err := compress(filepath.Join(dir, segment.Name)); err != nil {
+			r.logger.Error("failed to compress segment", zap.String("segment", segment.Name), zap.Error(err))
+		}
+	}
+}
+
+func (r *RotatingFile) applyRetention() {
+	if r.opts.MaxAge <= 0 && r.opts.MaxCount <= 0 {
+		return
+	}
+	segments, err := Segments(r.name)
+	if err != nil {
+		r.logger.Error("failed to list segments", zap.String("file", r.name), zap.Error(err))
+		return
+	}
+	dir := filepath.Dir(r.name)
+	// segments are listed newest first
+	for i, segment := range segments {
+		expired := r.opts.MaxAge > 0 && time.Since(segment.ModTime) > r.opts.MaxAge
+		excess := r.opts.MaxCount > 0 && i >= r.opts.MaxCount
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, segment.Name)); err != nil {
+			r.logger.Error("failed to delete segment", zap.String("segment", segment.Name), zap.Error(err))
+		}
+	}
+}
+
+// compress gzips the file next to it and deletes the original, the gzip file appears only once it is complete
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := name + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o664)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
+
+func segmentName(name string, at time.Time) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + at.UTC().Format(segmentTimeFormat) + ext
+}
+
+// Segments lists the rotated segments of the file, newest first
+func Segments(name string) ([]Segment, error) {
+	ext := filepath.Ext(name)
+	prefix := filepath.Base(strings.TrimSuffix(name, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	var segments []Segment
+	for _, entry := range entries {
+		segmentName := entry.Name()
+		compressed := strings.HasSuffix(segmentName, ext+".gz")
+		stamp := strings.TrimPrefix(strings.TrimSuffix(strings.TrimSuffix(segmentName, ".gz"), ext), prefix)
+		if entry.IsDir() || !strings.HasPrefix(segmentName, prefix) || (!compressed && !strings.HasSuffix(segmentName, ext)) {
+			continue
+		}
+		if _, err := time.Parse(segmentTimeFormat, stamp); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+		segments = append(segments, Segment{Name: segmentName, Size: info.Size(), ModTime: info.ModTime(), Compressed: compressed})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Name > segments[j].Name })
+	return segments, nil
+}
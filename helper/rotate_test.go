@@ -0,0 +1,140 @@
+package helper
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "output.json")
+	// unrelated files next to the output are not segments
+	assert.Equal(t, nil, os.WriteFile(filepath.Join(dir, "output-backup.json"), []byte("{}"), 0o664))
+
+	f, err := OpenRotatingFile(zap.NewNop(), name, RotateOptions{MaxSize: 10, Compress: true, MaxCount: 2})
+	assert.Equal(t, nil, err)
+	for _, line := range []string{"1111\n", "2222\n", "3333\n", "4444\n", "5555\n", "6666\n", "7777\n"} {
+		n, err := f.Write([]byte(line))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(line), n)
+	}
+	// the last line is below the size, so it stays in the file
+	assert.Equal(t, int64(5), f.Size())
+	assert.Equal(t, nil, f.Close())
+	_, err = f.Write([]byte("8888\n"))
+	assert.Equal(t, os.ErrClosed, err)
+
+	// three segments are rotated, the oldest is deleted by the retention
+	segments, err := Segments(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(segments))
+	assert.Equal(t, "5555\n6666\n", readSegment(t, filepath.Join(dir, segments[0].Name)))
+	assert.Equal(t, "3333\n4444\n", readSegment(t, filepath.Join(dir, segments[1].Name)))
+	for _, segment := range segments {
+		assert.Equal(t, true, segment.Compressed)
+	}
+	data, err := os.ReadFile(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "7777\n", string(data))
+}
+
+func TestRotatingFile_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "output.json")
+	f, err := OpenRotatingFile(zap.NewNop(), name, RotateOptions{})
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	_, err = f.Write([]byte("1111\n"))
+	assert.Equal(t, nil, err)
+
+	// logrotate moves the file away, writes go to the moved file until it is reopened
+	assert.Equal(t, nil, os.Rename(name, name+".1"))
+	_, err = f.Write([]byte("2222\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, f.Reopen())
+	_, err = f.Write([]byte("3333\n"))
+	assert.Equal(t, nil, err)
+
+	data, err := os.ReadFile(name + ".1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "1111\n2222\n", string(data))
+	data, err = os.ReadFile(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "3333\n", string(data))
+}
+
+func TestRotatingFile_MaxAge(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "output.json")
+	old := filepath.Join(dir, "output-20230101T000000.000000000.json")
+	assert.Equal(t, nil, os.WriteFile(old, []byte("old\n"), 0o664))
+	assert.Equal(t, nil, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)))
+
+	// every write is past the interval, the retention is applied to the segments of the previous run as well
+	f, err := OpenRotatingFile(zap.NewNop(), name, RotateOptions{Interval: time.Nanosecond, MaxAge: time.Hour})
+	assert.Equal(t, nil, err)
+	_, err = f.Write([]byte("new\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), f.Size())
+	assert.Equal(t, nil, f.Close())
+
+	segments, err := Segments(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(segments))
+	assert.Equal(t, false, segments[0].Compressed)
+	assert.Equal(t, "new\n", readSegment(t, filepath.Join(dir, segments[0].Name)))
+}
+
+func TestRotatingFile_OpenFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "output")
+	assert.Equal(t, nil, os.Mkdir(dir, 0o775))
+	name := filepath.Join(dir, "output.json")
+	f, err := OpenRotatingFile(zap.NewNop(), name, RotateOptions{})
+	assert.Equal(t, nil, err)
+	_, err = f.Write([]byte("1111\n"))
+	assert.Equal(t, nil, err)
+
+	// rotation fails to open the file while the directory is gone, the writes fail until it is back
+	assert.Equal(t, nil, os.RemoveAll(dir))
+	assert.NotEqual(t, nil, f.Rotate())
+	_, err = f.Write([]byte("2222\n"))
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, os.ErrClosed, err)
+	assert.Equal(t, nil, os.Mkdir(dir, 0o775))
+	_, err = f.Write([]byte("3333\n"))
+	assert.Equal(t, nil, err)
+	data, err := os.ReadFile(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "3333\n", string(data))
+
+	// close stops the cleanup worker even if the file is not open
+	assert.Equal(t, nil, os.RemoveAll(dir))
+	assert.NotEqual(t, nil, f.Rotate())
+	assert.Equal(t, nil, f.Close())
+	assert.Equal(t, os.ErrClosed, f.Close())
+	_, err = f.Write([]byte("4444\n"))
+	assert.Equal(t, os.ErrClosed, err)
+}
+
+func readSegment(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	var r io.Reader = f
+	if filepath.Ext(name) == ".gz" {
+		zr, err := gzip.NewReader(f)
+		assert.Equal(t, nil, err)
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	assert.Equal(t, nil, err)
+	return string(data)
+}
@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.uber.org/zap"
+)
+
+// NewBatch packs the messages into one batch message, the messages are gzipped if compress is set
+func NewBatch(messages []*types.Message, compress bool) (*types.Message, error) {
+	batch := &types.Message{Action: types.Batch}
+	if !compress {
+		batch.Messages = messages
+		return batch, nil
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if err := json.NewEncoder(zw).Encode(messages); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	batch.Compressed = buf.Bytes()
+	return batch, nil
+}
+
+// Unbatch returns the messages of the batch in publish order, they take the transport properties of the batch
+// (app id, headers, redelivered). messages of a batch are not requests, so they have no reply address
+func Unbatch(batch *types.Message) ([]*types.Message, error) {
+	if batch.Action != types.Batch {
+		return nil, fmt.Errorf("message is not a batch: %s", batch.Action)
+	}
+	messages := batch.Messages
+	if len(batch.Compressed) > 0 {
+		zr, err := gzip.NewReader(bytes.NewReader(batch.Compressed))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress batch: %w", err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress batch: %w", err)
+		}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal batch: %w", err)
+		}
+	}
+	for i, message := range messages {
+		if message == nil {
+			return nil, fmt.Errorf("message %d of the batch is null", i)
+		}
+		message.AppID = batch.AppID
+		message.Redelivered = batch.Redelivered
+		message.Retries = batch.Retries
+		message.Headers = copyHeaders(batch.Headers)
+	}
+	return messages, nil
+}
+
+// BatchOptions are the thresholds of the batcher, zero disables a threshold
+type BatchOptions struct {
+	// MaxMessages and MaxBytes publish the batch once it holds as many messages or json encoded bytes,
+	// the bytes are counted before the compression
+	MaxMessages int
+	MaxBytes    int
+	// Linger publishes the batch once it is elapsed since the first message of the batch
+	Linger time.Duration
+	// Compress gzips the messages of the batch
+	Compress bool
+}
+
+// Batcher packs the published messages into batch messages, so a bulk load takes one delivery per batch
+// instead of one per message. requests are not batched, the pending batch is published before a request
+// so the request is ordered after the messages published before it. the batch carries the headers of its
+// first message, so the messages of a batch continue the trace of the first one
+type Batcher struct {
+	Queue
+	logger *zap.Logger
+	opts   BatchOptions
+
+	mu      sync.Mutex
+	pending []*types.Message
+	size    int
+	timer   *time.Timer // linger timer of the pending batch
+	closed  bool
+	// err is the error of publishing the pending batch, it is kept and published again before a message is taken
+	err error
+}
+
+var _ HealthChecker = (*Batcher)(nil)
+
+// NewBatcher wraps the queue, the pending batch is published when the batcher is closed
+func NewBatcher(logger *zap.Logger, q Queue, opts BatchOptions) *Batcher {
+	return &Batcher{
+		Queue:  q,
+		logger: logger,
+		opts:   opts,
+	}
+}
+
+// Publish adds the message to the pending batch. the message completing the batch gets the error of publishing it,
+// the message is not taken then while the messages before it are kept and published again by the next Publish
+// or Flush. a message is not taken either while the pending batch cannot be published
+func (b *Batcher) Publish(message *types.Message) error {
+	message.Timestamp = time.Now()
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if b.err != nil {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	b.pending = append(b.pending, message)
+	b.size += len(body)
+	if (b.opts.MaxMessages > 0 && len(b.pending) >= b.opts.MaxMessages) || (b.opts.MaxBytes > 0 && b.size >= b.opts.MaxBytes) {
+		if err := b.flush(); err != nil {
+			b.pending, b.size = b.pending[:len(b.pending)-1], b.size-len(body)
+			return err
+		}
+	}
+	if b.timer == nil && b.opts.Linger > 0 {
+		b.timer = time.AfterFunc(b.opts.Linger, b.linger)
+	}
+	return nil
+}
+
+// Request publishes the pending batch first, then the request on its own
+func (b *Batcher) Request(ctx context.Context, message *types.Message) (*types.Response, error) {
+	if err := b.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Queue.Request(ctx, message)
+}
+
+// Flush publishes the pending batch, noop if there is none
+func (b *Batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+func (b *Batcher) linger() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count := len(b.pending)
+	if err := b.flush(); err != nil {
+		b.logger.Error("failed to publish batch, retrying", zap.Int("count", count), zap.Error(err))
+		if !b.closed && b.timer == nil {
+			b.timer = time.AfterFunc(b.opts.Linger, b.linger)
+		}
+	}
+}
+
+// flush publishes the pending batch, it is kept if it fails to publish. expects the lock to be held
+func (b *Batcher) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return nil
+	}
+	batch, err := NewBatch(b.pending, b.opts.Compress)
+	if err == nil {
+		batch.Headers = copyHeaders(b.pending[0].Headers)
+		err = b.Queue.Publish(batch)
+	}
+	if err != nil {
+		b.err = fmt.Errorf("failed to publish batch of %d messages: %w", len(b.pending), err)
+		return b.err
+	}
+	b.pending, b.size, b.err = nil, 0, nil
+	return nil
+}
+
+// Health reports the pending batch failing to publish as well as the queue health
+func (b *Batcher) Health() error {
+	b.mu.Lock()
+	err := b.err
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return Health(b.Queue)
+}
+
+// Close publishes the pending batch and closes the queue
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	err := b.flush()
+	b.mu.Unlock()
+	if closeErr := b.Queue.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
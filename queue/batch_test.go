@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestBatch(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			at := time.Now().UTC()
+			messages := []*types.Message{
+				{Action: types.AddItem, Key: "a", Value: "1", Timestamp: at, TTL: 1000},
+				{Action: types.RemoveItem, Key: "b", Timestamp: at},
+			}
+			batch, err := NewBatch(messages, compress)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, compress, len(batch.Compressed) > 0)
+
+			// over the wire and back
+			body, err := json.Marshal(batch)
+			assert.Equal(t, nil, err)
+			received := new(types.Message)
+			assert.Equal(t, nil, json.Unmarshal(body, received))
+			received.AppID = "client"
+			received.Redelivered = true
+			received.Headers = map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+
+			unpacked, err := Unbatch(received)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, 2, len(unpacked))
+			for i, message := range unpacked {
+				assert.Equal(t, messages[i].Action, message.Action)
+				assert.Equal(t, messages[i].Key, message.Key)
+				assert.Equal(t, messages[i].Value, message.Value)
+				assert.Equal(t, messages[i].TTL, message.TTL)
+				assert.Equal(t, true, messages[i].Timestamp.Equal(message.Timestamp))
+				assert.Equal(t, "client", message.AppID)
+				assert.Equal(t, true, message.Redelivered)
+				assert.Equal(t, received.Headers, message.Headers)
+			}
+		})
+	}
+
+	_, err := Unbatch(&types.Message{Action: types.Batch, Compressed: []byte("not gzip")})
+	assert.NotEqual(t, nil, err)
+	_, err = Unbatch(&types.Message{Action: types.AddItem})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestBatcher(t *testing.T) {
+	l := zap.NewNop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer := NewMemory(l, t.Name())
+	defer consumer.Close()
+	deliveries, err := consumer.Consume(ctx)
+	assert.Equal(t, nil, err)
+	receive := func() *types.Message {
+		t.Helper()
+		select {
+		case msg := <-deliveries:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("no batch received")
+			return nil
+		}
+	}
+	publish := func(b *Batcher, keys ...string) {
+		t.Helper()
+		for _, key := range keys {
+			assert.Equal(t, nil, b.Publish(&types.Message{Action: types.AddItem, Key: key}))
+		}
+	}
+	unbatch := func(batch *types.Message) []string {
+		t.Helper()
+		messages, err := Unbatch(batch)
+		assert.Equal(t, nil, err)
+		keys := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			keys = append(keys, msg.Key)
+		}
+		return keys
+	}
+
+	// count threshold
+	b := NewBatcher(l, NewMemory(l, t.Name()), BatchOptions{MaxMessages: 3, Compress: true})
+	publish(b, "a", "b")
+	assert.Equal(t, 0, consumer.topic.len())
+	publish(b, "c", "d")
+	assert.Equal(t, []string{"a", "b", "c"}, unbatch(receive()))
+	// pending batch is published before the request, so the request is not overtaking it
+	reqCtx, reqCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, err = b.Request(reqCtx, &types.Message{Action: types.GetItem, Key: "d"})
+	reqCancel()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, []string{"d"}, unbatch(receive()))
+	assert.Equal(t, types.GetItem, receive().Action)
+	// pending batch is published on close
+	publish(b, "e")
+	assert.Equal(t, nil, b.Close())
+	assert.Equal(t, []string{"e"}, unbatch(receive()))
+	assert.Equal(t, ErrClosed, b.Publish(&types.Message{Action: types.AddItem, Key: "f"}))
+
+	// size threshold, every message is about 80 bytes encoded
+	b = NewBatcher(l, NewMemory(l, t.Name()), BatchOptions{MaxBytes: 200})
+	publish(b, "a", "b", "c")
+	assert.Equal(t, []string{"a", "b", "c"}, unbatch(receive()))
+
+	// linger
+	b = NewBatcher(l, NewMemory(l, t.Name()), BatchOptions{MaxMessages: 100, Linger: 10 * time.Millisecond})
+	publish(b, "a", "b")
+	assert.Equal(t, []string{"a", "b"}, unbatch(receive()))
+	assert.Equal(t, nil, b.Close())
+}
+
+// failingQueue fails the publishes while err is set
+type failingQueue struct {
+	Queue
+	mu  sync.Mutex
+	err error
+}
+
+func (f *failingQueue) Publish(message *types.Message) error {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.Queue.Publish(message)
+}
+
+func (f *failingQueue) fail(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.mu.Unlock()
+}
+
+func TestBatcher_PublishFailed(t *testing.T) {
+	l := zap.NewNop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumer := NewMemory(l, t.Name())
+	defer consumer.Close()
+	deliveries, err := consumer.Consume(ctx)
+	assert.Equal(t, nil, err)
+	unbatch := func() []string {
+		t.Helper()
+		select {
+		case batch := <-deliveries:
+			messages, err := Unbatch(batch)
+			assert.Equal(t, nil, err)
+			keys := make([]string, 0, len(messages))
+			for _, msg := range messages {
+				keys = append(keys, msg.Key)
+			}
+			return keys
+		case <-time.After(2 * time.Second):
+			t.Fatal("no batch received")
+			return nil
+		}
+	}
+	down := errors.New("broker is down")
+
+	// the message completing the batch is not taken, the messages before it are kept
+	q := &failingQueue{Queue: NewMemory(l, t.Name())}
+	b := NewBatcher(l, q, BatchOptions{MaxMessages: 2})
+	assert.Equal(t, nil, b.Publish(&types.Message{Action: types.AddItem, Key: "a"}))
+	q.fail(down)
+	assert.Equal(t, true, errors.Is(b.Publish(&types.Message{Action: types.AddItem, Key: "b"}), down))
+	assert.Equal(t, true, errors.Is(b.Health(), down))
+	// no message is taken until the pending batch is published
+	assert.Equal(t, true, errors.Is(b.Publish(&types.Message{Action: types.AddItem, Key: "c"}), down))
+	q.fail(nil)
+	assert.Equal(t, nil, b.Publish(&types.Message{Action: types.AddItem, Key: "b"}))
+	assert.Equal(t, []string{"a"}, unbatch())
+	assert.Equal(t, nil, b.Health())
+	assert.Equal(t, nil, b.Close())
+	assert.Equal(t, []string{"b"}, unbatch())
+
+	// linger publishes the batch again until it succeeds
+	q = &failingQueue{Queue: NewMemory(l, t.Name()), err: down}
+	b = NewBatcher(l, q, BatchOptions{MaxMessages: 100, Linger: 5 * time.Millisecond})
+	assert.Equal(t, nil, b.Publish(&types.Message{Action: types.AddItem, Key: "a"}))
+	time.Sleep(20 * time.Millisecond)
+	q.fail(nil)
+	assert.Equal(t, []string{"a"}, unbatch())
+	assert.Equal(t, nil, b.Close())
+}
@@ -0,0 +1,260 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sort"
+	"sync"
+
+	"github.com/bhakiyakalimuthu/server-clique/queuepb"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// content types of the built-in codecs
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeCBOR     = "application/cbor"
+)
+
+var ErrUnknownContentType = errors.New("unknown content type")
+
+// Codec encodes the messages on the wire, the content type of the codec travels with every message
+// (e.g. as the amqp content type) so the consumer decodes it with the codec of the producer.
+// responses and change events are always json
+type Codec interface {
+	// Name is the name the codec is configured by
+	Name() string
+	ContentType() string
+	Marshal(*types.Message) ([]byte, error)
+	Unmarshal([]byte, *types.Message) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec) // by content type
+)
+
+func init() {
+	RegisterCodec(JSON)
+	RegisterCodec(Protobuf)
+	RegisterCodec(Msgpack)
+	RegisterCodec(CBOR)
+}
+
+// RegisterCodec makes the codec available to the producers by its name and to the consumers by its content type,
+// it panics if the content type is registered twice
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[codec.ContentType()]; ok {
+		panic("queue: codec registered twice " + codec.ContentType())
+	}
+	codecs[codec.ContentType()] = codec
+}
+
+// Codecs returns the sorted names of the registered codecs
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CodecByName returns the registered codec of the name
+func CodecByName(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// codecFor returns the codec of the content type, parameters (e.g. charset) are ignored.
+// messages without content type are json, the producers before the codecs did not set it
+func codecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownContentType, contentType)
+	}
+	codecsMu.RLock()
+	codec, ok := codecs[mediaType]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownContentType, contentType)
+	}
+	return codec, nil
+}
+
+// decode unmarshals the body with the codec of the content type
+func decode(contentType string, body []byte) (*types.Message, error) {
+	codec, err := codecFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+	m := new(types.Message)
+	if err := codec.Unmarshal(body, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// JSON is the default codec
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(message *types.Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Unmarshal(data []byte, message *types.Message) error {
+	return json.Unmarshal(data, message)
+}
+
+// Msgpack and CBOR encode the fields by their json names
+var (
+	Msgpack Codec = msgpackCodec{}
+	CBOR    Codec = cborCodec{
+		enc: mustEncMode(cbor.EncOptions{Time: cbor.TimeRFC3339Nano}),
+		dec: mustDecMode(cbor.DecOptions{}),
+	}
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (msgpackCodec) Marshal(message *types.Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	if err := enc.Encode(message); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, message *types.Message) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(message)
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func (cborCodec) Name() string        { return "cbor" }
+func (cborCodec) ContentType() string { return ContentTypeCBOR }
+
+func (c cborCodec) Marshal(message *types.Message) ([]byte, error) {
+	return c.enc.Marshal(message)
+}
+
+func (c cborCodec) Unmarshal(data []byte, message *types.Message) error {
+	return c.dec.Unmarshal(data, message)
+}
+
+func mustEncMode(opts cbor.EncOptions) cbor.EncMode {
+	mode, err := opts.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+func mustDecMode(opts cbor.DecOptions) cbor.DecMode {
+	mode, err := opts.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+// Protobuf encodes the message as queuepb.Message
+var Protobuf Codec = protobufCodec{}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string        { return "protobuf" }
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(message *types.Message) ([]byte, error) {
+	return proto.Marshal(toProto(message))
+}
+
+func (protobufCodec) Unmarshal(data []byte, message *types.Message) error {
+	pb := new(queuepb.Message)
+	if err := proto.Unmarshal(data, pb); err != nil {
+		return err
+	}
+	*message = *fromProto(pb)
+	return nil
+}
+
+func toProto(message *types.Message) *queuepb.Message {
+	pb := &queuepb.Message{
+		Action:     message.Action.String(),
+		Key:        message.Key,
+		Value:      message.Value,
+		Ttl:        message.TTL,
+		Version:    message.Version,
+		Compressed: message.Compressed,
+	}
+	if !message.Timestamp.IsZero() {
+		pb.Timestamp = timestamppb.New(message.Timestamp)
+	}
+	for _, op := range message.Ops {
+		pb.Ops = append(pb.Ops, &queuepb.Op{Action: op.Action.String(), Key: op.Key, Value: op.Value, Ttl: op.TTL, IfVersion: op.IfVersion})
+	}
+	for _, m := range message.Messages {
+		pb.Messages = append(pb.Messages, toProto(m))
+	}
+	return pb
+}
+
+func fromProto(pb *queuepb.Message) *types.Message {
+	message := &types.Message{
+		Action:     types.Action(pb.Action),
+		Key:        pb.Key,
+		Value:      pb.Value,
+		TTL:        pb.Ttl,
+		Version:    pb.Version,
+		Compressed: pb.Compressed,
+	}
+	if pb.Timestamp != nil {
+		message.Timestamp = pb.Timestamp.AsTime()
+	}
+	for _, op := range pb.Ops {
+		message.Ops = append(message.Ops, types.Op{Action: types.Action(op.Action), Key: op.Key, Value: op.Value, TTL: op.Ttl, IfVersion: op.IfVersion})
+	}
+	for _, m := range pb.Messages {
+		message.Messages = append(message.Messages, fromProto(m))
+	}
+	return message
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/broker"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestCodecs(t *testing.T) {
+	assert.Equal(t, []string{"cbor", "json", "msgpack", "protobuf"}, Codecs())
+	ifVersion := uint64(3)
+	timestamp := time.Date(2023, 5, 1, 10, 30, 0, 123456789, time.UTC)
+	for _, name := range Codecs() {
+		t.Run(name, func(t *testing.T) {
+			codec, err := CodecByName(name)
+			assert.Equal(t, nil, err)
+			message := &types.Message{
+				Action:    types.Txn,
+				Key:       "A",
+				Value:     "a",
+				TTL:       60,
+				Version:   2,
+				Timestamp: timestamp,
+				Ops: []types.Op{
+					{Action: types.AddItem, Key: "A", Value: "a", TTL: 10},
+					{Action: types.RemoveItem, Key: "B", IfVersion: &ifVersion},
+				},
+				Messages: []*types.Message{
+					{Action: types.AddItem, Key: "C", Value: "c"},
+					{Action: types.GetItem, Key: "C"},
+				},
+				Compressed: []byte{1, 2, 3},
+				// not sent over the wire
+				ReplyTo: "reply",
+				Headers: map[string]string{"key": "value"},
+			}
+			data, err := codec.Marshal(message)
+			assert.Equal(t, nil, err)
+
+			decoded, err := decode(codec.ContentType(), data)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, true, decoded.Timestamp.Equal(timestamp))
+			decoded.Timestamp = timestamp
+			message.ReplyTo, message.Headers = "", nil
+			assert.Equal(t, message, decoded)
+		})
+	}
+
+	_, err := CodecByName("xml")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		codec       Codec
+		err         error
+	}{
+		{contentType: "", codec: JSON},
+		{contentType: "application/json; charset=utf-8", codec: JSON},
+		{contentType: "application/x-protobuf", codec: Protobuf},
+		{contentType: "application/msgpack", codec: Msgpack},
+		{contentType: "application/cbor", codec: CBOR},
+		{contentType: "text/plain", err: ErrUnknownContentType},
+		{contentType: "application/", err: ErrUnknownContentType},
+	}
+	for _, tt := range tests {
+		codec, err := codecFor(tt.contentType)
+		assert.Equal(t, tt.err, errors.Unwrap(err))
+		assert.Equal(t, tt.codec, codec)
+	}
+}
+
+// TestCodec_MixedTraffic publishes with every codec to the same queue, the consumer decodes each message
+// by its content type and dead letters the message it has no codec for
+func TestCodec_MixedTraffic(t *testing.T) {
+	l := zap.NewNop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server := NewMemory(l, t.Name())
+	defer server.Close()
+	msgChan, err := server.Consume(ctx)
+	assert.Equal(t, nil, err)
+
+	for _, name := range Codecs() {
+		codec, err := CodecByName(name)
+		assert.Equal(t, nil, err)
+		client := NewMemory(l, t.Name(), WithCodec(codec))
+		assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: name, Value: name, Headers: map[string]string{"codec": name}}))
+		assert.Equal(t, nil, client.Close())
+	}
+	memoryTopicOf(t.Name()).push(memoryMessage{body: []byte("<add/>"), contentType: "application/xml", headers: map[string]string{"key": "value"}})
+	for _, name := range Codecs() {
+		msg := receive(t, msgChan)
+		assert.Equal(t, types.AddItem, msg.Action)
+		assert.Equal(t, name, msg.Key)
+		assert.Equal(t, name, msg.Value)
+		assert.Equal(t, map[string]string{"codec": name}, msg.Headers)
+		assert.Equal(t, nil, msg.Ack())
+	}
+
+	// dead lettered message is kept as it is
+	dlq := memoryTopicOf(DeadLetterQueue(t.Name()))
+	for i := 0; dlq.len() == 0; i++ {
+		if i == 100 {
+			t.Fatal("message is not dead lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	msg, _ := dlq.pop()
+	assert.Equal(t, []byte("<add/>"), msg.body)
+	assert.Equal(t, "application/xml", msg.contentType)
+	assert.Equal(t, "value", msg.headers["key"])
+	assert.Equal(t, ReasonUnknownContentType, msg.headers[HeaderDeadLetterReason])
+	assert.Equal(t, `unknown content type "application/xml"`, msg.headers[HeaderDeadLetterError])
+}
+
+func TestTCP_DeadLetter(t *testing.T) {
+	l := zap.NewNop()
+	b, err := broker.Listen(l, "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q, err := NewTCP(l, b.Addr().String(), "queue", "server", WithCodec(Msgpack), WithDeadLetterQueue("dead"))
+	assert.Equal(t, nil, err)
+	defer q.Close()
+	msgChan, err := q.Consume(ctx)
+	assert.Equal(t, nil, err)
+	dead := &tcpSub{queue: "dead", deliveries: make(chan tcpDelivery), done: make(chan struct{})}
+	assert.Equal(t, nil, q.subscribe(dead))
+
+	assert.Equal(t, nil, q.publish(&broker.Frame{Op: broker.OpPublish, Queue: "queue", ContentType: "application/xml", Body: []byte("<add/>")}))
+	assert.Equal(t, nil, q.Publish(&types.Message{Action: types.AddItem, Key: "A", Value: "a"}))
+	msg := receive(t, msgChan)
+	assert.Equal(t, "A", msg.Key)
+	assert.Equal(t, nil, msg.Ack())
+
+	select {
+	case d := <-dead.deliveries:
+		assert.Equal(t, []byte("<add/>"), d.frame.Body)
+		assert.Equal(t, "application/xml", d.frame.ContentType)
+		assert.Equal(t, ReasonUnknownContentType, d.frame.Headers[HeaderDeadLetterReason])
+		assert.Equal(t, nil, d.Ack())
+	case <-ctx.Done():
+		t.Fatal("message is not dead lettered")
+	}
+}
@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+)
+
+// dead lettered messages keep their body and content type, the failure is added to their headers
+const (
+	HeaderDeadLetterReason = "x-dead-letter-reason"
+	HeaderDeadLetterError  = "x-dead-letter-error"
+	HeaderDeadLetterSource = "x-dead-letter-source" // queue the message was dead lettered from
+	// HeaderRetries counts the requeues of the message by the brokers which do not count them (amqp, kafka)
+	HeaderRetries = "x-retries"
+)
+
+// reasons of the dead lettered messages
+const (
+	ReasonUnknownContentType = "unknown_content_type" // no codec is registered for the content type of the message
+	ReasonMalformed          = "malformed"            // message body failed to decode
+	ReasonUnknownAction      = "unknown_action"       // action of the message is not known by the server
+	ReasonRetriesExceeded    = "retries_exceeded"     // message failed to be processed more than the max retries
+	ReasonTooLarge           = "too_large"            // write of the message is larger than the store accepts
+)
+
+// DeadLetterQueue is the default dead letter queue of the queue
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// deadLetterQueueOf returns the dead letter queue of the consumed queue
+func (o options) deadLetterQueueOf(queueName string) string {
+	if o.deadLetterQueue != "" {
+		return o.deadLetterQueue
+	}
+	return DeadLetterQueue(queueName)
+}
+
+// reasonOf returns the dead letter reason of the decode error
+func reasonOf(err error) string {
+	if errors.Is(err, ErrUnknownContentType) {
+		return ReasonUnknownContentType
+	}
+	return ReasonMalformed
+}
+
+// retriesOf returns the retries counted in HeaderRetries and the headers without it
+func retriesOf(headers map[string]string) (int, map[string]string) {
+	value, ok := headers[HeaderRetries]
+	if !ok {
+		return 0, headers
+	}
+	retries, _ := strconv.Atoi(value)
+	delete(headers, HeaderRetries)
+	if len(headers) == 0 {
+		headers = nil
+	}
+	return retries, headers
+}
+
+// deadLetterHeaders returns a copy of the headers with the failure added
+func deadLetterHeaders(headers map[string]string, source, reason string, err error) map[string]string {
+	out := make(map[string]string, len(headers)+3)
+	for key, value := range headers {
+		out[key] = value
+	}
+	out[HeaderDeadLetterSource] = source
+	out[HeaderDeadLetterReason] = reason
+	out[HeaderDeadLetterError] = err.Error()
+	return out
+}
+
+// Envelope is a message as it is on the wire, the dead letter queue is read as envelopes since
+// the dead lettered messages may not decode
+type Envelope struct {
+	// Key is the message key the kafka messages are partitioned by, it is empty for the other drivers
+	Key           string
+	Body          []byte
+	ContentType   string
+	ReplyTo       string
+	CorrelationID string
+	AppID         string
+	Headers       map[string]string
+	// Acknowledger is set on the consumed envelopes
+	Acknowledger types.Acknowledger
+}
+
+// Ack acknowledges the delivery of the envelope, noop if it was not consumed
+func (e *Envelope) Ack() error {
+	if e.Acknowledger == nil {
+		return nil
+	}
+	return e.Acknowledger.Ack()
+}
+
+// RawQueue is implemented by the queues whose messages can be consumed and published without decoding
+type RawQueue interface {
+	// ConsumeRaw feeds the returned channel with the messages of the queue until the context is done,
+	// the consumer is not resumed once the connection is lost
+	ConsumeRaw(ctx context.Context, queueName string) (<-chan *Envelope, error)
+	PublishRaw(queueName string, envelope *Envelope) error
+}
+
+// Republisher is implemented by the queues which can publish a consumed message on its own again, so a message
+// unpacked from a batch is requeued or dead lettered without the rest of the batch
+type Republisher interface {
+	// RequeueMessage publishes the message to the tail of the queue with its retries counted in HeaderRetries
+	RequeueMessage(*types.Message) error
+	// DeadLetterMessage publishes the message to the dead letter queue with the failure in the headers
+	DeadLetterMessage(message *types.Message, reason string, err error) error
+}
+
+// envelopeOf encodes the message with the codec of the queue to publish it again with the headers
+func (o options) envelopeOf(message *types.Message, headers map[string]string) (*Envelope, error) {
+	body, err := o.codec.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Key:           message.Key,
+		Body:          body,
+		ContentType:   o.codec.ContentType(),
+		ReplyTo:       message.ReplyTo,
+		CorrelationID: message.CorrelationID,
+		AppID:         message.AppID,
+		Headers:       headers,
+	}, nil
+}
+
+// requeueMessage publishes the message to the tail of the queue name with its retries counted in HeaderRetries
+func requeueMessage(q RawQueue, o options, queueName string, message *types.Message) error {
+	headers := copyHeaders(message.Headers)
+	if headers == nil {
+		headers = make(map[string]string, 1)
+	}
+	headers[HeaderRetries] = strconv.Itoa(message.Retries + 1)
+	envelope, err := o.envelopeOf(message, headers)
+	if err != nil {
+		return err
+	}
+	return q.PublishRaw(queueName, envelope)
+}
+
+// deadLetterMessage publishes the message to the dead letter queue of the queue name with the failure in the headers
+func deadLetterMessage(q RawQueue, o options, queueName string, message *types.Message, reason string, err error) error {
+	envelope, encodeErr := o.envelopeOf(message, deadLetterHeaders(message.Headers, queueName, reason, err))
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return q.PublishRaw(o.deadLetterQueueOf(queueName), envelope)
+}
+
+// ReadDeadLetters feeds fn the messages of the dead letter queue until no message is delivered for idle,
+// or limit messages are read if it is not zero. messages are settled by fn, it returns the number of messages read
+func ReadDeadLetters(ctx context.Context, q RawQueue, deadLetterQueue string, idle time.Duration, limit int, fn func(*Envelope) error) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	envelopes, err := q.ConsumeRaw(ctx, deadLetterQueue)
+	if err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	read := 0
+	for limit == 0 || read < limit {
+		select {
+		case envelope, ok := <-envelopes:
+			if !ok {
+				return read, fmt.Errorf("dead letter queue consumer stopped: %w", ErrNotConnected)
+			}
+			if err := fn(envelope); err != nil {
+				return read, err
+			}
+			read++
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idle)
+		case <-timer.C:
+			return read, nil
+		case <-ctx.Done():
+			return read, ctx.Err()
+		}
+	}
+	return read, nil
+}
+
+// Replay publishes the dead lettered message to the queue it was dead lettered from, or to queueName if it is set,
+// and acks it. the dead letter headers and the retries are removed, so the message is processed from scratch
+func Replay(q RawQueue, envelope *Envelope, queueName string) error {
+	if queueName == "" {
+		queueName = envelope.Headers[HeaderDeadLetterSource]
+	}
+	if queueName == "" {
+		return errors.New("dead lettered message has no source queue")
+	}
+	replayed := *envelope
+	replayed.Acknowledger = nil
+	replayed.Headers = nil
+	for key, value := range envelope.Headers {
+		switch key {
+		case HeaderDeadLetterReason, HeaderDeadLetterError, HeaderDeadLetterSource, HeaderRetries:
+			continue
+		}
+		if replayed.Headers == nil {
+			replayed.Headers = make(map[string]string, len(envelope.Headers))
+		}
+		replayed.Headers[key] = value
+	}
+	if err := q.PublishRaw(queueName, &replayed); err != nil {
+		return fmt.Errorf("failed to replay message to %s: %w", queueName, err)
+	}
+	return envelope.Ack()
+}
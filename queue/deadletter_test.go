@@ -0,0 +1,221 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/broker"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+// TestDeadLetter counts the retries of a message, dead letters it and replays it from the dead letter queue
+// against every backend
+func TestDeadLetter(t *testing.T) {
+	l := zap.NewNop()
+	b, err := broker.Listen(l, "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer b.Close()
+	backends := []struct {
+		name string
+		// new returns the client and the server side of the queue named queue
+		new     func(t *testing.T) (Queue, Queue)
+		retries bool
+	}{
+		{
+			name: "memory",
+			new: func(t *testing.T) (Queue, Queue) {
+				// memory queues are shared by the process, the dead letter queue is named after the test
+				o := WithDeadLetterQueue(t.Name() + ".dlq")
+				return NewMemory(l, "queue", o), NewMemory(l, "queue", o)
+			},
+			retries: true,
+		},
+		{
+			name: "nats",
+			new: func(t *testing.T) (Queue, Queue) {
+				server := newFakeNATS()
+				return newNATSQueue(l, server.conn(), "queue", newOptions()), newNATSQueue(l, server.conn(), "queue", newOptions())
+			},
+		},
+		{
+			name: "kafka",
+			new: func(t *testing.T) (Queue, Queue) {
+				broker := newFakeKafka()
+				o := newOptions(WithReconnectBackoff(time.Millisecond, 10*time.Millisecond))
+				return newKafkaQueue(l, broker.writer(), broker.reader, "queue", "client", o),
+					newKafkaQueue(l, broker.writer(), broker.reader, "queue", "server", o)
+			},
+			retries: true,
+		},
+		{
+			name: "tcp",
+			new: func(t *testing.T) (Queue, Queue) {
+				client, err := NewTCP(l, b.Addr().String(), "queue", "client")
+				assert.Equal(t, nil, err)
+				server, err := NewTCP(l, b.Addr().String(), "queue", "server")
+				assert.Equal(t, nil, err)
+				return client, server
+			},
+			retries: true,
+		},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			client, server := backend.new(t)
+			defer client.Close()
+			defer server.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			msgChan, err := server.Consume(ctx)
+			assert.Equal(t, nil, err)
+			dlq := DeadLetterQueue("queue")
+			if backend.name == "memory" {
+				dlq = t.Name() + ".dlq"
+			}
+			// nats does not keep the messages, the dead letter queue is consumed before the message is dead lettered
+			raw := server.(RawQueue)
+			dlqCtx, dlqCancel := context.WithCancel(ctx)
+			envelopes, err := raw.ConsumeRaw(dlqCtx, dlq)
+			assert.Equal(t, nil, err)
+
+			assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: "A", Value: "a", Headers: map[string]string{"key": "value"}}))
+			msg := receive(t, msgChan)
+			assert.Equal(t, 0, msg.Retries)
+			if backend.retries {
+				for retries := 1; retries <= 2; retries++ {
+					assert.Equal(t, nil, msg.Nack(true))
+					msg = receive(t, msgChan)
+					assert.Equal(t, retries, msg.Retries)
+					assert.Equal(t, true, msg.Redelivered)
+					assert.Equal(t, map[string]string{"key": "value"}, msg.Headers)
+				}
+			}
+			assert.Equal(t, nil, msg.DeadLetter(ReasonRetriesExceeded, errors.New("boom")))
+
+			var envelope *Envelope
+			select {
+			case envelope = <-envelopes:
+			case <-ctx.Done():
+				t.Fatal("message is not dead lettered")
+			}
+			assert.Equal(t, ContentTypeJSON, envelope.ContentType)
+			assert.Equal(t, ReasonRetriesExceeded, envelope.Headers[HeaderDeadLetterReason])
+			assert.Equal(t, "boom", envelope.Headers[HeaderDeadLetterError])
+			assert.Equal(t, "queue", envelope.Headers[HeaderDeadLetterSource])
+			assert.Equal(t, "value", envelope.Headers["key"])
+			dead, err := decode(envelope.ContentType, envelope.Body)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, "A", dead.Key)
+
+			// replayed message is processed from scratch
+			assert.Equal(t, nil, Replay(raw, envelope, ""))
+			msg = receive(t, msgChan)
+			assert.Equal(t, "A", msg.Key)
+			assert.Equal(t, 0, msg.Retries)
+			assert.Equal(t, map[string]string{"key": "value"}, msg.Headers)
+
+			// message published on its own again keeps its retries, core nats does not redeliver
+			republisher := server.(Republisher)
+			if backend.retries {
+				assert.Equal(t, nil, republisher.RequeueMessage(msg))
+				assert.Equal(t, nil, msg.Ack())
+				msg = receive(t, msgChan)
+				assert.Equal(t, "A", msg.Key)
+				assert.Equal(t, 1, msg.Retries)
+				assert.Equal(t, true, msg.Redelivered)
+				assert.Equal(t, map[string]string{"key": "value"}, msg.Headers)
+			}
+			assert.Equal(t, nil, republisher.DeadLetterMessage(msg, ReasonUnknownAction, errors.New("unknown action")))
+			assert.Equal(t, nil, msg.Ack())
+			select {
+			case envelope = <-envelopes:
+			case <-ctx.Done():
+				t.Fatal("message is not dead lettered")
+			}
+			dlqCancel()
+			assert.Equal(t, ReasonUnknownAction, envelope.Headers[HeaderDeadLetterReason])
+			assert.Equal(t, "queue", envelope.Headers[HeaderDeadLetterSource])
+			assert.Equal(t, "value", envelope.Headers["key"])
+			dead, err = decode(envelope.ContentType, envelope.Body)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, "A", dead.Key)
+		})
+	}
+}
+
+func TestDeadLetter_Malformed(t *testing.T) {
+	l := zap.NewNop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q := NewMemory(l, t.Name())
+	defer q.Close()
+	msgChan, err := q.Consume(ctx)
+	assert.Equal(t, nil, err)
+
+	memoryTopicOf(t.Name()).push(memoryMessage{body: []byte("{"), contentType: ContentTypeJSON})
+	memoryTopicOf(t.Name()).push(memoryMessage{body: []byte("<add/>"), contentType: "application/xml"})
+	assert.Equal(t, nil, q.Publish(&types.Message{Action: types.AddItem, Key: "A", Value: "a"}))
+	msg := receive(t, msgChan)
+	assert.Equal(t, "A", msg.Key)
+	assert.Equal(t, nil, msg.Ack())
+
+	var reasons []string
+	read, err := ReadDeadLetters(ctx, q, DeadLetterQueue(t.Name()), 100*time.Millisecond, 0, func(envelope *Envelope) error {
+		assert.Equal(t, t.Name(), envelope.Headers[HeaderDeadLetterSource])
+		reasons = append(reasons, envelope.Headers[HeaderDeadLetterReason])
+		return envelope.Ack()
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, read)
+	assert.Equal(t, []string{ReasonMalformed, ReasonUnknownContentType}, reasons)
+}
+
+func TestReadDeadLetters(t *testing.T) {
+	l := zap.NewNop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q := NewMemory(l, t.Name())
+	defer q.Close()
+	dlq := DeadLetterQueue(t.Name())
+	for _, key := range []string{"A", "B", "C"} {
+		headers := deadLetterHeaders(nil, t.Name(), ReasonUnknownAction, errors.New("unknown action"))
+		assert.Equal(t, nil, q.PublishRaw(dlq, &Envelope{Body: []byte(`{"action":"bogus","key":"` + key + `"}`), ContentType: ContentTypeJSON, Headers: headers}))
+	}
+
+	// limit stops the reading, unsettled message is kept in the queue
+	read, err := ReadDeadLetters(ctx, q, dlq, time.Second, 1, func(envelope *Envelope) error {
+		return envelope.Acknowledger.Nack(true)
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, read)
+
+	// replay to another queue
+	read, err = ReadDeadLetters(ctx, q, dlq, 100*time.Millisecond, 2, func(envelope *Envelope) error {
+		return Replay(q, envelope, t.Name()+".replayed")
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, read)
+	replayed := memoryTopicOf(t.Name() + ".replayed")
+	for i := 0; i < 2; i++ {
+		msg, ok := replayed.pop()
+		assert.Equal(t, true, ok)
+		assert.Equal(t, ContentTypeJSON, msg.contentType)
+		assert.Equal(t, map[string]string(nil), msg.headers)
+	}
+
+	// purge
+	read, err = ReadDeadLetters(ctx, q, dlq, 100*time.Millisecond, 0, func(envelope *Envelope) error {
+		return envelope.Ack()
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, read)
+	assert.Equal(t, 0, memoryTopicOf(dlq).len())
+
+	// message without source cannot be replayed
+	err = Replay(q, &Envelope{Body: []byte("{}")}, "")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,647 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	kafkaHeaderReplyTo       = "reply-to"
+	kafkaHeaderCorrelationID = "correlation-id"
+	kafkaHeaderAppID         = "app-id"
+	kafkaHeaderRedelivered   = "redelivered"
+	kafkaHeaderContentType   = "content-type"
+)
+
+func init() {
+	Register("kafka", func(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (Queue, error) {
+		return NewKafka(logger, connStr, queueName, appID, opts...), nil
+	})
+}
+
+// kafkaWriter and kafkaReader are the parts of the kafka client used by the queue,
+// they are satisfied by a local stand-in in the tests
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	// SetOffsetAt moves the reader to the first message at or after the given time, it is not supported by group readers
+	SetOffsetAt(ctx context.Context, t time.Time) error
+	Close() error
+}
+
+// kafkaQueue publishes the messages to the topic named after the queue, keyed by the message key,
+// so the messages of a key stay in one partition and keep their order.
+// consumers of the queue share the messages through a consumer group named after the queue.
+// responses are published to the shared <queue>-replies topic, every requester reads it and picks its own responses
+type kafkaQueue struct {
+	logger     *zap.Logger
+	queueName  string
+	replyTopic string
+	appID      string
+	writer     kafkaWriter
+	// newReader creates a group reader, or a reader of the first partition if the group is empty
+	newReader func(topic, group string) kafkaReader
+	opts      options
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// fetchFailing is set while the consumer fails to fetch, the kafka client has no connection state to check
+	fetchFailing int32
+
+	replyOnce sync.Once
+	pendingMu sync.Mutex
+	pending   map[string]chan *types.Response // pending requests by correlation id
+}
+
+// NewKafka creates the queue over the comma separated broker addresses, connections are made lazily by the kafka client
+func NewKafka(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) *kafkaQueue {
+	o := newOptions(opts...)
+	brokers := strings.Split(connStr, ",")
+	hash := new(kafka.Hash)
+	writer := &kafka.Writer{
+		Addr: kafka.TCP(brokers...),
+		// replies are read from the first partition only
+		Balancer: kafka.BalancerFunc(func(msg kafka.Message, partitions ...int) int {
+			if msg.Topic != queueName {
+				return partitions[0]
+			}
+			return hash.Balance(msg, partitions...)
+		}),
+		WriteBackoffMin:        o.minBackoff,
+		WriteBackoffMax:        o.maxBackoff,
+		BatchTimeout:           10 * time.Millisecond,
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+	if o.publishPolicy == PublishFailFast {
+		writer.MaxAttempts = 1
+	}
+	newReader := func(topic, group string) kafkaReader {
+		cfg := kafka.ReaderConfig{
+			Brokers:        brokers,
+			Topic:          topic,
+			GroupID:        group,
+			MaxWait:        100 * time.Millisecond,
+			ReadBackoffMin: o.minBackoff,
+			ReadBackoffMax: o.maxBackoff,
+		}
+		if o.prefetch > 0 {
+			cfg.QueueCapacity = o.prefetch
+		}
+		return kafka.NewReader(cfg)
+	}
+	return newKafkaQueue(logger, writer, newReader, queueName, appID, o)
+}
+
+func newKafkaQueue(logger *zap.Logger, writer kafkaWriter, newReader func(topic, group string) kafkaReader, queueName, appID string, opts options) *kafkaQueue {
+	return &kafkaQueue{
+		logger:     logger,
+		queueName:  queueName,
+		replyTopic: queueName + "-replies",
+		appID:      appID,
+		writer:     writer,
+		newReader:  newReader,
+		opts:       opts,
+		done:       make(chan struct{}),
+		pending:    make(map[string]chan *types.Response),
+	}
+}
+
+func (q *kafkaQueue) Publish(message *types.Message) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	message.Timestamp = time.Now()
+	body, err := q.opts.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return q.write(kafka.Message{
+		Topic: q.queueName,
+		Key:   []byte(message.Key),
+		Value: body,
+		Headers: append([]kafka.Header{
+			{Key: kafkaHeaderReplyTo, Value: []byte(message.ReplyTo)},
+			{Key: kafkaHeaderCorrelationID, Value: []byte(message.CorrelationID)},
+			{Key: kafkaHeaderAppID, Value: []byte(q.appID)},
+			{Key: kafkaHeaderContentType, Value: []byte(q.opts.codec.ContentType())},
+		}, kafkaHeaders(message.Headers)...),
+	})
+}
+
+// PublishEvent keys the event by the store key, so the events of a key stay in one partition
+func (q *kafkaQueue) PublishEvent(event *types.Event) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return q.write(kafka.Message{
+		Topic:   q.queueName,
+		Key:     []byte(event.Key),
+		Value:   body,
+		Headers: []kafka.Header{{Key: kafkaHeaderAppID, Value: []byte(q.appID)}},
+	})
+}
+
+// write waits for the brokers to acknowledge the message, retries are done by the kafka client
+func (q *kafkaQueue) write(msg kafka.Message) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-q.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return q.writer.WriteMessages(ctx, msg)
+}
+
+func (q *kafkaQueue) Request(ctx context.Context, message *types.Message) (*types.Response, error) {
+	q.replyOnce.Do(func() {
+		go q.consumeReplies(time.Now())
+	})
+
+	correlationID := uuid.New().String()
+	respChan := make(chan *types.Response, 1)
+	q.pendingMu.Lock()
+	q.pending[correlationID] = respChan
+	q.pendingMu.Unlock()
+	defer func() {
+		q.pendingMu.Lock()
+		delete(q.pending, correlationID)
+		q.pendingMu.Unlock()
+	}()
+
+	message.ReplyTo = q.replyTopic
+	message.CorrelationID = correlationID
+	if err := q.Publish(message); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response for request %s: %w", correlationID, ctx.Err())
+	}
+}
+
+// consumeReplies reads the reply topic from the given time until the queue is closed,
+// responses of the other requesters are ignored
+func (q *kafkaQueue) consumeReplies(since time.Time) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-q.done
+		cancel()
+	}()
+	reader := q.newReader(q.replyTopic, "")
+	defer reader.Close()
+	// the offset is looked up by time, so no response is missed while the reader is starting.
+	// reply topic is created by the first response, until then the lookup fails
+	// retried at the min backoff, so the first responses are picked up before the requests time out
+	for {
+		err := reader.SetOffsetAt(ctx, since)
+		if err == nil {
+			break
+		}
+		q.logger.Debug("failed to set reply offset", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(q.opts.minBackoff):
+		}
+	}
+	for attempt := 0; ; {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			q.logger.Warn("failed to fetch response", zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(q.opts.backoff(attempt)):
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		q.dispatchReply(msg)
+	}
+}
+
+func (q *kafkaQueue) dispatchReply(msg kafka.Message) {
+	correlationID := kafkaHeader(msg, kafkaHeaderCorrelationID)
+	q.pendingMu.Lock()
+	respChan, ok := q.pending[correlationID]
+	q.pendingMu.Unlock()
+	if !ok {
+		// response of another requester or request timed out already
+		return
+	}
+	resp := new(types.Response)
+	if err := json.Unmarshal(msg.Value, resp); err != nil {
+		q.logger.Error("failed to unmarshal response body", zap.Error(err), zap.String("correlationID", correlationID))
+		return
+	}
+	select {
+	case respChan <- resp:
+	default: // duplicate response, request already answered
+	}
+}
+
+func (q *kafkaQueue) Reply(message *types.Message, response *types.Response) error {
+	if message.ReplyTo == "" {
+		return nil
+	}
+	response.Timestamp = time.Now()
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return q.write(kafka.Message{
+		Topic: message.ReplyTo,
+		Value: body,
+		Headers: []kafka.Header{
+			{Key: kafkaHeaderCorrelationID, Value: []byte(message.CorrelationID)},
+			{Key: kafkaHeaderAppID, Value: []byte(q.appID)},
+		},
+	})
+}
+
+// Consume feeds the returned channel until the context is done or the queue is closed.
+// acknowledgement commits the offset of the message, uncommitted messages are fetched again by the group after a restart
+func (q *kafkaQueue) Consume(ctx context.Context) (<-chan *types.Message, error) {
+	select {
+	case <-q.done:
+		return nil, ErrClosed
+	default:
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-q.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	reader := q.newReader(q.queueName, q.queueName)
+	committer := newKafkaCommitter(reader)
+	go func() {
+		// delivered messages are still acknowledged after the context is done, reader is closed with the queue
+		<-q.done
+		if err := reader.Close(); err != nil {
+			q.logger.Warn("failed to close reader", zap.Error(err))
+		}
+	}()
+	msgChan := make(chan *types.Message)
+	go func() {
+		defer close(msgChan)
+		defer cancel()
+		for attempt := 0; ; {
+			msg, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				q.logger.Warn("failed to fetch message", zap.Error(err))
+				atomic.StoreInt32(&q.fetchFailing, 1)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(q.opts.backoff(attempt)):
+				}
+				attempt++
+				continue
+			}
+			if attempt > 0 {
+				// the reader reconnects internally, a fetch succeeding after a failure means it is back
+				reconnectsTotal.WithLabelValues("kafka").Inc()
+				atomic.StoreInt32(&q.fetchFailing, 0)
+			}
+			attempt = 0
+			d := &kafkaDelivery{queue: q, committer: committer, msg: msg}
+			committer.track(msg)
+			m, err := decode(kafkaHeader(msg, kafkaHeaderContentType), msg.Value)
+			if err != nil {
+				// message would fail again, so it is not requeued
+				q.deadLetter(d, reasonOf(err), err)
+				continue
+			}
+			m.ReplyTo = kafkaHeader(msg, kafkaHeaderReplyTo)
+			m.CorrelationID = kafkaHeader(msg, kafkaHeaderCorrelationID)
+			m.Retries, _ = strconv.Atoi(kafkaHeader(msg, HeaderRetries))
+			m.Redelivered = kafkaHeader(msg, kafkaHeaderRedelivered) != "" || m.Retries > 0
+			m.AppID = kafkaHeader(msg, kafkaHeaderAppID)
+			m.Headers = messageHeaders(msg)
+			m.Acknowledger = d
+			span := dequeue("kafka", q.queueName, m)
+			select {
+			case <-ctx.Done():
+				span.End()
+				return
+			case msgChan <- m:
+			}
+			span.End()
+		}
+	}()
+	return msgChan, nil
+}
+
+// Health reports the consumer fetch failures, brokers are dialled lazily so there is nothing else to check
+func (q *kafkaQueue) Health() error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	if atomic.LoadInt32(&q.fetchFailing) == 1 {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+func (q *kafkaQueue) Close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.done)
+		err = q.writer.Close()
+	})
+	return err
+}
+
+// deadLetter writes the message as it is to the dead letter topic with the failure in the headers, the offset
+// is committed once the message is written. if that fails the message is skipped and lost
+func (q *kafkaQueue) deadLetter(d *kafkaDelivery, reason string, err error) {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	msg := kafka.Message{
+		Topic: dlq,
+		Key:   d.msg.Key,
+		Value: d.msg.Value,
+		Headers: append(append([]kafka.Header(nil), d.msg.Headers...),
+			kafka.Header{Key: HeaderDeadLetterSource, Value: []byte(q.queueName)},
+			kafka.Header{Key: HeaderDeadLetterReason, Value: []byte(reason)},
+			kafka.Header{Key: HeaderDeadLetterError, Value: []byte(err.Error())},
+		),
+	}
+	if err := q.write(msg); err != nil {
+		q.logger.Error("failed to dead letter message", zap.Error(err))
+		droppedTotal.WithLabelValues("kafka", dropDeadLetterFailed).Inc()
+	} else {
+		deadLetteredTotal.WithLabelValues("kafka", reason).Inc()
+	}
+	if err := d.Ack(); err != nil {
+		q.logger.Error("failed to commit message", zap.Error(err))
+	}
+}
+
+// RequeueMessage publishes the message on its own to the tail of the queue, e.g. a failed message of a batch
+func (q *kafkaQueue) RequeueMessage(message *types.Message) error {
+	return requeueMessage(q, q.opts, q.queueName, message)
+}
+
+// DeadLetterMessage publishes the message on its own to the dead letter queue, e.g. a failed message of a batch
+func (q *kafkaQueue) DeadLetterMessage(message *types.Message, reason string, err error) error {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := deadLetterMessage(q, q.opts, q.queueName, message, reason, err); err != nil {
+		return err
+	}
+	deadLetteredTotal.WithLabelValues("kafka", reason).Inc()
+	return nil
+}
+
+// ConsumeRaw reads the topic of the queue name in the consumer group named after it,
+// the reader is closed once the context is done
+func (q *kafkaQueue) ConsumeRaw(ctx context.Context, queueName string) (<-chan *Envelope, error) {
+	select {
+	case <-q.done:
+		return nil, ErrClosed
+	default:
+	}
+	reader := q.newReader(queueName, queueName)
+	committer := newKafkaCommitter(reader)
+	envelopes := make(chan *Envelope)
+	go func() {
+		defer close(envelopes)
+		defer func() {
+			if err := reader.Close(); err != nil {
+				q.logger.Warn("failed to close reader", zap.Error(err))
+			}
+		}()
+		for attempt := 0; ; {
+			msg, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				q.logger.Warn("failed to fetch message", zap.Error(err))
+				select {
+				case <-ctx.Done():
+					return
+				case <-q.done:
+					return
+				case <-time.After(q.opts.backoff(attempt)):
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			committer.track(msg)
+			envelope := &Envelope{
+				Key:           string(msg.Key),
+				Body:          msg.Value,
+				ContentType:   kafkaHeader(msg, kafkaHeaderContentType),
+				ReplyTo:       kafkaHeader(msg, kafkaHeaderReplyTo),
+				CorrelationID: kafkaHeader(msg, kafkaHeaderCorrelationID),
+				AppID:         kafkaHeader(msg, kafkaHeaderAppID),
+				Headers:       messageHeaders(msg),
+				Acknowledger:  &kafkaDelivery{queue: q, committer: committer, msg: msg},
+			}
+			select {
+			case envelopes <- envelope:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return envelopes, nil
+}
+
+func (q *kafkaQueue) PublishRaw(queueName string, envelope *Envelope) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	return q.write(kafka.Message{
+		Topic: queueName,
+		Key:   []byte(envelope.Key),
+		Value: envelope.Body,
+		Headers: append([]kafka.Header{
+			{Key: kafkaHeaderReplyTo, Value: []byte(envelope.ReplyTo)},
+			{Key: kafkaHeaderCorrelationID, Value: []byte(envelope.CorrelationID)},
+			{Key: kafkaHeaderAppID, Value: []byte(envelope.AppID)},
+			{Key: kafkaHeaderContentType, Value: []byte(envelope.ContentType)},
+		}, kafkaHeaders(envelope.Headers)...),
+	})
+}
+
+func kafkaHeaders(headers map[string]string) []kafka.Header {
+	out := make([]kafka.Header, 0, len(headers))
+	for key, value := range headers {
+		out = append(out, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return out
+}
+
+// messageHeaders are the headers of the message besides the ones used by the queue
+func messageHeaders(msg kafka.Message) map[string]string {
+	var headers map[string]string
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case kafkaHeaderReplyTo, kafkaHeaderCorrelationID, kafkaHeaderAppID, kafkaHeaderRedelivered, kafkaHeaderContentType, HeaderRetries:
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[h.Key] = string(h.Value)
+	}
+	return headers
+}
+
+func kafkaHeader(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// kafkaCommitter commits the offsets of the messages fetched by a reader. the messages are settled out of order
+// by the workers, so the offset of a partition is committed only up to the settled messages below the first
+// unsettled one, a consumer restarted after a crash gets the unsettled messages again instead of skipping them
+type kafkaCommitter struct {
+	reader kafkaReader
+
+	mu      sync.Mutex // serializes the commits, so a committed offset never goes back
+	pending map[int]*kafkaPartition
+}
+
+// kafkaPartition holds the fetched offsets of a partition not committed yet
+type kafkaPartition struct {
+	offsets []int64 // in fetch order
+	settled map[int64]kafka.Message
+}
+
+func newKafkaCommitter(reader kafkaReader) *kafkaCommitter {
+	return &kafkaCommitter{reader: reader, pending: make(map[int]*kafkaPartition)}
+}
+
+// track registers the fetched message, it has to be called in fetch order before the message is settled
+func (c *kafkaCommitter) track(msg kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	partition, ok := c.pending[msg.Partition]
+	if !ok {
+		partition = &kafkaPartition{settled: make(map[int64]kafka.Message)}
+		c.pending[msg.Partition] = partition
+	}
+	partition.offsets = append(partition.offsets, msg.Offset)
+}
+
+// commit settles the message and commits the offset of its partition up to the first unsettled message
+func (c *kafkaCommitter) commit(msg kafka.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	partition, ok := c.pending[msg.Partition]
+	if !ok || msg.Offset < partition.offsets[0] {
+		return nil // committed already
+	}
+	partition.settled[msg.Offset] = msg
+	var last *kafka.Message
+	for len(partition.offsets) > 0 {
+		settled, ok := partition.settled[partition.offsets[0]]
+		if !ok {
+			break
+		}
+		delete(partition.settled, settled.Offset)
+		partition.offsets = partition.offsets[1:]
+		last = &settled
+	}
+	if last == nil {
+		return nil
+	}
+	if len(partition.offsets) == 0 {
+		delete(c.pending, msg.Partition)
+	}
+	return c.reader.CommitMessages(context.Background(), *last)
+}
+
+// kafkaDelivery settles the message by committing its offset, kafka has no negative acknowledgement
+// so a requeued message is published again to the end of the topic. the partition is not held until the retry
+// is settled, so the requeued message loses its order and is applied after the later messages of its key
+type kafkaDelivery struct {
+	queue     *kafkaQueue
+	committer *kafkaCommitter
+	msg       kafka.Message
+}
+
+func (d *kafkaDelivery) Ack() error {
+	return d.committer.commit(d.msg)
+}
+
+func (d *kafkaDelivery) Nack(requeue bool) error {
+	if requeue {
+		msg := kafka.Message{
+			Topic:   d.msg.Topic,
+			Key:     d.msg.Key,
+			Value:   d.msg.Value,
+			Headers: []kafka.Header{{Key: kafkaHeaderRedelivered, Value: []byte("true")}},
+		}
+		retries, _ := strconv.Atoi(kafkaHeader(d.msg, HeaderRetries))
+		msg.Headers = append(msg.Headers, kafka.Header{Key: HeaderRetries, Value: []byte(strconv.Itoa(retries + 1))})
+		for _, h := range d.msg.Headers {
+			if h.Key != kafkaHeaderRedelivered && h.Key != HeaderRetries {
+				msg.Headers = append(msg.Headers, h)
+			}
+		}
+		if err := d.queue.write(msg); err != nil {
+			return fmt.Errorf("failed to requeue message: %w", err)
+		}
+	}
+	return d.committer.commit(d.msg)
+}
+
+func (d *kafkaDelivery) DeadLetter(reason string, cause error) error {
+	d.queue.deadLetter(d, reason, cause)
+	return nil
+}
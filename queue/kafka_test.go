@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestKafka_CommitInOrder(t *testing.T) {
+	l := zap.NewNop()
+	broker := newFakeKafka()
+	q := newKafkaQueue(l, broker.writer(), broker.reader, "queue", "server", newOptions())
+	defer q.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgChan, err := q.Consume(ctx)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, nil, q.Publish(&types.Message{Action: types.AddItem, Key: strconv.Itoa(i)}))
+	}
+	messages := make([]*types.Message, 4)
+	for i := range messages {
+		messages[i] = receive(t, msgChan)
+	}
+	commits := func() []int64 {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return append([]int64(nil), broker.commits["queue/queue"]...)
+	}
+
+	// offsets are committed only up to the first unsettled message, whatever order the messages are settled in
+	assert.Equal(t, nil, messages[1].Ack())
+	assert.Equal(t, nil, messages[3].Ack())
+	assert.Equal(t, []int64(nil), commits())
+	assert.Equal(t, nil, messages[0].Ack())
+	assert.Equal(t, []int64{1}, commits())
+	assert.Equal(t, nil, messages[0].Ack()) // committed already
+	assert.Equal(t, nil, messages[2].DeadLetter(ReasonUnknownAction, errors.New("unknown action")))
+	assert.Equal(t, []int64{1, 3}, commits())
+}
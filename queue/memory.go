@@ -0,0 +1,461 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("memory", func(logger *zap.Logger, _, queueName, appID string, opts ...Option) (Queue, error) {
+		q := NewMemory(logger, queueName, opts...)
+		q.appID = appID
+		return q, nil
+	})
+}
+
+// memoryBus connects the in-process queues, queues with the same name share the messages
+// and the reply addresses are resolved across all of them
+var memoryBus = struct {
+	mu      sync.Mutex
+	topics  map[string]*memoryTopic
+	inboxes map[string]*memoryQueue
+}{
+	topics:  make(map[string]*memoryTopic),
+	inboxes: make(map[string]*memoryQueue),
+}
+
+// memoryMessage is the encoded message, messages are encoded by the codec same as the other backends
+// so the fields which are not sent over the wire are not shared between the sender and the receiver
+type memoryMessage struct {
+	body          []byte
+	contentType   string
+	replyTo       string
+	correlationID string
+	appID         string
+	headers       map[string]string
+	redelivered   bool
+	retries       int
+}
+
+// memoryTopic is an unbounded fifo of the messages, consumers compete for the messages
+type memoryTopic struct {
+	mu       sync.Mutex
+	messages []memoryMessage
+	notify   chan struct{} // signalled when a message is pushed
+}
+
+func (t *memoryTopic) push(msg memoryMessage) {
+	t.mu.Lock()
+	t.messages = append(t.messages, msg)
+	t.mu.Unlock()
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pushFront puts the message back to the head of the topic, ahead of the later messages of its key
+func (t *memoryTopic) pushFront(msg memoryMessage) {
+	t.mu.Lock()
+	t.messages = append([]memoryMessage{msg}, t.messages...)
+	t.mu.Unlock()
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (t *memoryTopic) pop() (memoryMessage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.messages) == 0 {
+		return memoryMessage{}, false
+	}
+	msg := t.messages[0]
+	t.messages[0] = memoryMessage{}
+	t.messages = t.messages[1:]
+	if len(t.messages) > 0 {
+		// wake up another consumer for the rest of the messages
+		select {
+		case t.notify <- struct{}{}:
+		default:
+		}
+	}
+	return msg, true
+}
+
+func (t *memoryTopic) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.messages)
+}
+
+type memoryQueue struct {
+	logger    *zap.Logger
+	queueName string
+	appID     string // empty unless opened through the registry
+	opts      options
+	topic     *memoryTopic
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// inbox is registered lazily on the first request
+	inboxOnce sync.Once
+	inbox     string
+	pendingMu sync.Mutex
+	pending   map[string]chan *types.Response // pending requests by correlation id
+}
+
+// NewMemory creates an in-process queue, used by the tests and to run the client and the server in one binary.
+// messages do not survive the process and unacknowledged messages are not redelivered once the consumer is gone
+func NewMemory(logger *zap.Logger, queueName string, opts ...Option) *memoryQueue {
+	return &memoryQueue{
+		logger:    logger,
+		queueName: queueName,
+		opts:      newOptions(opts...),
+		topic:     memoryTopicOf(queueName),
+		done:      make(chan struct{}),
+		pending:   make(map[string]chan *types.Response),
+	}
+}
+
+// memoryTopicOf returns the topic of the queue name, the topic is created on first use
+func memoryTopicOf(queueName string) *memoryTopic {
+	memoryBus.mu.Lock()
+	defer memoryBus.mu.Unlock()
+	topic, ok := memoryBus.topics[queueName]
+	if !ok {
+		topic = &memoryTopic{notify: make(chan struct{}, 1)}
+		memoryBus.topics[queueName] = topic
+	}
+	return topic
+}
+
+func (q *memoryQueue) Publish(message *types.Message) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	message.Timestamp = time.Now()
+	body, err := q.opts.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	// there is no outage to buffer for, publish buffer size is the capacity of the topic
+	if q.topic.len() >= q.opts.publishBufferSize {
+		return ErrPublishBufferFull
+	}
+	q.topic.push(memoryMessage{body: body, contentType: q.opts.codec.ContentType(), replyTo: message.ReplyTo, correlationID: message.CorrelationID, appID: q.appID, headers: copyHeaders(message.Headers)})
+	return nil
+}
+
+func (q *memoryQueue) PublishEvent(event *types.Event) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if q.topic.len() >= q.opts.publishBufferSize {
+		return ErrPublishBufferFull
+	}
+	q.topic.push(memoryMessage{body: body, contentType: ContentTypeJSON, appID: q.appID})
+	return nil
+}
+
+func (q *memoryQueue) Request(ctx context.Context, message *types.Message) (*types.Response, error) {
+	q.inboxOnce.Do(func() {
+		q.inbox = "memory-reply-" + uuid.New().String()
+		memoryBus.mu.Lock()
+		memoryBus.inboxes[q.inbox] = q
+		memoryBus.mu.Unlock()
+	})
+
+	correlationID := uuid.New().String()
+	respChan := make(chan *types.Response, 1)
+	q.pendingMu.Lock()
+	q.pending[correlationID] = respChan
+	q.pendingMu.Unlock()
+	defer func() {
+		q.pendingMu.Lock()
+		delete(q.pending, correlationID)
+		q.pendingMu.Unlock()
+	}()
+
+	message.ReplyTo = q.inbox
+	message.CorrelationID = correlationID
+	if err := q.Publish(message); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response for request %s: %w", correlationID, ctx.Err())
+	}
+}
+
+func (q *memoryQueue) Reply(message *types.Message, response *types.Response) error {
+	if message.ReplyTo == "" {
+		return nil
+	}
+	response.Timestamp = time.Now()
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	memoryBus.mu.Lock()
+	inbox, ok := memoryBus.inboxes[message.ReplyTo]
+	memoryBus.mu.Unlock()
+	if !ok {
+		// requester is closed already, same as publishing to a deleted reply queue
+		q.logger.Warn("reply address not found", zap.String("replyTo", message.ReplyTo))
+		return nil
+	}
+	inbox.dispatchReply(message.CorrelationID, body)
+	return nil
+}
+
+func (q *memoryQueue) dispatchReply(correlationID string, body []byte) {
+	resp := new(types.Response)
+	if err := json.Unmarshal(body, resp); err != nil {
+		q.logger.Error("failed to unmarshal response body", zap.Error(err), zap.String("correlationID", correlationID))
+		return
+	}
+	q.pendingMu.Lock()
+	respChan, ok := q.pending[correlationID]
+	q.pendingMu.Unlock()
+	if !ok {
+		// request timed out already
+		q.logger.Warn("received response for unknown request", zap.String("correlationID", correlationID))
+		return
+	}
+	select {
+	case respChan <- resp:
+	default: // duplicate response, request already answered
+	}
+}
+
+// Consume feeds the returned channel until the context is done or the queue is closed
+func (q *memoryQueue) Consume(ctx context.Context) (<-chan *types.Message, error) {
+	select {
+	case <-q.done:
+		return nil, ErrClosed
+	default:
+	}
+	msgChan := make(chan *types.Message)
+	go func() {
+		defer close(msgChan)
+		for {
+			msg, ok := q.topic.pop()
+			if !ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-q.done:
+					return
+				case <-q.topic.notify:
+				}
+				continue
+			}
+			m, err := decode(msg.contentType, msg.body)
+			if err != nil {
+				// message would fail again, so it is not requeued
+				q.deadLetter(msg, reasonOf(err), err)
+				continue
+			}
+			m.ReplyTo = msg.replyTo
+			m.CorrelationID = msg.correlationID
+			// a message requeued on its own counts the retries of the delivery it was taken from in the headers
+			retries, headers := retriesOf(copyHeaders(msg.headers))
+			m.Redelivered = msg.redelivered || retries > 0
+			m.Retries = msg.retries + retries
+			m.AppID = msg.appID
+			m.Headers = headers
+			m.Acknowledger = &memoryDelivery{queue: q, topic: q.topic, msg: msg}
+			span := dequeue("memory", q.queueName, m)
+			select {
+			case msgChan <- m:
+			case <-ctx.Done():
+				span.End()
+				q.topic.pushFront(msg) // not delivered, give it to the next consumer
+				return
+			case <-q.done:
+				span.End()
+				q.topic.pushFront(msg)
+				return
+			}
+			span.End()
+		}
+	}()
+	return msgChan, nil
+}
+
+// deadLetter pushes the message as it is to the dead letter queue, with the failure in the headers
+func (q *memoryQueue) deadLetter(msg memoryMessage, reason string, err error) {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	msg.headers = deadLetterHeaders(msg.headers, q.queueName, reason, err)
+	msg.redelivered, msg.retries = false, 0
+	memoryTopicOf(dlq).push(msg)
+	deadLetteredTotal.WithLabelValues("memory", reason).Inc()
+}
+
+// RequeueMessage publishes the message on its own to the tail of the queue, e.g. a failed message of a batch
+func (q *memoryQueue) RequeueMessage(message *types.Message) error {
+	return requeueMessage(q, q.opts, q.queueName, message)
+}
+
+// DeadLetterMessage publishes the message on its own to the dead letter queue, e.g. a failed message of a batch
+func (q *memoryQueue) DeadLetterMessage(message *types.Message, reason string, err error) error {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := deadLetterMessage(q, q.opts, q.queueName, message, reason, err); err != nil {
+		return err
+	}
+	deadLetteredTotal.WithLabelValues("memory", reason).Inc()
+	return nil
+}
+
+// ConsumeRaw feeds the returned channel with the messages of the queue name until the context is done or the queue is closed
+func (q *memoryQueue) ConsumeRaw(ctx context.Context, queueName string) (<-chan *Envelope, error) {
+	select {
+	case <-q.done:
+		return nil, ErrClosed
+	default:
+	}
+	topic := memoryTopicOf(queueName)
+	envelopes := make(chan *Envelope)
+	go func() {
+		defer close(envelopes)
+		for {
+			msg, ok := topic.pop()
+			if !ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-q.done:
+					return
+				case <-topic.notify:
+				}
+				continue
+			}
+			envelope := &Envelope{
+				Body:          msg.body,
+				ContentType:   msg.contentType,
+				ReplyTo:       msg.replyTo,
+				CorrelationID: msg.correlationID,
+				AppID:         msg.appID,
+				Headers:       copyHeaders(msg.headers),
+				Acknowledger:  &memoryDelivery{queue: q, topic: topic, msg: msg},
+			}
+			select {
+			case envelopes <- envelope:
+			case <-ctx.Done():
+				topic.pushFront(msg)
+				return
+			case <-q.done:
+				topic.pushFront(msg)
+				return
+			}
+		}
+	}()
+	return envelopes, nil
+}
+
+func (q *memoryQueue) PublishRaw(queueName string, envelope *Envelope) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	memoryTopicOf(queueName).push(memoryMessage{
+		body:          envelope.Body,
+		contentType:   envelope.ContentType,
+		replyTo:       envelope.ReplyTo,
+		correlationID: envelope.CorrelationID,
+		appID:         envelope.AppID,
+		headers:       copyHeaders(envelope.Headers),
+	})
+	return nil
+}
+
+// Health fails only once the queue is closed, there is no connection to lose
+func (q *memoryQueue) Health() error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+func (q *memoryQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.inboxOnce.Do(func() {}) // waits for a concurrent registration, no inbox is registered afterwards
+		if q.inbox != "" {
+			memoryBus.mu.Lock()
+			delete(memoryBus.inboxes, q.inbox)
+			memoryBus.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+// copyHeaders keeps the sender and the receiver from sharing the map, same as going over the wire
+func copyHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(headers))
+	for key, value := range headers {
+		out[key] = value
+	}
+	return out
+}
+
+// memoryDelivery puts the message back to the head of the topic when it is nacked with requeue,
+// so it is redelivered before the later messages of its key same as rabbitmq
+type memoryDelivery struct {
+	queue   *memoryQueue
+	topic   *memoryTopic
+	msg     memoryMessage
+	settled sync.Once
+}
+
+func (d *memoryDelivery) Ack() error {
+	d.settled.Do(func() {})
+	return nil
+}
+
+func (d *memoryDelivery) Nack(requeue bool) error {
+	d.settled.Do(func() {
+		if requeue {
+			msg := d.msg
+			msg.redelivered = true
+			msg.retries++
+			d.topic.pushFront(msg)
+		}
+	})
+	return nil
+}
+
+func (d *memoryDelivery) DeadLetter(reason string, cause error) error {
+	d.settled.Do(func() {
+		d.queue.deadLetter(d.msg, reason, cause)
+	})
+	return nil
+}
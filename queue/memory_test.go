@@ -0,0 +1,35 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestMemory_Requeue(t *testing.T) {
+	q := NewMemory(zap.NewNop(), t.Name())
+	defer q.Close()
+	for _, value := range []string{"1", "2", "3"} {
+		assert.Equal(t, nil, q.Publish(&types.Message{Action: types.AddItem, Key: "A", Value: value}))
+	}
+	// requeued message goes back ahead of the messages of its key not delivered yet
+	msg, ok := q.topic.pop()
+	assert.Equal(t, true, ok)
+	delivery := &memoryDelivery{queue: q, topic: q.topic, msg: msg}
+	assert.Equal(t, nil, delivery.Nack(true))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgChan, err := q.Consume(ctx)
+	assert.Equal(t, nil, err)
+	for _, value := range []string{"1", "2", "3"} {
+		m := receive(t, msgChan)
+		assert.Equal(t, value, m.Value)
+		assert.Equal(t, value == "1", m.Redelivered)
+		assert.Equal(t, nil, m.Ack())
+	}
+}
@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reasons of the messages dropped by the queue drivers
+const (
+	dropClosed           = "closed"             // published while disconnected and the queue is closed before reconnecting
+	dropDeadLetterFailed = "dead_letter_failed" // dead letter queue failed to take the message
+)
+
+var (
+	reconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "queue",
+		Name:      "reconnects_total",
+		Help:      "Successful reconnections to the broker by driver.",
+	}, []string{"driver"})
+	droppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "queue",
+		Name:      "messages_dropped_total",
+		Help:      "Messages dropped by the queue driver by reason.",
+	}, []string{"driver", "reason"})
+	deadLetteredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "queue",
+		Name:      "messages_dead_lettered_total",
+		Help:      "Messages forwarded to the dead letter queue by driver and reason.",
+	}, []string{"driver", "reason"})
+)
@@ -0,0 +1,425 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("nats", func(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (Queue, error) {
+		return NewNATS(logger, connStr, queueName, appID, opts...)
+	})
+}
+
+// natsConn is the part of the nats connection used by the queue, it is satisfied by a local stand-in in the tests
+type natsConn interface {
+	// Publish sends the message with the headers, header is nil if there are no headers
+	Publish(subject, reply string, header map[string]string, data []byte) error
+	// QueueSubscribe delivers every message to one member of the group, every subscriber gets the message if the group is empty.
+	// handler is not called concurrently
+	QueueSubscribe(subject, group string, handler func(subject, reply string, header map[string]string, data []byte)) (unsubscribe func() error, err error)
+	NewInbox() string
+	// IsConnected is false while the client is reconnecting
+	IsConnected() bool
+	Close()
+}
+
+// natsClient adapts the nats connection
+type natsClient struct {
+	conn *nats.Conn
+}
+
+func (c natsClient) Publish(subject, reply string, header map[string]string, data []byte) error {
+	msg := &nats.Msg{Subject: subject, Reply: reply, Data: data}
+	if len(header) > 0 {
+		msg.Header = make(nats.Header, len(header))
+		for key, value := range header {
+			msg.Header.Set(key, value)
+		}
+	}
+	return c.conn.PublishMsg(msg)
+}
+
+func (c natsClient) QueueSubscribe(subject, group string, handler func(subject, reply string, header map[string]string, data []byte)) (func() error, error) {
+	sub, err := c.conn.QueueSubscribe(subject, group, func(msg *nats.Msg) {
+		var header map[string]string
+		if len(msg.Header) > 0 {
+			header = make(map[string]string, len(msg.Header))
+			for key := range msg.Header {
+				// header keys are canonicalized by nats, the propagators look them up in lower case
+				header[strings.ToLower(key)] = msg.Header.Get(key)
+			}
+		}
+		handler(msg.Subject, msg.Reply, header, msg.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub.Unsubscribe, nil
+}
+
+func (c natsClient) NewInbox() string {
+	return c.conn.NewInbox()
+}
+
+func (c natsClient) IsConnected() bool {
+	return c.conn.IsConnected()
+}
+
+func (c natsClient) Close() {
+	// in flight messages are delivered to the handlers before the connection is closed
+	if err := c.conn.Drain(); err != nil {
+		c.conn.Close()
+	}
+}
+
+// natsHeaderContentType carries the content type of the message, nats messages have no properties
+const natsHeaderContentType = "content-type"
+
+// natsQueue publishes the messages to the subject named after the queue, consumers of the queue share
+// the messages through a queue group. core nats has no acknowledgement, delivery is at most once
+type natsQueue struct {
+	logger    *zap.Logger
+	queueName string
+	conn      natsConn
+	opts      options
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// inbox is subscribed lazily on the first request, responses are published to inbox.<correlation id>
+	inboxOnce sync.Once
+	inbox     string
+	inboxErr  error
+	pendingMu sync.Mutex
+	pending   map[string]chan *types.Response // pending requests by correlation id
+}
+
+// NewNATS connects to the nats server, reconnection and publish buffering during an outage are done by the nats client
+func NewNATS(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (*natsQueue, error) {
+	o := newOptions(opts...)
+	natsOpts := []nats.Option{
+		nats.Name(appID),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(o.backoff),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logger.Warn("nats connection lost, reconnecting", zap.Error(err))
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			logger.Info("nats reconnected")
+			reconnectsTotal.WithLabelValues("nats").Inc()
+		}),
+	}
+	if o.publishPolicy == PublishFailFast {
+		natsOpts = append(natsOpts, nats.ReconnectBufSize(-1))
+	}
+	conn, err := nats.Connect(connStr, natsOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect %v", err)
+	}
+	return newNATSQueue(logger, natsClient{conn}, queueName, o), nil
+}
+
+func newNATSQueue(logger *zap.Logger, conn natsConn, queueName string, opts options) *natsQueue {
+	return &natsQueue{
+		logger:    logger,
+		queueName: queueName,
+		conn:      conn,
+		opts:      opts,
+		done:      make(chan struct{}),
+		pending:   make(map[string]chan *types.Response),
+	}
+}
+
+func (q *natsQueue) Publish(message *types.Message) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	message.Timestamp = time.Now()
+	body, err := q.opts.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	header := make(map[string]string, len(message.Headers)+1)
+	for key, value := range message.Headers {
+		header[key] = value
+	}
+	header[natsHeaderContentType] = q.opts.codec.ContentType()
+	return q.conn.Publish(q.queueName, message.ReplyTo, header, body)
+}
+
+func (q *natsQueue) PublishEvent(event *types.Event) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return q.conn.Publish(q.queueName, "", nil, body)
+}
+
+func (q *natsQueue) Request(ctx context.Context, message *types.Message) (*types.Response, error) {
+	q.inboxOnce.Do(func() {
+		q.inbox = q.conn.NewInbox()
+		_, q.inboxErr = q.conn.QueueSubscribe(q.inbox+".*", "", q.dispatchReply)
+	})
+	if q.inboxErr != nil {
+		return nil, fmt.Errorf("failed to subscribe inbox: %v", q.inboxErr)
+	}
+
+	correlationID := uuid.New().String()
+	respChan := make(chan *types.Response, 1)
+	q.pendingMu.Lock()
+	q.pending[correlationID] = respChan
+	q.pendingMu.Unlock()
+	defer func() {
+		q.pendingMu.Lock()
+		delete(q.pending, correlationID)
+		q.pendingMu.Unlock()
+	}()
+
+	// correlation id travels in the reply subject, nats messages have no properties
+	message.ReplyTo = q.inbox + "." + correlationID
+	message.CorrelationID = correlationID
+	if err := q.Publish(message); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response for request %s: %w", correlationID, ctx.Err())
+	}
+}
+
+func (q *natsQueue) dispatchReply(subject, _ string, _ map[string]string, data []byte) {
+	correlationID := subject[strings.LastIndexByte(subject, '.')+1:]
+	resp := new(types.Response)
+	if err := json.Unmarshal(data, resp); err != nil {
+		q.logger.Error("failed to unmarshal response body", zap.Error(err), zap.String("correlationID", correlationID))
+		return
+	}
+	q.pendingMu.Lock()
+	respChan, ok := q.pending[correlationID]
+	q.pendingMu.Unlock()
+	if !ok {
+		// request timed out already
+		q.logger.Warn("received response for unknown request", zap.String("correlationID", correlationID))
+		return
+	}
+	select {
+	case respChan <- resp:
+	default: // duplicate response, request already answered
+	}
+}
+
+func (q *natsQueue) Reply(message *types.Message, response *types.Response) error {
+	if message.ReplyTo == "" {
+		return nil
+	}
+	response.Timestamp = time.Now()
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return q.conn.Publish(message.ReplyTo, "", nil, body)
+}
+
+func (q *natsQueue) Health() error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	if !q.conn.IsConnected() {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// Consume feeds the returned channel until the context is done or the queue is closed
+func (q *natsQueue) Consume(ctx context.Context) (<-chan *types.Message, error) {
+	msgChan := make(chan *types.Message)
+	// handler holds the read lock while sending, so the channel is closed only once no handler is sending
+	var mu sync.RWMutex
+	closed := false
+	unsubscribe, err := q.conn.QueueSubscribe(q.queueName, q.queueName, func(_, reply string, header map[string]string, data []byte) {
+		m, err := decode(header[natsHeaderContentType], data)
+		if err != nil {
+			q.deadLetter(reply, header, data, reasonOf(err), err)
+			return
+		}
+		m.ReplyTo = reply
+		m.Headers = messageHeadersOf(header)
+		m.Acknowledger = natsDelivery{queue: q, reply: reply, header: header, data: data}
+		mu.RLock()
+		defer mu.RUnlock()
+		if closed {
+			return
+		}
+		span := dequeue("nats", q.queueName, m)
+		defer span.End()
+		select {
+		case msgChan <- m:
+		case <-ctx.Done():
+		case <-q.done:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-q.done:
+		}
+		if err := unsubscribe(); err != nil {
+			q.logger.Warn("failed to unsubscribe", zap.Error(err))
+		}
+		mu.Lock()
+		closed = true
+		close(msgChan)
+		mu.Unlock()
+	}()
+	return msgChan, nil
+}
+
+// deadLetter publishes the message as it is to the dead letter subject with the failure in the headers,
+// the message is lost if nobody is subscribed to it
+func (q *natsQueue) deadLetter(reply string, header map[string]string, data []byte, reason string, err error) {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := q.conn.Publish(dlq, reply, deadLetterHeaders(header, q.queueName, reason, err), data); err != nil {
+		q.logger.Error("failed to dead letter message", zap.Error(err))
+		droppedTotal.WithLabelValues("nats", dropDeadLetterFailed).Inc()
+		return
+	}
+	deadLetteredTotal.WithLabelValues("nats", reason).Inc()
+}
+
+// RequeueMessage is noop, core nats does not redeliver the messages
+func (q *natsQueue) RequeueMessage(*types.Message) error { return nil }
+
+// DeadLetterMessage publishes the message on its own to the dead letter queue, e.g. a failed message of a batch
+func (q *natsQueue) DeadLetterMessage(message *types.Message, reason string, err error) error {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := deadLetterMessage(q, q.opts, q.queueName, message, reason, err); err != nil {
+		return err
+	}
+	deadLetteredTotal.WithLabelValues("nats", reason).Inc()
+	return nil
+}
+
+// ConsumeRaw subscribes the subject of the queue name in the queue group named after it until the context is done
+func (q *natsQueue) ConsumeRaw(ctx context.Context, queueName string) (<-chan *Envelope, error) {
+	envelopes := make(chan *Envelope)
+	var mu sync.RWMutex
+	closed := false
+	unsubscribe, err := q.conn.QueueSubscribe(queueName, queueName, func(_, reply string, header map[string]string, data []byte) {
+		envelope := &Envelope{
+			Body:         data,
+			ContentType:  header[natsHeaderContentType],
+			ReplyTo:      reply,
+			Headers:      messageHeadersOf(header),
+			Acknowledger: natsDelivery{queue: q, reply: reply, header: header, data: data},
+		}
+		mu.RLock()
+		defer mu.RUnlock()
+		if closed {
+			return
+		}
+		select {
+		case envelopes <- envelope:
+		case <-ctx.Done():
+		case <-q.done:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-q.done:
+		}
+		if err := unsubscribe(); err != nil {
+			q.logger.Warn("failed to unsubscribe", zap.Error(err))
+		}
+		mu.Lock()
+		closed = true
+		close(envelopes)
+		mu.Unlock()
+	}()
+	return envelopes, nil
+}
+
+func (q *natsQueue) PublishRaw(queueName string, envelope *Envelope) error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	header := make(map[string]string, len(envelope.Headers)+1)
+	for key, value := range envelope.Headers {
+		header[key] = value
+	}
+	if envelope.ContentType != "" {
+		header[natsHeaderContentType] = envelope.ContentType
+	}
+	return q.conn.Publish(queueName, envelope.ReplyTo, header, envelope.Body)
+}
+
+// natsDelivery dead letters the message, core nats has no acknowledgement so ack and nack are noop
+type natsDelivery struct {
+	queue  *natsQueue
+	reply  string
+	header map[string]string
+	data   []byte
+}
+
+func (natsDelivery) Ack() error { return nil }
+
+func (natsDelivery) Nack(bool) error { return nil }
+
+func (d natsDelivery) DeadLetter(reason string, cause error) error {
+	d.queue.deadLetter(d.reply, d.header, d.data, reason, cause)
+	return nil
+}
+
+// messageHeadersOf returns the headers of the message without the content type, nil if there are none
+func messageHeadersOf(header map[string]string) map[string]string {
+	var headers map[string]string
+	for key, value := range header {
+		if key == natsHeaderContentType {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string, len(header))
+		}
+		headers[key] = value
+	}
+	return headers
+}
+
+func (q *natsQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.conn.Close()
+	})
+	return nil
+}
@@ -0,0 +1,109 @@
+package queue
+
+import (
+	"math/rand"
+	"time"
+)
+
+// PublishPolicy decides what happens to the published messages while the connection is down
+type PublishPolicy string
+
+const (
+	// PublishBuffer keeps the messages in memory and publishes them once reconnected
+	PublishBuffer PublishPolicy = "buffer"
+	// PublishFailFast returns an error straight away
+	PublishFailFast PublishPolicy = "failfast"
+)
+
+type options struct {
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
+	publishPolicy     PublishPolicy
+	publishBufferSize int
+	prefetch          int
+	codec             Codec
+	deadLetterQueue   string // empty for the DeadLetterQueue of the consumed queue
+}
+
+type Option func(*options)
+
+// WithReconnectBackoff sets the delay bounds between the reconnection attempts, min has to be positive
+// or the defaults are kept so a down broker is never retried in a hot loop. max is raised to min if it is below
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		if min <= 0 {
+			return
+		}
+		if max < min {
+			max = min
+		}
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithPublishPolicy sets the publish behaviour during an outage, bufferSize is used only by PublishBuffer
+func WithPublishPolicy(policy PublishPolicy, bufferSize int) Option {
+	return func(o *options) {
+		o.publishPolicy = policy
+		o.publishBufferSize = bufferSize
+	}
+}
+
+// WithPrefetch limits the number of unacknowledged messages delivered to the consumer
+func WithPrefetch(count int) Option {
+	return func(o *options) {
+		o.prefetch = count
+	}
+}
+
+// WithCodec sets the codec of the published messages, consumed messages are decoded by their content type
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithDeadLetterQueue sets the queue the messages which cannot be decoded or processed are forwarded to,
+// it defaults to DeadLetterQueue of the consumed queue
+func WithDeadLetterQueue(name string) Option {
+	return func(o *options) {
+		o.deadLetterQueue = name
+	}
+}
+
+// newOptions applies the options over the defaults shared by the backends
+func newOptions(opts ...Option) options {
+	o := options{
+		minBackoff:        500 * time.Millisecond,
+		maxBackoff:        30 * time.Second,
+		publishPolicy:     PublishBuffer,
+		publishBufferSize: 1000,
+		codec:             JSON,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// backoff is exponential with equal jitter, capped at max backoff. the delay is doubled up to the cap,
+// so it never overflows whatever the attempt and the bounds are
+func (o options) backoff(attempt int) time.Duration {
+	delay := o.minBackoff
+	for i := 0; i < attempt && delay < o.maxBackoff; i++ {
+		if delay > o.maxBackoff/2 {
+			delay = o.maxBackoff
+			break
+		}
+		delay *= 2
+	}
+	if delay > o.maxBackoff {
+		delay = o.maxBackoff
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
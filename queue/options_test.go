@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestOptions_Backoff(t *testing.T) {
+	// zero min keeps the defaults, max below min is raised to min
+	o := newOptions(WithReconnectBackoff(0, time.Second))
+	assert.Equal(t, 500*time.Millisecond, o.minBackoff)
+	assert.Equal(t, 30*time.Second, o.maxBackoff)
+	o = newOptions(WithReconnectBackoff(time.Second, time.Millisecond))
+	assert.Equal(t, time.Second, o.minBackoff)
+	assert.Equal(t, time.Second, o.maxBackoff)
+
+	// delay is doubled up to max, with the jitter it is between the half and the whole delay
+	o = newOptions(WithReconnectBackoff(100*time.Millisecond, time.Second))
+	for attempt, delay := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		delay *= time.Millisecond
+		for i := 0; i < 10; i++ {
+			got := o.backoff(attempt)
+			assert.Equal(t, true, got >= delay/2 && got < delay)
+		}
+	}
+	assert.Equal(t, true, o.backoff(math.MaxInt32) >= 500*time.Millisecond)
+
+	// large bounds never overflow
+	o = newOptions(WithReconnectBackoff(time.Duration(math.MaxInt64/3), time.Duration(math.MaxInt64)))
+	for _, attempt := range []int{0, 1, 2, 3, 64, math.MaxInt32} {
+		assert.Equal(t, true, o.backoff(attempt) > 0)
+	}
+}
@@ -2,13 +2,40 @@ package queue
 
 import (
 	"context"
+	"errors"
 
 	"github.com/bhakiyakalimuthu/server-clique/types"
 )
 
+var (
+	ErrClosed            = errors.New("queue is closed")
+	ErrNotConnected      = errors.New("queue is not connected")
+	ErrPublishBufferFull = errors.New("publish buffer is full")
+)
+
 // Queue is an abstract type, can be extended by different message queue implementations
 type Queue interface {
 	Publish(*types.Message) error
+	// Request publishes the message and waits for the response until the context is done
+	Request(context.Context, *types.Message) (*types.Response, error)
+	// Reply sends the response back to the sender of the given message
+	Reply(*types.Message, *types.Response) error
+	// PublishEvent publishes the change event of the store, events of a key keep their order
+	PublishEvent(*types.Event) error
 	Consume(context.Context) (<-chan *types.Message, error)
 	Close() error
 }
+
+// HealthChecker is implemented by the queues which can tell whether the broker is reachable
+type HealthChecker interface {
+	// Health returns nil while connected, ErrNotConnected while reconnecting and ErrClosed once the queue is closed
+	Health() error
+}
+
+// Health checks the queue if it supports the health check, the other queues are considered healthy
+func Health(q Queue) error {
+	if checker, ok := q.(HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
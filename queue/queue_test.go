@@ -0,0 +1,470 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/broker"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// TestQueue runs the same scenario against every backend, nats and kafka are connected to local stand-ins
+// and tcp to the embedded broker
+func TestQueue(t *testing.T) {
+	l := zap.NewNop()
+	b, err := broker.Listen(l, "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer b.Close()
+	exporter := setupTracing(t)
+	backends := []struct {
+		name string
+		// new returns the client and the server side of one queue
+		new         func(t *testing.T) (Queue, Queue)
+		acknowledge bool
+		// the app id of the client is carried to the consumer
+		appID bool
+	}{
+		{
+			name: "memory",
+			new: func(t *testing.T) (Queue, Queue) {
+				return NewMemory(l, t.Name()), NewMemory(l, t.Name())
+			},
+			acknowledge: true,
+		},
+		{
+			name: "nats",
+			new: func(t *testing.T) (Queue, Queue) {
+				server := newFakeNATS()
+				return newNATSQueue(l, server.conn(), "queue", newOptions()), newNATSQueue(l, server.conn(), "queue", newOptions())
+			},
+		},
+		{
+			name: "kafka",
+			new: func(t *testing.T) (Queue, Queue) {
+				broker := newFakeKafka()
+				o := newOptions(WithReconnectBackoff(time.Millisecond, 10*time.Millisecond))
+				return newKafkaQueue(l, broker.writer(), broker.reader, "queue", "client", o),
+					newKafkaQueue(l, broker.writer(), broker.reader, "queue", "server", o)
+			},
+			acknowledge: true,
+			appID:       true,
+		},
+		{
+			name: "tcp",
+			new: func(t *testing.T) (Queue, Queue) {
+				client, err := NewTCP(l, b.Addr().String(), "queue", "client")
+				assert.Equal(t, nil, err)
+				server, err := NewTCP(l, b.Addr().String(), "queue", "server")
+				assert.Equal(t, nil, err)
+				return client, server
+			},
+			acknowledge: true,
+			appID:       true,
+		},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			client, server := backend.new(t)
+			defer client.Close()
+			defer server.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			msgChan, err := server.Consume(ctx)
+			assert.Equal(t, nil, err)
+
+			// publish
+			assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: "A", Value: "a"}))
+			msg := receive(t, msgChan)
+			assert.Equal(t, types.AddItem, msg.Action)
+			assert.Equal(t, "A", msg.Key)
+			assert.Equal(t, "a", msg.Value)
+			assert.Equal(t, false, msg.Redelivered)
+			if backend.appID {
+				assert.Equal(t, "client", msg.AppID)
+			}
+			if backend.acknowledge {
+				// requeued message is delivered again
+				assert.Equal(t, nil, msg.Nack(true))
+				msg = receive(t, msgChan)
+				assert.Equal(t, "A", msg.Key)
+				assert.Equal(t, true, msg.Redelivered)
+			}
+			assert.Equal(t, nil, msg.Ack())
+
+			// request and reply
+			type result struct {
+				resp *types.Response
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := client.Request(ctx, &types.Message{Action: types.GetItem, Key: "A"})
+				results <- result{resp: resp, err: err}
+			}()
+			msg = receive(t, msgChan)
+			assert.Equal(t, types.GetItem, msg.Action)
+			assert.NotEqual(t, "", msg.ReplyTo)
+			assert.Equal(t, nil, server.Reply(msg, &types.Response{Action: msg.Action, Status: types.StatusOK, Key: msg.Key, Value: "a"}))
+			assert.Equal(t, nil, msg.Ack())
+			res := <-results
+			assert.Equal(t, nil, res.err)
+			assert.Equal(t, types.StatusOK, res.resp.Status)
+			assert.Equal(t, "a", res.resp.Value)
+
+			// change event is published to the same queue, the event decodes into the message fields it shares
+			assert.Equal(t, nil, client.PublishEvent(&types.Event{Seq: 1, Action: types.AddItem, Key: "E", Value: "e", OldValue: "d"}))
+			msg = receive(t, msgChan)
+			assert.Equal(t, "E", msg.Key)
+			assert.Equal(t, "e", msg.Value)
+			assert.Equal(t, nil, msg.Ack())
+
+			// trace context is carried in the headers, the consumer span is a child of the producer span
+			parentCtx, parent := otel.Tracer("test").Start(ctx, "parent")
+			assert.Equal(t, nil, PublishContext(parentCtx, client, &types.Message{Action: types.AddItem, Key: "T"}))
+			parent.End()
+			msg = receive(t, msgChan)
+			assert.Equal(t, nil, msg.Ack())
+			spans := waitSpans(t, exporter, parent.SpanContext().TraceID(), 3)
+			publish, dequeue := spans["publish add"], spans["dequeue add"]
+			assert.Equal(t, parent.SpanContext().SpanID(), publish.Parent.SpanID())
+			assert.Equal(t, publish.SpanContext.SpanID(), dequeue.Parent.SpanID())
+			assert.Equal(t, true, dequeue.Parent.IsRemote())
+			assert.Equal(t, trace.SpanKindConsumer, dequeue.SpanKind)
+			// the consumer continues the trace from the dequeue span
+			assert.Equal(t, dequeue.SpanContext.SpanID(), trace.SpanContextFromContext(Extract(context.Background(), msg)).SpanID())
+
+			// consumer channel is closed once the context is done
+			cancel()
+			for range msgChan {
+			}
+		})
+	}
+}
+
+// setupTracing records the spans in memory and propagates the w3c trace context until the test ends
+func setupTracing(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// waitSpans waits for the given number of ended spans of the trace, spans are returned by name
+func waitSpans(t *testing.T, exporter *tracetest.InMemoryExporter, traceID trace.TraceID, count int) map[string]tracetest.SpanStub {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		spans := make(map[string]tracetest.SpanStub)
+		for _, span := range exporter.GetSpans() {
+			if span.SpanContext.TraceID() == traceID {
+				spans[span.Name] = span
+			}
+		}
+		if len(spans) >= count {
+			return spans
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d spans of the trace, got %d", count, len(spans))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTCP_Reconnect(t *testing.T) {
+	l := zap.NewNop()
+	b, err := broker.Listen(l, "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := b.Addr().String()
+	opts := []Option{WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond), WithPublishPolicy(PublishBuffer, 10)}
+	client, err := NewTCP(l, addr, "queue", "client", opts...)
+	assert.Equal(t, nil, err)
+	defer client.Close()
+	server, err := NewTCP(l, addr, "queue", "server", opts...)
+	assert.Equal(t, nil, err)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgChan, err := server.Consume(ctx)
+	assert.Equal(t, nil, err)
+	reconnects := testutil.ToFloat64(reconnectsTotal.WithLabelValues("tcp"))
+
+	assert.Equal(t, nil, server.Health())
+
+	// messages published during the outage are buffered and the consumer is subscribed again
+	assert.Equal(t, nil, b.Close())
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, ErrNotConnected, server.Health())
+	assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: "A", Value: "a"}))
+	b, err = broker.Listen(l, addr)
+	assert.Equal(t, nil, err)
+	defer b.Close()
+	msg := receive(t, msgChan)
+	assert.Equal(t, "A", msg.Key)
+	assert.Equal(t, nil, msg.Ack())
+	// both the publisher and the consumer are reconnected before the message gets through
+	assert.Equal(t, reconnects+2, testutil.ToFloat64(reconnectsTotal.WithLabelValues("tcp")))
+	assert.Equal(t, nil, server.Health())
+	assert.Equal(t, nil, server.Close())
+	assert.Equal(t, ErrClosed, server.Health())
+}
+
+func TestOpen(t *testing.T) {
+	l := zap.NewNop()
+	for _, name := range []string{"kafka", "memory", "nats", "rabbitmq", "tcp"} {
+		assert.Equal(t, true, strings.Contains(fmt.Sprint(Drivers()), name))
+	}
+	q, err := Open("memory", l, "", t.Name(), "test")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, q.Close())
+	_, err = Open("unknown", l, "", t.Name(), "test")
+	assert.NotEqual(t, nil, err)
+}
+
+func receive(t *testing.T, msgChan <-chan *types.Message) *types.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-msgChan:
+		if !ok {
+			t.Fatal("message channel is closed")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+// fakeNATS is a stand-in of the nats server routing the messages between its connections.
+// subjects are matched exactly or by a trailing * wildcard
+type fakeNATS struct {
+	mu      sync.Mutex
+	subs    []*fakeNATSSub
+	next    map[string]int // round robin position by group
+	inboxes int
+}
+
+type fakeNATSSub struct {
+	subject, group string
+	msgs           chan fakeNATSMsg
+	done           chan struct{}
+}
+
+type fakeNATSMsg struct {
+	subject, reply string
+	header         map[string]string
+	data           []byte
+}
+
+func newFakeNATS() *fakeNATS {
+	return &fakeNATS{next: make(map[string]int)}
+}
+
+func (f *fakeNATS) conn() natsConn {
+	return fakeNATSConn{f}
+}
+
+func (s *fakeNATSSub) matches(subject string) bool {
+	if strings.HasSuffix(s.subject, ".*") {
+		prefix := strings.TrimSuffix(s.subject, "*")
+		return strings.HasPrefix(subject, prefix) && !strings.Contains(subject[len(prefix):], ".")
+	}
+	return s.subject == subject
+}
+
+type fakeNATSConn struct {
+	server *fakeNATS
+}
+
+func (c fakeNATSConn) Publish(subject, reply string, header map[string]string, data []byte) error {
+	f := c.server
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	groups := make(map[string][]*fakeNATSSub)
+	for _, sub := range f.subs {
+		if !sub.matches(subject) {
+			continue
+		}
+		if sub.group == "" {
+			sub.msgs <- fakeNATSMsg{subject, reply, header, data}
+			continue
+		}
+		groups[sub.group] = append(groups[sub.group], sub)
+	}
+	for group, subs := range groups {
+		f.next[group]++
+		subs[f.next[group]%len(subs)].msgs <- fakeNATSMsg{subject, reply, header, data}
+	}
+	return nil
+}
+
+func (c fakeNATSConn) QueueSubscribe(subject, group string, handler func(subject, reply string, header map[string]string, data []byte)) (func() error, error) {
+	sub := &fakeNATSSub{subject: subject, group: group, msgs: make(chan fakeNATSMsg, 100), done: make(chan struct{})}
+	f := c.server
+	f.mu.Lock()
+	f.subs = append(f.subs, sub)
+	f.mu.Unlock()
+	go func() {
+		for {
+			select {
+			case msg := <-sub.msgs:
+				handler(msg.subject, msg.reply, msg.header, msg.data)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, s := range f.subs {
+			if s == sub {
+				f.subs = append(f.subs[:i], f.subs[i+1:]...)
+				close(sub.done)
+			}
+		}
+		return nil
+	}, nil
+}
+
+func (c fakeNATSConn) NewInbox() string {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.server.inboxes++
+	return fmt.Sprintf("_INBOX.%d", c.server.inboxes)
+}
+
+func (c fakeNATSConn) IsConnected() bool { return true }
+
+func (c fakeNATSConn) Close() {}
+
+// fakeKafka is a stand-in of a kafka cluster with single partition topics, topics are created by the first write.
+// readers of a group share the group offset, committed offsets are recorded but not used by the readers
+type fakeKafka struct {
+	mu      sync.Mutex
+	topics  map[string][]kafka.Message
+	groups  map[string]int     // next offset by topic and group
+	commits map[string][]int64 // committed offsets by topic and group
+	written chan struct{}      // closed and replaced on every write
+}
+
+func newFakeKafka() *fakeKafka {
+	return &fakeKafka{
+		topics:  make(map[string][]kafka.Message),
+		groups:  make(map[string]int),
+		commits: make(map[string][]int64),
+		written: make(chan struct{}),
+	}
+}
+
+type fakeKafkaWriter struct {
+	broker *fakeKafka
+}
+
+func (f *fakeKafka) writer() kafkaWriter {
+	return fakeKafkaWriter{f}
+}
+
+func (w fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f := w.broker
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range msgs {
+		msg.Offset = int64(len(f.topics[msg.Topic]))
+		msg.Time = time.Now()
+		f.topics[msg.Topic] = append(f.topics[msg.Topic], msg)
+	}
+	close(f.written)
+	f.written = make(chan struct{})
+	return nil
+}
+
+func (w fakeKafkaWriter) Close() error { return nil }
+
+type fakeKafkaReader struct {
+	broker       *fakeKafka
+	topic, group string
+	offset       int // used when the group is empty
+}
+
+func (f *fakeKafka) reader(topic, group string) kafkaReader {
+	return &fakeKafkaReader{broker: f, topic: topic, group: group}
+}
+
+func (r *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	f := r.broker
+	for {
+		f.mu.Lock()
+		key := r.topic + "/" + r.group
+		offset := r.offset
+		if r.group != "" {
+			offset = f.groups[key]
+		}
+		if msgs := f.topics[r.topic]; offset < len(msgs) {
+			if r.group != "" {
+				f.groups[key] = offset + 1
+			} else {
+				r.offset = offset + 1
+			}
+			f.mu.Unlock()
+			return msgs[offset], nil
+		}
+		written := f.written
+		f.mu.Unlock()
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		}
+	}
+}
+
+func (r *fakeKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f := r.broker
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.topic + "/" + r.group
+	for _, msg := range msgs {
+		f.commits[key] = append(f.commits[key], msg.Offset)
+	}
+	return nil
+}
+
+func (r *fakeKafkaReader) SetOffsetAt(ctx context.Context, t time.Time) error {
+	f := r.broker
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msgs, ok := f.topics[r.topic]
+	if !ok {
+		return fmt.Errorf("unknown topic %s", r.topic)
+	}
+	r.offset = len(msgs)
+	for i, msg := range msgs {
+		if !msg.Time.Before(t) {
+			r.offset = i
+			break
+		}
+	}
+	return nil
+}
+
+func (r *fakeKafkaReader) Close() error { return nil }
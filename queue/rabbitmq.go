@@ -3,7 +3,10 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bhakiyakalimuthu/server-clique/types"
@@ -12,45 +15,360 @@ import (
 	"go.uber.org/zap"
 )
 
+func init() {
+	Register("rabbitmq", func(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (Queue, error) {
+		return New(logger, connStr, queueName, appID, opts...)
+	})
+}
+
+// amqpConn and amqpChannel are the parts of the amqp connection used by the queue,
+// they are satisfied by a local stand-in in the tests
+type amqpConn interface {
+	Channel() (amqpChannel, error)
+	// NotifyClose gets the error once the connection is lost, it is closed without error on a graceful close
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type amqpChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	// Confirm puts the channel in confirm mode, the broker confirms every publishing on NotifyPublish then
+	Confirm(noWait bool) error
+	NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+}
+
+// amqpClient adapts the amqp connection
+type amqpClient struct {
+	*amqp.Connection
+}
+
+func (c amqpClient) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// dialAMQP connects to the amqp url
+func dialAMQP(connStr string) (amqpConn, error) {
+	conn, err := amqp.Dial(connStr)
+	if err != nil {
+		return nil, err
+	}
+	return amqpClient{conn}, nil
+}
+
+type publishing struct {
+	routingKey string
+	msg        amqp.Publishing
+}
+
 type queue struct {
 	logger    *zap.Logger
-	conn      *amqp.Connection
-	ch        *amqp.Channel
+	dial      func(connStr string) (amqpConn, error)
+	connStr   string
 	queueName string
 	appID     string
+	opts      options
+
+	mu     sync.Mutex
+	conn   amqpConn
+	ch     amqpChannel
+	ready  chan struct{} // closed once connected, replaced when the connection is lost
+	buffer []publishing  // messages published while disconnected
+
+	// confirmCh is the channel in confirm mode the deliveries are republished on before they are settled,
+	// confirmMu keeps a single publishing waiting for its confirmation
+	confirmMu sync.Mutex
+	confirmCh amqpChannel
+	confirms  chan amqp.Confirmation
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// reply queue is declared lazily by a request, again by the next one if it failed or the connection was lost
+	replyMu    sync.Mutex
+	replyQueue string
+	pendingMu  sync.Mutex
+	pending    map[string]chan *types.Response // pending requests by correlation id
+
+	// requeues of the consumed messages by message id, classic queues do not count the redeliveries.
+	// the counts are dropped on reconnection, the unsettled messages may be redelivered to another consumer then
+	retriesMu sync.Mutex
+	retries   map[string]int
 }
 
-func New(logger *zap.Logger, connStr, queueName, appID string) (*queue, error) {
-	conn, err := amqp.Dial(connStr)
+func New(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (*queue, error) {
+	return newRabbitMQQueue(logger, dialAMQP, connStr, queueName, appID, newOptions(opts...))
+}
+
+func newRabbitMQQueue(logger *zap.Logger, dial func(string) (amqpConn, error), connStr, queueName, appID string, opts options) (*queue, error) {
+	q := &queue{
+		logger:    logger,
+		dial:      dial,
+		connStr:   connStr,
+		queueName: queueName,
+		appID:     appID,
+		opts:      opts,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		pending:   make(map[string]chan *types.Response),
+		retries:   make(map[string]int),
+	}
+	// initial connection is not retried, misconfiguration should be reported straight away
+	if err := q.connect(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// connect dials the broker, declares the queue and flushes the buffered messages
+func (q *queue) connect() error {
+	conn, err := q.dial(q.connStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial %v", err)
+		return fmt.Errorf("failed to dial %v", err)
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create channel %v", err)
+		_ = conn.Close()
+		return fmt.Errorf("failed to create channel %v", err)
 	}
-	_, err = ch.QueueDeclare(queueName, false, false, false, false, nil)
+	_, err = ch.QueueDeclare(q.queueName, false, false, false, false, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare a queue: %v", err)
+		_ = conn.Close()
+		return fmt.Errorf("failed to declare a queue: %v", err)
 	}
-	return &queue{
-		logger:    logger,
-		conn:      conn,
-		ch:        ch,
-		queueName: queueName,
-		appID:     appID,
-	}, nil
+	_, err = ch.QueueDeclare(q.opts.deadLetterQueueOf(q.queueName), false, false, false, false, nil)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to declare the dead letter queue: %v", err)
+	}
+	confirmCh, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to create confirm channel %v", err)
+	}
+	if err := confirmCh.Confirm(false); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to put channel in confirm mode: %v", err)
+	}
+	confirms := confirmCh.NotifyPublish(make(chan amqp.Confirmation, 1))
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	confirmClosed := confirmCh.NotifyClose(make(chan *amqp.Error, 1))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		_ = conn.Close()
+		return ErrClosed
+	default:
+	}
+	q.conn, q.ch = conn, ch
+	q.confirmCh, q.confirms = confirmCh, confirms
+	flushed := 0
+	for _, p := range q.buffer {
+		if err := ch.Publish("", p.routingKey, false, false, p.msg); err != nil {
+			// connection is broken again, keep the rest for the next reconnection
+			q.logger.Warn("failed to flush buffered messages", zap.Int("remaining", len(q.buffer)-flushed), zap.Error(err))
+			break
+		}
+		flushed++
+	}
+	q.buffer = q.buffer[flushed:]
+	close(q.ready)
+	go q.supervise(conn, connClosed, chClosed, confirmClosed)
+	return nil
+}
+
+// supervise waits for the connection or one of the channels to be closed and reconnects unless the queue is closed
+func (q *queue) supervise(conn amqpConn, connClosed, chClosed, confirmClosed <-chan *amqp.Error) {
+	var reason *amqp.Error
+	select {
+	case <-q.done:
+		return
+	case reason = <-connClosed:
+	case reason = <-chClosed:
+	case reason = <-confirmClosed:
+	}
+	select {
+	case <-q.done: // closed gracefully
+		return
+	default:
+	}
+	q.logger.Warn("rabbit mq connection lost, reconnecting", zap.Any("reason", reason))
+	// the exclusive reply queue is deleted with the connection, the next request declares a new one
+	q.replyMu.Lock()
+	q.replyQueue = ""
+	q.replyMu.Unlock()
+	q.mu.Lock()
+	q.conn, q.ch = nil, nil
+	q.confirmCh, q.confirms = nil, nil
+	q.ready = make(chan struct{})
+	q.mu.Unlock()
+	q.retriesMu.Lock()
+	q.retries = make(map[string]int)
+	q.retriesMu.Unlock()
+	_ = conn.Close() // channel might be closed alone, make sure the connection is released as well
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-q.done:
+			return
+		case <-time.After(q.opts.backoff(attempt)):
+		}
+		err := q.connect()
+		if err == nil {
+			q.logger.Info("rabbit mq reconnected", zap.Int("attempt", attempt+1))
+			reconnectsTotal.WithLabelValues("rabbitmq").Inc()
+			return
+		}
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+		q.logger.Warn("failed to reconnect rabbit mq", zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+}
+
+func (q *queue) Health() error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ch == nil {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// channel returns the current channel, waits for the reconnection if the connection is down
+func (q *queue) channel(ctx context.Context) (amqpChannel, error) {
+	for {
+		q.mu.Lock()
+		ch, ready := q.ch, q.ready
+		q.mu.Unlock()
+		if ch != nil {
+			return ch, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-q.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// publish sends the message or applies the publish policy when the connection is down
+func (q *queue) publish(routingKey string, msg amqp.Publishing) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	if q.ch != nil && len(q.buffer) == 0 {
+		err := q.ch.Publish("", routingKey, false, false, msg)
+		if err == nil || q.opts.publishPolicy == PublishFailFast {
+			return err
+		}
+		q.logger.Warn("failed to publish, buffering the message", zap.Error(err))
+	}
+	if q.opts.publishPolicy == PublishFailFast {
+		return ErrNotConnected
+	}
+	if len(q.buffer) >= q.opts.publishBufferSize {
+		return ErrPublishBufferFull
+	}
+	q.buffer = append(q.buffer, publishing{routingKey: routingKey, msg: msg})
+	return nil
+}
+
+// errNotConfirmed is returned when the broker refuses to take over a publishing
+var errNotConfirmed = errors.New("publishing is not confirmed by the broker")
+
+// publishConfirmed publishes on the confirm channel and waits for the broker to confirm the publishing,
+// it is not buffered and fails straight away while the connection is down
+func (q *queue) publishConfirmed(routingKey string, msg amqp.Publishing) error {
+	q.confirmMu.Lock()
+	defer q.confirmMu.Unlock()
+	q.mu.Lock()
+	ch, confirms := q.confirmCh, q.confirms
+	q.mu.Unlock()
+	if ch == nil {
+		return ErrNotConnected
+	}
+	if err := ch.Publish("", routingKey, false, false, msg); err != nil {
+		return err
+	}
+	select {
+	case confirm, ok := <-confirms:
+		if !ok {
+			// channel is closed before the confirmation
+			return ErrNotConnected
+		}
+		if !confirm.Ack {
+			return errNotConfirmed
+		}
+		return nil
+	case <-q.done:
+		return ErrClosed
+	}
+}
+
+// publishNow sends the message straight away, it is not buffered while the connection is down
+func (q *queue) publishNow(routingKey string, msg amqp.Publishing) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	if q.ch == nil {
+		return ErrNotConnected
+	}
+	return q.ch.Publish("", routingKey, false, false, msg)
 }
 
 func (q *queue) Publish(message *types.Message) error {
 	message.Timestamp = time.Now()
-	body, err := json.Marshal(message)
+	body, err := q.opts.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return q.publish(q.queueName, amqp.Publishing{
+		ContentType:   q.opts.codec.ContentType(),
+		Timestamp:     time.Now(),
+		MessageId:     uuid.New().String(),
+		AppId:         q.appID,
+		ReplyTo:       message.ReplyTo,
+		CorrelationId: message.CorrelationID,
+		Headers:       amqpHeaders(message.Headers),
+		Body:          body,
+	})
+}
+
+func (q *queue) PublishEvent(event *types.Event) error {
+	body, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
-	return q.ch.Publish("", q.queueName, false, false, amqp.Publishing{
-		ContentType: "application/json",
+	return q.publish(q.queueName, amqp.Publishing{
+		ContentType: ContentTypeJSON,
 		Timestamp:   time.Now(),
 		MessageId:   uuid.New().String(),
 		AppId:       q.appID,
@@ -58,48 +376,446 @@ func (q *queue) Publish(message *types.Message) error {
 	})
 }
 
+func (q *queue) Request(ctx context.Context, message *types.Message) (*types.Response, error) {
+	replyQueue, err := q.replyQueueOf(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup reply queue: %w", err)
+	}
+
+	correlationID := uuid.New().String()
+	respChan := make(chan *types.Response, 1)
+	q.pendingMu.Lock()
+	q.pending[correlationID] = respChan
+	q.pendingMu.Unlock()
+	defer func() {
+		q.pendingMu.Lock()
+		delete(q.pending, correlationID)
+		q.pendingMu.Unlock()
+	}()
+
+	message.ReplyTo = replyQueue
+	message.CorrelationID = correlationID
+	if err := q.Publish(message); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response for request %s: %w", correlationID, ctx.Err())
+	}
+}
+
+// replyQueueOf returns the reply queue, it is set up if there is none yet
+func (q *queue) replyQueueOf(ctx context.Context) (string, error) {
+	q.replyMu.Lock()
+	defer q.replyMu.Unlock()
+	if q.replyQueue != "" {
+		return q.replyQueue, nil
+	}
+	replyQueue, err := q.setupReplyQueue(ctx)
+	if err != nil {
+		return "", err
+	}
+	q.replyQueue = replyQueue
+	return replyQueue, nil
+}
+
+// setupReplyQueue declares an exclusive queue and routes incoming responses to the pending requests until
+// the connection is lost, the queue is deleted by the broker then
+func (q *queue) setupReplyQueue(ctx context.Context) (string, error) {
+	replyQueue := "reply-" + uuid.New().String()
+	ch, err := q.channel(ctx)
+	if err != nil {
+		return "", err
+	}
+	deliveryChan, err := q.consumeReplies(ch, replyQueue)
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		for msg := range deliveryChan {
+			q.dispatchReply(msg)
+		}
+	}()
+	return replyQueue, nil
+}
+
+func (q *queue) consumeReplies(ch amqpChannel, replyQueue string) (<-chan amqp.Delivery, error) {
+	if _, err := ch.QueueDeclare(replyQueue, false, true, true, false, nil); err != nil {
+		return nil, err
+	}
+	return ch.Consume(replyQueue, "", true, true, false, false, nil)
+}
+
+func (q *queue) dispatchReply(msg amqp.Delivery) {
+	resp := new(types.Response)
+	if err := json.Unmarshal(msg.Body, resp); err != nil {
+		q.logger.Error("failed to unmarshal response body", zap.Error(err), zap.String("correlationID", msg.CorrelationId))
+		return
+	}
+	q.pendingMu.Lock()
+	respChan, ok := q.pending[msg.CorrelationId]
+	q.pendingMu.Unlock()
+	if !ok {
+		// request timed out already
+		q.logger.Warn("received response for unknown request", zap.String("correlationID", msg.CorrelationId))
+		return
+	}
+	select {
+	case respChan <- resp:
+	default: // duplicate response, request already answered
+	}
+}
+
+func (q *queue) Reply(message *types.Message, response *types.Response) error {
+	if message.ReplyTo == "" {
+		return nil
+	}
+	response.Timestamp = time.Now()
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	// reply is not buffered, the reply queue of the request is deleted with the connection
+	return q.publishNow(message.ReplyTo, amqp.Publishing{
+		ContentType:   ContentTypeJSON,
+		Timestamp:     time.Now(),
+		MessageId:     uuid.New().String(),
+		AppId:         q.appID,
+		CorrelationId: message.CorrelationID,
+		Body:          body,
+	})
+}
+
 func (q *queue) Close() error {
-	// gracefully close the connection
-	return q.conn.Close()
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if len(q.buffer) > 0 {
+			q.logger.Warn("queue closed with buffered messages, messages are dropped", zap.Int("count", len(q.buffer)))
+			droppedTotal.WithLabelValues("rabbitmq", dropClosed).Add(float64(len(q.buffer)))
+		}
+		// gracefully close the connection
+		if q.conn != nil {
+			err = q.conn.Close()
+		}
+	})
+	return err
 }
 
+// Consume keeps feeding the returned channel across reconnections, channel is closed when the context is done
+// or the queue is closed
 func (q *queue) Consume(ctx context.Context) (<-chan *types.Message, error) {
-	deliveryChan, err := q.ch.Consume(q.queueName, "", true, false, false, false, nil)
+	ch, err := q.channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deliveryChan, err := q.consume(ch)
 	if err != nil {
 		return nil, err
 	}
 	msgChan := make(chan *types.Message)
 	go func() {
 		defer close(msgChan)
+		for {
+			if !q.forward(ctx, deliveryChan, msgChan) {
+				return
+			}
+			q.logger.Warn("rabbit mq consumer stopped, waiting for reconnection")
+			for {
+				ch, err := q.channel(ctx)
+				if err != nil {
+					return // context done or queue closed
+				}
+				if deliveryChan, err = q.consume(ch); err == nil {
+					q.logger.Info("rabbit mq consumer recovered")
+					break
+				}
+				q.logger.Warn("failed to recover rabbit mq consumer", zap.Error(err))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(q.opts.minBackoff):
+				}
+			}
+		}
+	}()
+	return msgChan, nil
+}
+
+// consume starts consuming with manual acknowledgement, prefetch is applied per channel
+// so it has to be set again after every reconnection
+func (q *queue) consume(ch amqpChannel) (<-chan amqp.Delivery, error) {
+	if q.opts.prefetch > 0 {
+		if err := ch.Qos(q.opts.prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+	return ch.Consume(q.queueName, "", false, false, false, false, nil)
+}
+
+// forward decodes the deliveries into msgChan, returns true if the delivery channel is closed
+// and false if the context is done
+func (q *queue) forward(ctx context.Context, deliveryChan <-chan amqp.Delivery, msgChan chan<- *types.Message) bool {
+	for {
+		select {
+		case msg, ok := <-deliveryChan:
+			if !ok {
+				return true
+			}
+			m, err := decode(msg.ContentType, msg.Body)
+			if err != nil {
+				// message would fail again, so it is not requeued
+				q.deadLetter(msg, reasonOf(err), err)
+				continue
+			}
+			m.ReplyTo = msg.ReplyTo
+			m.CorrelationID = msg.CorrelationId
+			m.AppID = msg.AppId
+			m.Retries, m.Headers = retriesOf(stringHeaders(msg.Headers))
+			m.Retries += q.requeues(msg)
+			m.Redelivered = msg.Redelivered || m.Retries > 0
+			m.Acknowledger = delivery{Delivery: msg, queue: q}
+			span := dequeue("rabbitmq", q.queueName, m)
+			select {
+			// make sure that none of the msg get into msgChan  after context gets cancelled,
+			// unacknowledged message is redelivered by the broker once the connection is closed
+			case <-ctx.Done():
+				span.End()
+				return false
+			case msgChan <- m: // send in messages
+			}
+			span.End()
+
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// deadLetter publishes the delivery as it is to the dead letter queue with the failure in the headers, the delivery
+// is acked once the broker confirms the publishing. if that fails the delivery is requeued, so it is dead lettered
+// again once redelivered rather than lost
+func (q *queue) deadLetter(msg amqp.Delivery, reason string, err error) {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := q.publishConfirmed(dlq, republishing(msg, deadLetterHeaders(stringHeaders(msg.Headers), q.queueName, reason, err))); err != nil {
+		q.logger.Error("failed to dead letter message, requeueing it", zap.Error(err))
+		if err := msg.Nack(false, true); err != nil {
+			q.logger.Error("failed to nack message", zap.Error(err))
+		}
+		return
+	}
+	deadLetteredTotal.WithLabelValues("rabbitmq", reason).Inc()
+	if err := msg.Ack(false); err != nil {
+		q.logger.Error("failed to ack message", zap.Error(err))
+	}
+}
+
+// RequeueMessage publishes the message on its own to the tail of the queue, e.g. a failed message of a batch
+func (q *queue) RequeueMessage(message *types.Message) error {
+	return requeueMessage(q, q.opts, q.queueName, message)
+}
+
+// DeadLetterMessage publishes the message on its own to the dead letter queue, e.g. a failed message of a batch
+func (q *queue) DeadLetterMessage(message *types.Message, reason string, err error) error {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := deadLetterMessage(q, q.opts, q.queueName, message, reason, err); err != nil {
+		return err
+	}
+	deadLetteredTotal.WithLabelValues("rabbitmq", reason).Inc()
+	return nil
+}
+
+// ConsumeRaw consumes the queue name on the current channel with the prefetch of the queue
+func (q *queue) ConsumeRaw(ctx context.Context, queueName string) (<-chan *Envelope, error) {
+	ch, err := q.channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if q.opts.prefetch > 0 {
+		if err := ch.Qos(q.opts.prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+	consumerTag := uuid.New().String()
+	deliveryChan, err := ch.Consume(queueName, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	envelopes := make(chan *Envelope)
+	go func() {
+		defer close(envelopes)
+		// unsettled deliveries are redelivered by the broker once the connection is closed
+		defer func() { _ = ch.Cancel(consumerTag, false) }()
 		for {
 			select {
 			case msg, ok := <-deliveryChan:
-				// do not proceed if connection closed
-				// alternatively ch.NotifyClose can be used
-				// retry logic is not implemented
 				if !ok {
-					q.logger.Warn("rabbit mq connection closed")
-					// Instead of returning here, os.Exit might be an option as
-					// server will be waiting for termination signal and also no way to reconnect the connection
 					return
 				}
-				m := new(types.Message)
-				if err := json.Unmarshal(msg.Body, &m); err != nil {
-					q.logger.Error("failed to unmarshal message body", zap.Error(err), zap.Any("msg", msg))
-					continue
+				envelope := &Envelope{
+					Body:          msg.Body,
+					ContentType:   msg.ContentType,
+					ReplyTo:       msg.ReplyTo,
+					CorrelationID: msg.CorrelationId,
+					AppID:         msg.AppId,
+					Headers:       stringHeaders(msg.Headers),
+					Acknowledger:  delivery{Delivery: msg, queue: q},
 				}
 				select {
-				// make sure that none of the msg get into msgChan  after context gets cancelled
+				case envelopes <- envelope:
 				case <-ctx.Done():
 					return
-				case msgChan <- m: // send in messages
-				default:
 				}
-
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-	return msgChan, nil
+	return envelopes, nil
+}
+
+func (q *queue) PublishRaw(queueName string, envelope *Envelope) error {
+	return q.publish(queueName, amqp.Publishing{
+		ContentType:   envelope.ContentType,
+		Timestamp:     time.Now(),
+		MessageId:     uuid.New().String(),
+		AppId:         envelope.AppID,
+		ReplyTo:       envelope.ReplyTo,
+		CorrelationId: envelope.CorrelationID,
+		Headers:       amqpHeaders(envelope.Headers),
+		Body:          envelope.Body,
+	})
+}
+
+// republishing copies the delivery to be published again with the headers
+func republishing(msg amqp.Delivery, headers map[string]string) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		Timestamp:       msg.Timestamp,
+		MessageId:       msg.MessageId,
+		AppId:           msg.AppId,
+		ReplyTo:         msg.ReplyTo,
+		CorrelationId:   msg.CorrelationId,
+		Headers:         amqpHeaders(headers),
+		Body:            msg.Body,
+	}
+}
+
+func amqpHeaders(headers map[string]string) amqp.Table {
+	if len(headers) == 0 {
+		return nil
+	}
+	table := make(amqp.Table, len(headers))
+	for key, value := range headers {
+		table[key] = value
+	}
+	return table
+}
+
+// stringHeaders keeps the string headers, the others are not set by the queue
+func stringHeaders(table amqp.Table) map[string]string {
+	if len(table) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(table))
+	for key, value := range table {
+		if value, ok := value.(string); ok {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// headerDeliveryCount counts the redeliveries of a message of a quorum queue
+const headerDeliveryCount = "x-delivery-count"
+
+// requeues returns how many times the delivered message was requeued, counted by the broker for the quorum
+// queues or by the queue for the messages it requeued by id
+func (q *queue) requeues(msg amqp.Delivery) int {
+	switch count := msg.Headers[headerDeliveryCount].(type) {
+	case int64:
+		return int(count)
+	case int32:
+		return int(count)
+	case int:
+		return count
+	}
+	if msg.MessageId == "" {
+		return 0
+	}
+	q.retriesMu.Lock()
+	defer q.retriesMu.Unlock()
+	return q.retries[msg.MessageId]
+}
+
+// requeued counts a requeue of the message by id, unless the broker counts them
+func (q *queue) requeued(msg amqp.Delivery) {
+	if _, ok := msg.Headers[headerDeliveryCount]; ok {
+		return
+	}
+	q.retriesMu.Lock()
+	q.retries[msg.MessageId]++
+	q.retriesMu.Unlock()
+}
+
+// settled forgets the requeues of the message once it left the queue
+func (q *queue) settled(msg amqp.Delivery) {
+	if msg.MessageId == "" {
+		return
+	}
+	q.retriesMu.Lock()
+	delete(q.retries, msg.MessageId)
+	q.retriesMu.Unlock()
+}
+
+// delivery settles the message on the channel it was delivered on
+type delivery struct {
+	amqp.Delivery
+	queue *queue
+}
+
+func (d delivery) Ack() error {
+	d.queue.settled(d.Delivery)
+	return d.Delivery.Ack(false)
+}
+
+// Nack with requeue puts the message back to its place in the queue, so it stays ahead of the messages of its key
+// not delivered yet. a message without id cannot be counted unless the queue is a quorum queue, it is published
+// again to the end of the queue with the retries incremented in the headers instead and acked once confirmed
+func (d delivery) Nack(requeue bool) error {
+	if !requeue {
+		d.queue.settled(d.Delivery)
+		return d.Delivery.Nack(false, false)
+	}
+	if _, counted := d.Headers[headerDeliveryCount]; counted || d.MessageId != "" {
+		d.queue.requeued(d.Delivery)
+		return d.Delivery.Nack(false, true)
+	}
+	headers := stringHeaders(d.Headers)
+	retries, _ := retriesOf(headers)
+	if headers == nil {
+		headers = make(map[string]string, 1)
+	}
+	headers[HeaderRetries] = strconv.Itoa(retries + 1)
+	if err := d.queue.publishConfirmed(d.queue.queueName, republishing(d.Delivery, headers)); err != nil {
+		// put back to its place instead, its retries are not counted then
+		if nackErr := d.Delivery.Nack(false, true); nackErr != nil {
+			d.queue.logger.Error("failed to nack message", zap.Error(nackErr))
+		}
+		return fmt.Errorf("failed to requeue message: %w", err)
+	}
+	return d.Delivery.Ack(false)
+}
+
+func (d delivery) DeadLetter(reason string, cause error) error {
+	d.queue.settled(d.Delivery)
+	d.queue.deadLetter(d.Delivery, reason, cause)
+	return nil
 }
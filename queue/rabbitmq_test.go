@@ -0,0 +1,499 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// fakeAcknowledger records how the deliveries are settled
+type fakeAcknowledger struct {
+	acked, nacked, requeued int
+}
+
+func (a *fakeAcknowledger) Ack(uint64, bool) error {
+	a.acked++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	a.nacked++
+	if requeue {
+		a.requeued++
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(_ uint64, requeue bool) error {
+	return a.Nack(0, false, requeue)
+}
+
+func TestRabbitMQ_Requeue(t *testing.T) {
+	q := &queue{
+		logger:    zap.NewNop(),
+		queueName: "queue",
+		opts:      newOptions(),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		retries:   make(map[string]int),
+	}
+
+	// requeued message keeps its place in the queue, its requeues are counted by id
+	ack := new(fakeAcknowledger)
+	msg := amqp.Delivery{Acknowledger: ack, MessageId: "id"}
+	for retries := 1; retries <= 2; retries++ {
+		assert.Equal(t, nil, delivery{Delivery: msg, queue: q}.Nack(true))
+		assert.Equal(t, retries, q.requeues(msg))
+	}
+	assert.Equal(t, &fakeAcknowledger{nacked: 2, requeued: 2}, ack)
+	assert.Equal(t, nil, delivery{Delivery: msg, queue: q}.Ack())
+	assert.Equal(t, 0, q.requeues(msg))
+	assert.Equal(t, 0, len(q.retries))
+
+	// quorum queues count the redeliveries
+	ack = new(fakeAcknowledger)
+	msg = amqp.Delivery{Acknowledger: ack, MessageId: "id", Headers: amqp.Table{headerDeliveryCount: int64(3)}}
+	assert.Equal(t, nil, delivery{Delivery: msg, queue: q}.Nack(true))
+	assert.Equal(t, &fakeAcknowledger{nacked: 1, requeued: 1}, ack)
+	assert.Equal(t, 3, q.requeues(msg))
+	assert.Equal(t, 0, len(q.retries))
+
+	// message without id is published again to the end of the queue with its retries in the headers,
+	// it is put back to its place while disconnected
+	ack = new(fakeAcknowledger)
+	msg = amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{HeaderRetries: "1", "key": "value"}}
+	assert.NotEqual(t, nil, delivery{Delivery: msg, queue: q}.Nack(true))
+	assert.Equal(t, &fakeAcknowledger{nacked: 1, requeued: 1}, ack)
+	assert.Equal(t, 0, len(q.buffer))
+	b := newFakeAMQP()
+	q.confirmCh, q.confirms = confirmChannel(t, b)
+	ack = new(fakeAcknowledger)
+	assert.Equal(t, nil, delivery{Delivery: amqp.Delivery{Acknowledger: ack, Headers: msg.Headers}, queue: q}.Nack(true))
+	assert.Equal(t, &fakeAcknowledger{acked: 1}, ack)
+	requeued := b.queued("queue")
+	assert.Equal(t, 1, len(requeued))
+	assert.Equal(t, amqp.Table{HeaderRetries: "2", "key": "value"}, requeued[0].Headers)
+
+	// rejected message is not counted anymore
+	ack = new(fakeAcknowledger)
+	msg = amqp.Delivery{Acknowledger: ack, MessageId: "rejected"}
+	assert.Equal(t, nil, delivery{Delivery: msg, queue: q}.Nack(true))
+	assert.Equal(t, nil, delivery{Delivery: msg, queue: q}.Nack(false))
+	assert.Equal(t, &fakeAcknowledger{nacked: 2, requeued: 1}, ack)
+	assert.Equal(t, 0, len(q.retries))
+}
+
+func TestRabbitMQ_DeadLetter(t *testing.T) {
+	b := newFakeAMQP()
+	q := &queue{
+		logger:    zap.NewNop(),
+		queueName: "queue",
+		opts:      newOptions(),
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+		retries:   make(map[string]int),
+	}
+
+	// delivery is requeued while disconnected, not buffered
+	ack := new(fakeAcknowledger)
+	msg := amqp.Delivery{Acknowledger: ack, MessageId: "id", Body: []byte("body")}
+	q.deadLetter(msg, ReasonMalformed, errors.New("malformed"))
+	assert.Equal(t, &fakeAcknowledger{nacked: 1, requeued: 1}, ack)
+	assert.Equal(t, 0, len(q.buffer))
+
+	// delivery is acked once the broker confirms the dead letter
+	q.confirmCh, q.confirms = confirmChannel(t, b)
+	ack = new(fakeAcknowledger)
+	msg.Acknowledger = ack
+	q.deadLetter(msg, ReasonMalformed, errors.New("malformed"))
+	assert.Equal(t, &fakeAcknowledger{acked: 1}, ack)
+	dead := b.queued(DeadLetterQueue("queue"))
+	assert.Equal(t, 1, len(dead))
+	assert.Equal(t, "body", string(dead[0].Body))
+	assert.Equal(t, ReasonMalformed, dead[0].Headers[HeaderDeadLetterReason])
+
+	// nacked confirmation requeues the delivery
+	b.nackConfirm(true)
+	ack = new(fakeAcknowledger)
+	msg.Acknowledger = ack
+	q.deadLetter(msg, ReasonMalformed, errors.New("malformed"))
+	assert.Equal(t, &fakeAcknowledger{nacked: 1, requeued: 1}, ack)
+}
+
+func TestRabbitMQ_Reconnect(t *testing.T) {
+	l := zap.NewNop()
+	b := newFakeAMQP()
+	opts := newOptions(WithReconnectBackoff(time.Millisecond, 5*time.Millisecond))
+
+	// initial connection is not retried
+	b.setDown(true)
+	_, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "server", opts)
+	assert.NotEqual(t, nil, err)
+	b.setDown(false)
+
+	client, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "client", opts)
+	assert.Equal(t, nil, err)
+	defer client.Close()
+	server, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "server", opts)
+	assert.Equal(t, nil, err)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgChan, err := server.Consume(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, client.Health())
+
+	// messages published during the outage are buffered, reconnection is retried with backoff until the broker is back
+	dials := b.dialed()
+	b.drop()
+	eventually(t, func() bool { return client.Health() == ErrNotConnected && server.Health() == ErrNotConnected })
+	for _, key := range []string{"A", "B"} {
+		assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: key, Value: "v"}))
+	}
+	eventually(t, func() bool { return b.dialed() >= dials+6 })
+	b.setDown(false)
+	eventually(t, func() bool { return client.Health() == nil && server.Health() == nil })
+
+	// buffered messages are flushed in order and the consumer is recovered
+	for _, key := range []string{"A", "B"} {
+		msg := receive(t, msgChan)
+		assert.Equal(t, key, msg.Key)
+		assert.Equal(t, nil, msg.Ack())
+	}
+	assert.Equal(t, nil, client.Close())
+	assert.Equal(t, ErrClosed, client.Health())
+	assert.Equal(t, ErrClosed, client.Publish(&types.Message{Action: types.AddItem, Key: "C"}))
+}
+
+func TestRabbitMQ_PublishPolicy(t *testing.T) {
+	l := zap.NewNop()
+	b := newFakeAMQP()
+	buffered, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "buffered", newOptions(WithPublishPolicy(PublishBuffer, 1)))
+	assert.Equal(t, nil, err)
+	defer buffered.Close()
+	failFast, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "failfast", newOptions(WithPublishPolicy(PublishFailFast, 0)))
+	assert.Equal(t, nil, err)
+	defer failFast.Close()
+
+	b.drop()
+	eventually(t, func() bool { return buffered.Health() == ErrNotConnected && failFast.Health() == ErrNotConnected })
+	assert.Equal(t, nil, buffered.Publish(&types.Message{Action: types.AddItem, Key: "A"}))
+	assert.Equal(t, ErrPublishBufferFull, buffered.Publish(&types.Message{Action: types.AddItem, Key: "B"}))
+	assert.Equal(t, ErrNotConnected, failFast.Publish(&types.Message{Action: types.AddItem, Key: "A"}))
+}
+
+func TestRabbitMQ_ReplyQueue(t *testing.T) {
+	l := zap.NewNop()
+	b := newFakeAMQP()
+	opts := newOptions(WithReconnectBackoff(time.Millisecond, 5*time.Millisecond))
+	client, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "client", opts)
+	assert.Equal(t, nil, err)
+	defer client.Close()
+	server, err := newRabbitMQQueue(l, b.dial, "amqp://fake", "queue", "server", opts)
+	assert.Equal(t, nil, err)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msgChan, err := server.Consume(ctx)
+	assert.Equal(t, nil, err)
+	go func() {
+		for msg := range msgChan {
+			_ = server.Reply(msg, &types.Response{Action: msg.Action, Status: types.StatusOK, Key: msg.Key})
+			_ = msg.Ack()
+		}
+	}()
+	request := func() (*types.Response, string, error) {
+		message := &types.Message{Action: types.GetItem, Key: "A"}
+		resp, err := client.Request(ctx, message)
+		return resp, message.ReplyTo, err
+	}
+
+	// failed setup of the reply queue is not kept, the next request declares it again
+	b.failDeclare(errors.New("access refused"))
+	_, _, err = request()
+	assert.NotEqual(t, nil, err)
+	resp, replyQueue, err := request()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "A", resp.Key)
+	_, again, err := request()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, replyQueue, again)
+
+	// reply queue is deleted with the connection, a reply is not buffered and a new queue is declared once reconnected
+	b.drop()
+	eventually(t, func() bool { return client.Health() == ErrNotConnected && server.Health() == ErrNotConnected })
+	reply := &types.Message{Action: types.GetItem, Key: "A", ReplyTo: replyQueue, CorrelationID: "id"}
+	assert.Equal(t, ErrNotConnected, server.Reply(reply, &types.Response{Action: types.GetItem, Status: types.StatusOK, Key: "A"}))
+	assert.Equal(t, 0, len(server.buffer))
+	b.setDown(false)
+	resp, again, err = request()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "A", resp.Key)
+	assert.NotEqual(t, replyQueue, again)
+}
+
+// confirmChannel opens a channel in confirm mode on the broker
+func confirmChannel(t *testing.T, b *fakeAMQP) (amqpChannel, chan amqp.Confirmation) {
+	t.Helper()
+	conn, err := b.dial("amqp://fake")
+	assert.Equal(t, nil, err)
+	ch, err := conn.Channel()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, ch.Confirm(false))
+	return ch, ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+}
+
+// eventually fails the test if the condition is not met within 2 seconds
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeAMQP is a stand-in of the amqp broker routing the messages by queue name to one consumer of the queue.
+// dialing fails while it is down, dropping it loses all of its connections
+type fakeAMQP struct {
+	mu           sync.Mutex
+	down         bool
+	dials        int
+	declareErr   error // returned by the next queue declare
+	nackConfirms bool  // publishings on the channels in confirm mode are nacked
+	conns        []*fakeAMQPConn
+	queues       map[string][]amqp.Delivery
+	consumers    map[string]chan amqp.Delivery
+}
+
+func newFakeAMQP() *fakeAMQP {
+	return &fakeAMQP{queues: make(map[string][]amqp.Delivery), consumers: make(map[string]chan amqp.Delivery)}
+}
+
+func (b *fakeAMQP) dial(string) (amqpConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.down {
+		return nil, errors.New("connection refused")
+	}
+	conn := &fakeAMQPConn{broker: b}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+func (b *fakeAMQP) dialed() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+func (b *fakeAMQP) setDown(down bool) {
+	b.mu.Lock()
+	b.down = down
+	b.mu.Unlock()
+}
+
+func (b *fakeAMQP) nackConfirm(nack bool) {
+	b.mu.Lock()
+	b.nackConfirms = nack
+	b.mu.Unlock()
+}
+
+func (b *fakeAMQP) queued(name string) []amqp.Delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]amqp.Delivery(nil), b.queues[name]...)
+}
+
+func (b *fakeAMQP) failDeclare(err error) {
+	b.mu.Lock()
+	b.declareErr = err
+	b.mu.Unlock()
+}
+
+// drop takes the broker down and loses its connections, the consumers are cancelled
+func (b *fakeAMQP) drop() {
+	b.mu.Lock()
+	b.down = true
+	conns := b.conns
+	b.conns = nil
+	for name, deliveries := range b.consumers {
+		close(deliveries)
+		delete(b.consumers, name)
+	}
+	b.mu.Unlock()
+	for _, conn := range conns {
+		conn.lose(&amqp.Error{Code: amqp.ConnectionForced, Reason: "connection dropped"})
+	}
+}
+
+type fakeAMQPConn struct {
+	broker   *fakeAMQP
+	mu       sync.Mutex
+	closed   bool
+	notify   []chan *amqp.Error
+	confirms []chan amqp.Confirmation // listeners of all the channels, closed with the connection
+}
+
+func (c *fakeAMQPConn) Channel() (amqpChannel, error) {
+	return &fakeAMQPChannel{conn: c}, nil
+}
+
+func (c *fakeAMQPConn) NotifyClose(ch chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(ch)
+		return ch
+	}
+	c.notify = append(c.notify, ch)
+	return ch
+}
+
+func (c *fakeAMQPConn) Close() error {
+	c.lose(nil)
+	return nil
+}
+
+// lose sends the error to the listeners and closes them, noop once the connection is closed
+func (c *fakeAMQPConn) lose(err *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for _, ch := range c.notify {
+		if err != nil {
+			ch <- err
+		}
+		close(ch)
+	}
+	for _, ch := range c.confirms {
+		close(ch)
+	}
+}
+
+func (c *fakeAMQPConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// fakeAMQPChannel is the channel of the connection, it is closed with the connection.
+// the confirm mode fields are guarded by the connection lock
+type fakeAMQPChannel struct {
+	conn       *fakeAMQPConn
+	confirming bool
+	tag        uint64
+	confirms   []chan amqp.Confirmation
+}
+
+func (ch *fakeAMQPChannel) QueueDeclare(name string, _, _, _, _ bool, _ amqp.Table) (amqp.Queue, error) {
+	if ch.conn.isClosed() {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.declareErr; err != nil {
+		b.declareErr = nil
+		return amqp.Queue{}, err
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeAMQPChannel) Qos(int, int, bool) error {
+	if ch.conn.isClosed() {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Consume(queue, _ string, _, _, _, _ bool, _ amqp.Table) (<-chan amqp.Delivery, error) {
+	if ch.conn.isClosed() {
+		return nil, amqp.ErrClosed
+	}
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	deliveries := make(chan amqp.Delivery, 64)
+	for _, msg := range b.queues[queue] {
+		deliveries <- msg
+	}
+	delete(b.queues, queue)
+	b.consumers[queue] = deliveries
+	return deliveries, nil
+}
+
+func (ch *fakeAMQPChannel) Cancel(string, bool) error { return nil }
+
+func (ch *fakeAMQPChannel) Publish(_, key string, _, _ bool, msg amqp.Publishing) error {
+	if ch.conn.isClosed() {
+		return amqp.ErrClosed
+	}
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := amqp.Delivery{
+		Acknowledger:  new(fakeAcknowledger),
+		Headers:       msg.Headers,
+		ContentType:   msg.ContentType,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		MessageId:     msg.MessageId,
+		AppId:         msg.AppId,
+		RoutingKey:    key,
+		Body:          msg.Body,
+	}
+	if deliveries, ok := b.consumers[key]; ok {
+		deliveries <- d
+	} else {
+		b.queues[key] = append(b.queues[key], d)
+	}
+	ch.conn.mu.Lock()
+	defer ch.conn.mu.Unlock()
+	if ch.confirming && !ch.conn.closed {
+		ch.tag++
+		for _, confirms := range ch.confirms {
+			confirms <- amqp.Confirmation{DeliveryTag: ch.tag, Ack: !b.nackConfirms}
+		}
+	}
+	return nil
+}
+
+func (ch *fakeAMQPChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return ch.conn.NotifyClose(c)
+}
+
+func (ch *fakeAMQPChannel) Confirm(bool) error {
+	ch.conn.mu.Lock()
+	defer ch.conn.mu.Unlock()
+	if ch.conn.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *fakeAMQPChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.conn.mu.Lock()
+	defer ch.conn.mu.Unlock()
+	if ch.conn.closed {
+		close(c)
+		return c
+	}
+	ch.confirms = append(ch.confirms, c)
+	ch.conn.confirms = append(ch.conn.confirms, c)
+	return c
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Driver opens a queue of a backend, format of the connection string is specific to the backend.
+// options not applicable to the backend are ignored
+type Driver func(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (Queue, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes the backend available by the given name, it panics if the name is registered twice
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("queue: driver is nil")
+	}
+	if _, ok := drivers[name]; ok {
+		panic("queue: driver registered twice " + name)
+	}
+	drivers[name] = driver
+}
+
+// Drivers returns the sorted names of the registered backends
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates a queue with the backend registered by the given name
+func Open(driver string, logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (Queue, error) {
+	driversMu.RLock()
+	open, ok := drivers[driver]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown queue driver %q, registered drivers are %v", driver, Drivers())
+	}
+	return open(logger, connStr, queueName, appID, opts...)
+}
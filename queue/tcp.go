@@ -0,0 +1,574 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/broker"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("tcp", func(logger *zap.Logger, connStr, queueName, appID string, opts ...Option) (Queue, error) {
+		return NewTCP(logger, connStr, queueName, appID, opts...)
+	})
+}
+
+// tcpConn serialises the frames written by the publishers, consumers and acknowledgements
+type tcpConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *tcpConn) write(frame *broker.Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return broker.WriteFrame(c.Conn, frame)
+}
+
+// tcpDelivery is a delivered message with the connection it has to be settled on
+type tcpDelivery struct {
+	queue *tcpQueue
+	conn  *tcpConn
+	frame *broker.Frame
+}
+
+func (d tcpDelivery) Ack() error {
+	return d.conn.write(&broker.Frame{Op: broker.OpAck, Tag: d.frame.Tag})
+}
+
+func (d tcpDelivery) Nack(requeue bool) error {
+	return d.conn.write(&broker.Frame{Op: broker.OpNack, Tag: d.frame.Tag, Requeue: requeue})
+}
+
+func (d tcpDelivery) DeadLetter(reason string, cause error) error {
+	d.queue.deadLetter(d, reason, cause)
+	return nil
+}
+
+// tcpSub is a subscription to a queue, it is subscribed again after every reconnection
+type tcpSub struct {
+	queue      string
+	prefetch   int
+	exclusive  bool
+	deliveries chan tcpDelivery
+	done       chan struct{} // closed when the subscription is cancelled
+}
+
+func (s *tcpSub) frame() *broker.Frame {
+	return &broker.Frame{Op: broker.OpConsume, Queue: s.queue, Prefetch: s.prefetch, Exclusive: s.exclusive}
+}
+
+// tcpQueue is the client of the embedded broker, it follows the rabbit mq queue: the connection is supervised
+// and reconnected with backoff and the publish policy applies while it is down
+type tcpQueue struct {
+	logger    *zap.Logger
+	addr      string
+	queueName string
+	appID     string
+	opts      options
+
+	mu     sync.Mutex
+	conn   *tcpConn
+	ready  chan struct{}   // closed once connected, replaced when the connection is lost
+	buffer []*broker.Frame // messages published while disconnected
+	subs   map[string]*tcpSub
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// reply queue is subscribed lazily on the first request
+	replyOnce  sync.Once
+	replyQueue string
+	replyErr   error
+	pendingMu  sync.Mutex
+	pending    map[string]chan *types.Response // pending requests by correlation id
+}
+
+// NewTCP connects to the embedded broker listening on the address
+func NewTCP(logger *zap.Logger, addr, queueName, appID string, opts ...Option) (*tcpQueue, error) {
+	q := &tcpQueue{
+		logger:    logger,
+		addr:      addr,
+		queueName: queueName,
+		appID:     appID,
+		opts:      newOptions(opts...),
+		ready:     make(chan struct{}),
+		subs:      make(map[string]*tcpSub),
+		done:      make(chan struct{}),
+		pending:   make(map[string]chan *types.Response),
+	}
+	// initial connection is not retried, misconfiguration should be reported straight away
+	if err := q.connect(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// connect dials the broker, declares the queue, subscribes again and flushes the buffered messages
+func (q *tcpQueue) connect() error {
+	netConn, err := net.Dial("tcp", q.addr)
+	if err != nil {
+		return fmt.Errorf("failed to dial %v", err)
+	}
+	conn := &tcpConn{Conn: netConn}
+	if err := conn.write(&broker.Frame{Op: broker.OpDeclare, Queue: q.queueName}); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to declare a queue: %v", err)
+	}
+	if err := conn.write(&broker.Frame{Op: broker.OpDeclare, Queue: q.opts.deadLetterQueueOf(q.queueName)}); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to declare the dead letter queue: %v", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		_ = conn.Close()
+		return ErrClosed
+	default:
+	}
+	for _, sub := range q.subs {
+		if err := conn.write(sub.frame()); err != nil {
+			_ = conn.Close()
+			return fmt.Errorf("failed to subscribe %s: %v", sub.queue, err)
+		}
+	}
+	flushed := 0
+	for _, frame := range q.buffer {
+		if err := conn.write(frame); err != nil {
+			// connection is broken again, keep the rest for the next reconnection
+			q.logger.Warn("failed to flush buffered messages", zap.Int("remaining", len(q.buffer)-flushed), zap.Error(err))
+			break
+		}
+		flushed++
+	}
+	q.buffer = q.buffer[flushed:]
+	q.conn = conn
+	close(q.ready)
+	go q.readLoop(conn)
+	return nil
+}
+
+// readLoop routes the deliveries to the subscriptions until the connection is lost, then reconnects
+// unless the queue is closed
+func (q *tcpQueue) readLoop(conn *tcpConn) {
+	r := bufio.NewReader(conn)
+	var err error
+	for {
+		var frame *broker.Frame
+		if frame, err = broker.ReadFrame(r); err != nil {
+			break
+		}
+		switch frame.Op {
+		case broker.OpDeliver:
+			q.deliver(tcpDelivery{queue: q, conn: conn, frame: frame})
+		case broker.OpError:
+			q.logger.Warn("broker rejected frame", zap.String("queue", frame.Queue), zap.String("error", frame.Error))
+		}
+	}
+	select {
+	case <-q.done: // closed gracefully
+		return
+	default:
+	}
+	q.logger.Warn("broker connection lost, reconnecting", zap.Error(err))
+	q.mu.Lock()
+	q.conn = nil
+	q.ready = make(chan struct{})
+	q.mu.Unlock()
+	_ = conn.Close()
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-q.done:
+			return
+		case <-time.After(q.opts.backoff(attempt)):
+		}
+		err := q.connect()
+		if err == nil {
+			q.logger.Info("broker reconnected", zap.Int("attempt", attempt+1))
+			reconnectsTotal.WithLabelValues("tcp").Inc()
+			return
+		}
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+		q.logger.Warn("failed to reconnect broker", zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+}
+
+func (q *tcpQueue) deliver(d tcpDelivery) {
+	q.mu.Lock()
+	sub, ok := q.subs[d.frame.Queue]
+	q.mu.Unlock()
+	if ok {
+		select {
+		case sub.deliveries <- d:
+			return
+		case <-sub.done:
+		case <-q.done:
+			return
+		}
+	}
+	// subscription is cancelled, give the message to another consumer
+	if err := d.Nack(true); err != nil {
+		q.logger.Warn("failed to requeue delivery", zap.Error(err))
+	}
+}
+
+// subscribe registers the subscription and sends it to the broker if connected, otherwise it is sent once reconnected
+func (q *tcpQueue) subscribe(sub *tcpSub) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.subs[sub.queue]; ok {
+		return fmt.Errorf("already consuming %s", sub.queue)
+	}
+	q.subs[sub.queue] = sub
+	if q.conn != nil {
+		// a write failure means the connection is lost, the subscription is sent again on reconnection
+		_ = q.conn.write(sub.frame())
+	}
+	return nil
+}
+
+func (q *tcpQueue) unsubscribe(sub *tcpSub) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.subs, sub.queue)
+	close(sub.done)
+	if q.conn != nil {
+		_ = q.conn.write(&broker.Frame{Op: broker.OpCancel, Queue: sub.queue})
+	}
+}
+
+func (q *tcpQueue) Health() error {
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn == nil {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// publish sends the frame or applies the publish policy when the connection is down
+func (q *tcpQueue) publish(frame *broker.Frame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		return ErrClosed
+	default:
+	}
+	if q.conn != nil && len(q.buffer) == 0 {
+		err := q.conn.write(frame)
+		if err == nil || q.opts.publishPolicy == PublishFailFast {
+			return err
+		}
+		q.logger.Warn("failed to publish, buffering the message", zap.Error(err))
+	}
+	if q.opts.publishPolicy == PublishFailFast {
+		return ErrNotConnected
+	}
+	if len(q.buffer) >= q.opts.publishBufferSize {
+		return ErrPublishBufferFull
+	}
+	q.buffer = append(q.buffer, frame)
+	return nil
+}
+
+func (q *tcpQueue) Publish(message *types.Message) error {
+	message.Timestamp = time.Now()
+	body, err := q.opts.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return q.publish(&broker.Frame{
+		Op:            broker.OpPublish,
+		Queue:         q.queueName,
+		ReplyTo:       message.ReplyTo,
+		CorrelationID: message.CorrelationID,
+		AppID:         q.appID,
+		ContentType:   q.opts.codec.ContentType(),
+		Headers:       message.Headers,
+		Body:          body,
+	})
+}
+
+func (q *tcpQueue) PublishEvent(event *types.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return q.publish(&broker.Frame{
+		Op:          broker.OpPublish,
+		Queue:       q.queueName,
+		AppID:       q.appID,
+		ContentType: ContentTypeJSON,
+		Body:        body,
+	})
+}
+
+func (q *tcpQueue) Request(ctx context.Context, message *types.Message) (*types.Response, error) {
+	q.replyOnce.Do(func() {
+		q.replyErr = q.setupReplyQueue()
+	})
+	if q.replyErr != nil {
+		return nil, fmt.Errorf("failed to setup reply queue: %v", q.replyErr)
+	}
+
+	correlationID := uuid.New().String()
+	respChan := make(chan *types.Response, 1)
+	q.pendingMu.Lock()
+	q.pending[correlationID] = respChan
+	q.pendingMu.Unlock()
+	defer func() {
+		q.pendingMu.Lock()
+		delete(q.pending, correlationID)
+		q.pendingMu.Unlock()
+	}()
+
+	message.ReplyTo = q.replyQueue
+	message.CorrelationID = correlationID
+	if err := q.Publish(message); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-respChan:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no response for request %s: %w", correlationID, ctx.Err())
+	}
+}
+
+// setupReplyQueue subscribes an exclusive queue and routes the responses to the pending requests
+func (q *tcpQueue) setupReplyQueue() error {
+	q.replyQueue = "reply-" + uuid.New().String()
+	sub := &tcpSub{queue: q.replyQueue, exclusive: true, deliveries: make(chan tcpDelivery), done: make(chan struct{})}
+	if err := q.subscribe(sub); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case <-q.done:
+				return
+			case d := <-sub.deliveries:
+				q.dispatchReply(d.frame)
+				_ = d.Ack()
+			}
+		}
+	}()
+	return nil
+}
+
+func (q *tcpQueue) dispatchReply(frame *broker.Frame) {
+	resp := new(types.Response)
+	if err := json.Unmarshal(frame.Body, resp); err != nil {
+		q.logger.Error("failed to unmarshal response body", zap.Error(err), zap.String("correlationID", frame.CorrelationID))
+		return
+	}
+	q.pendingMu.Lock()
+	respChan, ok := q.pending[frame.CorrelationID]
+	q.pendingMu.Unlock()
+	if !ok {
+		// request timed out already
+		q.logger.Warn("received response for unknown request", zap.String("correlationID", frame.CorrelationID))
+		return
+	}
+	select {
+	case respChan <- resp:
+	default: // duplicate response, request already answered
+	}
+}
+
+func (q *tcpQueue) Reply(message *types.Message, response *types.Response) error {
+	if message.ReplyTo == "" {
+		return nil
+	}
+	response.Timestamp = time.Now()
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return q.publish(&broker.Frame{
+		Op:            broker.OpPublish,
+		Queue:         message.ReplyTo,
+		CorrelationID: message.CorrelationID,
+		AppID:         q.appID,
+		ContentType:   ContentTypeJSON,
+		Body:          body,
+	})
+}
+
+// Consume keeps feeding the returned channel across reconnections, channel is closed when the context is done
+// or the queue is closed
+func (q *tcpQueue) Consume(ctx context.Context) (<-chan *types.Message, error) {
+	sub := &tcpSub{queue: q.queueName, prefetch: q.opts.prefetch, deliveries: make(chan tcpDelivery), done: make(chan struct{})}
+	if err := q.subscribe(sub); err != nil {
+		return nil, err
+	}
+	msgChan := make(chan *types.Message)
+	go func() {
+		defer close(msgChan)
+		defer q.unsubscribe(sub)
+		for {
+			var d tcpDelivery
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.done:
+				return
+			case d = <-sub.deliveries:
+			}
+			m, err := decode(d.frame.ContentType, d.frame.Body)
+			if err != nil {
+				// message would fail again, so it is not requeued
+				q.deadLetter(d, reasonOf(err), err)
+				continue
+			}
+			m.ReplyTo = d.frame.ReplyTo
+			m.CorrelationID = d.frame.CorrelationID
+			// a message requeued on its own counts the retries of the delivery it was taken from in the headers
+			retries, headers := retriesOf(copyHeaders(d.frame.Headers))
+			m.Redelivered = d.frame.Redelivered || retries > 0
+			m.Retries = d.frame.Retries + retries
+			m.AppID = d.frame.AppID
+			m.Headers = headers
+			m.Acknowledger = d
+			span := dequeue("tcp", q.queueName, m)
+			select {
+			// unacknowledged message is redelivered by the broker once the connection is closed
+			case <-ctx.Done():
+				span.End()
+				return
+			case msgChan <- m:
+			}
+			span.End()
+		}
+	}()
+	return msgChan, nil
+}
+
+// deadLetter publishes the delivery as it is to the dead letter queue with the failure in the headers, then acks it.
+// the message is published with the publish policy, if that fails the delivery is rejected and the message is lost
+func (q *tcpQueue) deadLetter(d tcpDelivery, reason string, err error) {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	frame := *d.frame
+	frame.Op = broker.OpPublish
+	frame.Queue = dlq
+	frame.Tag = 0
+	frame.Redelivered, frame.Retries = false, 0
+	frame.Headers = deadLetterHeaders(d.frame.Headers, q.queueName, reason, err)
+	if err := q.publish(&frame); err != nil {
+		q.logger.Error("failed to dead letter message", zap.Error(err))
+		droppedTotal.WithLabelValues("tcp", dropDeadLetterFailed).Inc()
+		if err := d.Nack(false); err != nil {
+			q.logger.Error("failed to nack message", zap.Error(err))
+		}
+		return
+	}
+	deadLetteredTotal.WithLabelValues("tcp", reason).Inc()
+	if err := d.Ack(); err != nil {
+		q.logger.Error("failed to ack message", zap.Error(err))
+	}
+}
+
+// RequeueMessage publishes the message on its own to the tail of the queue, e.g. a failed message of a batch
+func (q *tcpQueue) RequeueMessage(message *types.Message) error {
+	return requeueMessage(q, q.opts, q.queueName, message)
+}
+
+// DeadLetterMessage publishes the message on its own to the dead letter queue, e.g. a failed message of a batch
+func (q *tcpQueue) DeadLetterMessage(message *types.Message, reason string, err error) error {
+	dlq := q.opts.deadLetterQueueOf(q.queueName)
+	q.logger.Warn("message is dead lettered", zap.String("reason", reason), zap.String("queue", dlq), zap.Error(err))
+	if err := deadLetterMessage(q, q.opts, q.queueName, message, reason, err); err != nil {
+		return err
+	}
+	deadLetteredTotal.WithLabelValues("tcp", reason).Inc()
+	return nil
+}
+
+// ConsumeRaw subscribes the queue name with the prefetch of the queue until the context is done
+func (q *tcpQueue) ConsumeRaw(ctx context.Context, queueName string) (<-chan *Envelope, error) {
+	sub := &tcpSub{queue: queueName, prefetch: q.opts.prefetch, deliveries: make(chan tcpDelivery), done: make(chan struct{})}
+	if err := q.subscribe(sub); err != nil {
+		return nil, err
+	}
+	envelopes := make(chan *Envelope)
+	go func() {
+		defer close(envelopes)
+		defer q.unsubscribe(sub)
+		for {
+			var d tcpDelivery
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.done:
+				return
+			case d = <-sub.deliveries:
+			}
+			envelope := &Envelope{
+				Body:          d.frame.Body,
+				ContentType:   d.frame.ContentType,
+				ReplyTo:       d.frame.ReplyTo,
+				CorrelationID: d.frame.CorrelationID,
+				AppID:         d.frame.AppID,
+				Headers:       d.frame.Headers,
+				Acknowledger:  d,
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case envelopes <- envelope:
+			}
+		}
+	}()
+	return envelopes, nil
+}
+
+func (q *tcpQueue) PublishRaw(queueName string, envelope *Envelope) error {
+	return q.publish(&broker.Frame{
+		Op:            broker.OpPublish,
+		Queue:         queueName,
+		ReplyTo:       envelope.ReplyTo,
+		CorrelationID: envelope.CorrelationID,
+		AppID:         envelope.AppID,
+		ContentType:   envelope.ContentType,
+		Headers:       envelope.Headers,
+		Body:          envelope.Body,
+	})
+}
+
+func (q *tcpQueue) Close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.done)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if len(q.buffer) > 0 {
+			q.logger.Warn("queue closed with buffered messages, messages are dropped", zap.Int("count", len(q.buffer)))
+			droppedTotal.WithLabelValues("tcp", dropClosed).Add(float64(len(q.buffer)))
+		}
+		if q.conn != nil {
+			err = q.conn.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/bhakiyakalimuthu/server-clique/queue"
+
+// Inject writes the trace context of ctx into the message headers, the queue carries them as transport headers.
+// the format is decided by the global propagator, w3c trace context once the tracing is set up
+func Inject(ctx context.Context, message *types.Message) {
+	if message.Headers == nil {
+		message.Headers = make(map[string]string)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(message.Headers))
+}
+
+// Extract returns ctx with the trace context of the message headers
+func Extract(ctx context.Context, message *types.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(message.Headers))
+}
+
+// PublishContext publishes the message in a producer span, the span is injected into the message
+// so the consumer continues the trace
+func PublishContext(ctx context.Context, q Queue, message *types.Message) error {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "publish "+message.Action.String(), trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messageAttributes(message)...))
+	defer span.End()
+	Inject(ctx, message)
+	err := q.Publish(message)
+	recordError(span, err)
+	return err
+}
+
+// RequestContext is PublishContext for the requests, the span lasts until the response is received
+func RequestContext(ctx context.Context, q Queue, message *types.Message) (*types.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "request "+message.Action.String(), trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messageAttributes(message)...))
+	defer span.End()
+	Inject(ctx, message)
+	resp, err := q.Request(ctx, message)
+	recordError(span, err)
+	return resp, err
+}
+
+// dequeue starts the consumer span of the delivered message as a child of the producer span, the span
+// is injected into the message in place of the producer span so the server continues the trace from it.
+// the span ends once the message is handed over to the consumer
+func dequeue(driver, queueName string, message *types.Message) trace.Span {
+	attrs := append(messageAttributes(message),
+		attribute.String("messaging.system", driver),
+		attribute.String("messaging.source.name", queueName),
+		attribute.Bool("messaging.redelivered", message.Redelivered),
+	)
+	ctx, span := otel.Tracer(tracerName).Start(Extract(context.Background(), message), "dequeue "+message.Action.String(),
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
+	Inject(ctx, message)
+	return span
+}
+
+func messageAttributes(message *types.Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("clique.action", message.Action.String()),
+		attribute.String("clique.key", message.Key),
+	}
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	maxBodySize      = 1 << 20
+	// apiOrigin is the origin of the mutations made through the http api
+	apiOrigin = "http"
+)
+
+// API is the rest api of the store, requests are applied through the server workers
+// so they are ordered and logged the same as the queue messages
+type API struct {
+	logger      *zap.Logger
+	server      *Server
+	listenAddrs string
+	httpServer  *http.Server
+}
+
+// itemRequest is the body of PUT /items/{key}, ttl is in milliseconds
+type itemRequest struct {
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// itemsPage is the body of GET /items, items are ordered the same as getall
+type itemsPage struct {
+	Items  []types.Item `json:"items"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Total  int          `json:"total"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// healthReport is the body of the probes, checks are "ok" or the failure
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func NewAPI(logger *zap.Logger, server *Server, listenAddrs string) *API {
+	a := &API{
+		logger:      logger,
+		server:      server,
+		listenAddrs: listenAddrs,
+	}
+	// created upfront, so stop does not race with start
+	a.httpServer = &http.Server{
+		Addr:              listenAddrs,
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return a
+}
+
+// Handler routes the item, metrics and probe endpoints
+//
+//	PUT    /items/{key}  body {"value": "v", "ttl": 1000}, If-Match: {version} for cas, If-None-Match: * for add if absent
+//	GET    /items/{key}
+//	DELETE /items/{key}  ?value=v removes only if the key has the value
+//	GET    /items?offset=0&limit=100
+//	GET    /metrics      prometheus metrics of the default registry
+//	GET    /healthz      liveness, 503 if a worker is not running or stuck
+//	GET    /readyz       readiness, 503 while reconnecting to the broker or draining
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items", a.handleItems)
+	mux.HandleFunc("/items/", a.handleItem)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", a.probe(a.server.Live))
+	mux.HandleFunc("/readyz", a.probe(a.server.Ready))
+	return mux
+}
+
+func (a *API) Start() {
+	a.logger.Info("Starting api server...", zap.String("listeningAddress", a.listenAddrs))
+	err := a.httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	a.logger.Error("Failed to start api server", zap.Error(err))
+}
+
+func (a *API) Stop() {
+	_ = a.httpServer.Shutdown(context.Background())
+}
+
+func (a *API) handleItem(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/items/")
+	if key == "" {
+		a.writeError(w, http.StatusBadRequest, "key is empty")
+		return
+	}
+	msg := &types.Message{Key: key, Timestamp: time.Now(), AppID: apiOrigin}
+	switch r.Method {
+	case http.MethodPut:
+		var req itemRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+			a.writeError(w, http.StatusBadRequest, "malformed body: "+err.Error())
+			return
+		}
+		if req.TTL < 0 {
+			a.writeError(w, http.StatusBadRequest, "ttl is negative")
+			return
+		}
+		msg.Action, msg.Value, msg.TTL = types.AddItem, req.Value, req.TTL
+		if r.Header.Get("If-None-Match") == "*" {
+			msg.Action = types.AddIfAbsent
+		} else if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			version, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+			if err != nil {
+				a.writeError(w, http.StatusBadRequest, "If-Match must be a version")
+				return
+			}
+			msg.Action, msg.Version = types.CompareAndSwap, version
+		}
+	case http.MethodGet:
+		msg.Action = types.GetItem
+	case http.MethodDelete:
+		msg.Action = types.RemoveItem
+		if query := r.URL.Query(); query.Has("value") {
+			msg.Action, msg.Value = types.RemoveIfValue, query.Get("value")
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		a.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	resp, ok := a.do(w, r, msg)
+	if !ok {
+		return
+	}
+	a.writeJSON(w, httpStatus(resp.Status), resp)
+}
+
+func (a *API) handleItems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		a.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		a.writeError(w, http.StatusBadRequest, "offset must be a non negative number")
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageLimit)
+	if err != nil || limit <= 0 || limit > maxPageLimit {
+		a.writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageLimit))
+		return
+	}
+	resp, ok := a.do(w, r, &types.Message{Action: types.GetAll, Timestamp: time.Now()})
+	if !ok {
+		return
+	}
+	page := itemsPage{Items: []types.Item{}, Offset: offset, Limit: limit, Total: len(resp.Items)}
+	if offset < len(resp.Items) {
+		end := offset + limit
+		if end > len(resp.Items) {
+			end = len(resp.Items)
+		}
+		page.Items = resp.Items[offset:end]
+	}
+	a.writeJSON(w, http.StatusOK, page)
+}
+
+// probe answers with 200 if every check passes and 503 otherwise, the probes never go through the workers
+func (a *API) probe(checks func() map[string]error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			a.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		report := healthReport{Status: "ok", Checks: make(map[string]string)}
+		code := http.StatusOK
+		for name, err := range checks() {
+			if err != nil {
+				report.Status, report.Checks[name] = "unavailable", err.Error()
+				code = http.StatusServiceUnavailable
+				continue
+			}
+			report.Checks[name] = "ok"
+		}
+		a.writeJSON(w, code, report)
+	}
+}
+
+// do applies the message, it writes the error response and returns false if the message is not applied
+func (a *API) do(w http.ResponseWriter, r *http.Request, msg *types.Message) (*types.Response, bool) {
+	resp, err := a.server.Do(r.Context(), msg)
+	if err != nil {
+		if r.Context().Err() != nil {
+			// client is gone, nobody reads the response
+			return nil, false
+		}
+		a.logger.Error("failed to process api request", zap.String("action", msg.Action.String()), zap.String("key", msg.Key), zap.Error(err))
+		code := http.StatusInternalServerError
+		if errors.Is(err, ErrServerStopped) {
+			code = http.StatusServiceUnavailable
+		}
+		a.writeError(w, code, err.Error())
+		return nil, false
+	}
+	return resp, true
+}
+
+func (a *API) writeError(w http.ResponseWriter, code int, msg string) {
+	a.writeJSON(w, code, apiError{Error: msg})
+}
+
+func (a *API) writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		a.logger.Debug("failed to write api response", zap.Error(err))
+	}
+}
+
+func httpStatus(status types.Status) int {
+	switch status {
+	case types.StatusOK:
+		return http.StatusOK
+	case types.StatusKeyNotFound:
+		return http.StatusNotFound
+	case types.StatusConflict:
+		return http.StatusConflict
+	case types.StatusTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case types.StatusNotSupported:
+		return http.StatusNotImplemented
+	case types.StatusUnknownAction:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+// syncBuffer is the output log, workers write it concurrently with the test reading it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAPI(t *testing.T) {
+	l := zap.NewNop()
+	out := new(syncBuffer)
+	server := New(l, jsonResults(out), nil, NewMemStore(l), benchWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(context.Background(), wg, i)
+	}
+	ts := httptest.NewServer(NewAPI(l, server, "").Handler())
+	defer func() {
+		ts.Close()
+		server.closePartitions()
+		wg.Wait()
+	}()
+
+	// header is the request header as name value pairs
+	call := func(method, path, body string, header ...string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		assert.Equal(t, nil, err)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		return res.StatusCode, data
+	}
+	decode := func(data []byte, v interface{}) {
+		t.Helper()
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		code, _ := call(http.MethodPut, "/items/"+key, `{"value":"`+key+key+`"}`)
+		assert.Equal(t, http.StatusOK, code)
+	}
+	code, data := call(http.MethodGet, "/items/b", "")
+	assert.Equal(t, http.StatusOK, code)
+	var resp types.Response
+	decode(data, &resp)
+	assert.Equal(t, "bb", resp.Value)
+
+	code, _ = call(http.MethodDelete, "/items/b", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(http.MethodDelete, "/items/b", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, data = call(http.MethodGet, "/items/b", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	resp = types.Response{}
+	decode(data, &resp)
+	assert.Equal(t, types.StatusKeyNotFound, resp.Status)
+
+	code, data = call(http.MethodGet, "/items?offset=1&limit=5", "")
+	assert.Equal(t, http.StatusOK, code)
+	var page itemsPage
+	decode(data, &page)
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, "c", page.Items[0].Key)
+	code, data = call(http.MethodGet, "/items?offset=10", "")
+	assert.Equal(t, http.StatusOK, code)
+	page = itemsPage{}
+	decode(data, &page)
+	assert.Equal(t, 0, len(page.Items))
+	assert.Equal(t, defaultPageLimit, page.Limit)
+
+	// conditional writes answer the conflict with the current version
+	code, data = call(http.MethodPut, "/items/a", `{"value":"a1"}`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusConflict, code)
+	resp = types.Response{}
+	decode(data, &resp)
+	assert.Equal(t, types.StatusConflict, resp.Status)
+	assert.Equal(t, uint64(1), resp.Version)
+	code, data = call(http.MethodPut, "/items/a", `{"value":"a1"}`, "If-Match", `"1"`)
+	assert.Equal(t, http.StatusOK, code)
+	resp = types.Response{}
+	decode(data, &resp)
+	// versions are drawn store wide, a, b and c took the first three
+	assert.Equal(t, uint64(4), resp.Version)
+	code, _ = call(http.MethodPut, "/items/a", `{"value":"a2"}`, "If-Match", "1")
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = call(http.MethodPut, "/items/a", `{"value":"a2"}`, "If-Match", "latest")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(http.MethodDelete, "/items/c?value=aa", "")
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = call(http.MethodPut, "/items/b", `{"value":"bb"}`, "If-None-Match", "*")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(http.MethodDelete, "/items/b?value=bb", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// rejected before reaching the workers
+	code, _ = call(http.MethodPut, "/items/a", `{"value":`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(http.MethodPut, "/items/", `{"value":"v"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(http.MethodGet, "/items?limit=0", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call(http.MethodPost, "/items/a", `{"value":"v"}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// api requests are written to the output the same as the queue messages
+	results := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var result Result
+		decode([]byte(line), &result)
+		results[fmt.Sprintf("%s %s %s %s", result.Action, result.Key, result.Value, result.Status)]++
+	}
+	assert.Equal(t, 1, results["add a aa ok"])
+	assert.Equal(t, 1, results["get b bb ok"])
+	assert.Equal(t, 1, results["remove b  ok"])
+	assert.Equal(t, 1, results["remove b  key_not_found"])
+	assert.Equal(t, 2, results["getall   ok"])
+	assert.Equal(t, 1, results["cas a a1 ok"])
+	assert.Equal(t, 1, results["add_if_absent a a1 conflict"])
+	assert.Equal(t, 1, results["remove_if_value c aa conflict"])
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.uber.org/zap"
+)
+
+// dispatchBatch unpacks the batch and dispatches its messages in order, so the messages of a key are applied
+// in publish order same as the messages published one by one. the batch delivery is settled once all of its
+// messages are processed
+func (s *Server) dispatchBatch(ctx context.Context, batch *types.Message) error {
+	messages, err := queue.Unbatch(batch)
+	if err != nil {
+		// malformed batch would fail again, so it is not requeued
+		s.logger.Error("failed to unpack batch", zap.String("appID", batch.AppID), zap.Error(err))
+		if err := batch.DeadLetter(queue.ReasonMalformed, err); err != nil {
+			s.logger.Error("failed to dead letter batch", zap.Error(err))
+		}
+		return nil
+	}
+	if len(messages) == 0 {
+		return batch.Ack()
+	}
+	// a failed message is requeued or dead lettered on its own if the queue can publish it again
+	republisher, _ := s.queue.(queue.Republisher)
+	delivery := &batchDelivery{batch: batch, republisher: republisher, pending: int32(len(messages))}
+	for _, msg := range messages {
+		msg.Acknowledger = &batchItem{delivery: delivery, message: msg}
+	}
+	for _, msg := range messages {
+		// undispatched messages keep the batch unsettled, it is redelivered by the broker once the consumer is gone
+		if err := s.Dispatch(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchDelivery settles the delivery of a batch once all of its messages are settled. a failed message is
+// requeued or dead lettered on its own by the republisher, so the messages already applied are not applied again
+// and the batch is acked. a message nacked without requeue is dropped like a rejected delivery.
+// the failed messages the republisher could not publish, or all of them if the queue has no republisher,
+// settle the batch as a whole: the batch is requeued if any of them asked for it, otherwise it is dead lettered
+// if any of them is dead lettered, or rejected
+type batchDelivery struct {
+	batch       *types.Message
+	republisher queue.Republisher
+	pending     int32 // messages not settled yet
+
+	mu      sync.Mutex
+	failed  bool
+	requeue bool
+	reason  string // dead letter reason of the first dead lettered message
+	cause   error
+}
+
+// settle returns the error of settling the batch once the last message is settled
+func (d *batchDelivery) settle(failed, requeue bool, reason string, cause error) error {
+	if failed {
+		d.mu.Lock()
+		d.failed = true
+		d.requeue = d.requeue || requeue
+		if d.reason == "" {
+			d.reason, d.cause = reason, cause
+		}
+		d.mu.Unlock()
+	}
+	if atomic.AddInt32(&d.pending, -1) > 0 {
+		return nil
+	}
+	d.mu.Lock()
+	failed, requeue, reason, cause = d.failed, d.requeue, d.reason, d.cause
+	d.mu.Unlock()
+	switch {
+	case requeue:
+		return d.batch.Nack(true)
+	case reason != "":
+		return d.batch.DeadLetter(reason, cause)
+	case failed:
+		return d.batch.Nack(false)
+	}
+	return d.batch.Ack()
+}
+
+// batchItem is the acknowledger of a message of a batch
+type batchItem struct {
+	delivery *batchDelivery
+	message  *types.Message
+	settled  sync.Once
+}
+
+func (i *batchItem) Ack() (err error) {
+	i.settled.Do(func() { err = i.delivery.settle(false, false, "", nil) })
+	return err
+}
+
+func (i *batchItem) Nack(requeue bool) (err error) {
+	i.settled.Do(func() {
+		if !requeue && i.delivery.republisher != nil {
+			err = i.delivery.settle(false, false, "", nil)
+			return
+		}
+		err = i.republish(func(r queue.Republisher) error { return r.RequeueMessage(i.message) }, requeue, "", nil)
+	})
+	return err
+}
+
+func (i *batchItem) DeadLetter(reason string, cause error) (err error) {
+	i.settled.Do(func() {
+		err = i.republish(func(r queue.Republisher) error { return r.DeadLetterMessage(i.message, reason, cause) }, false, reason, cause)
+	})
+	return err
+}
+
+// republish publishes the message on its own with publish, the message settles the batch as a whole
+// if the queue has no republisher or publish fails
+func (i *batchItem) republish(publish func(queue.Republisher) error, requeue bool, reason string, cause error) error {
+	if i.delivery.republisher == nil {
+		return i.delivery.settle(true, requeue, reason, cause)
+	}
+	if err := publish(i.delivery.republisher); err != nil {
+		if settleErr := i.delivery.settle(true, requeue, reason, cause); settleErr != nil {
+			return settleErr
+		}
+		return fmt.Errorf("failed to publish message of batch on its own, the batch is settled as a whole: %w", err)
+	}
+	return i.delivery.settle(false, false, "", nil)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestServer_Batch(t *testing.T) {
+	l := zap.NewNop()
+	store := NewMemStore(l)
+	q := queue.NewMemory(l, t.Name())
+	client := queue.NewBatcher(l, queue.NewMemory(l, t.Name()), queue.BatchOptions{MaxMessages: 10, Compress: true})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	server := New(l, jsonResults(io.Discard), q, store, benchWorkers)
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start(ctx)
+	}()
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(ctx, wg, i)
+	}
+
+	// the writes of a key are applied in publish order across the batches
+	for i := 1; i <= 25; i++ {
+		assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: "hot", Value: strconv.Itoa(i)}))
+		assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: fmt.Sprintf("key-%d", i), Value: "v"}))
+	}
+	assert.Equal(t, nil, client.Publish(&types.Message{Action: types.RemoveItem, Key: "key-1"}))
+	assert.Equal(t, nil, client.Publish(&types.Message{Action: "bogus", Key: "bogus"}))
+	reqCtx, reqCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer reqCancel()
+	resp, err := client.Request(reqCtx, &types.Message{Action: types.GetItem, Key: "hot"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "25", resp.Value)
+	resp, err = client.Request(reqCtx, &types.Message{Action: types.GetItem, Key: "key-1"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, types.StatusKeyNotFound, resp.Status)
+
+	// the unknown action is dead lettered on its own, the rest of its batch is not dead lettered with it
+	var dead []string
+	read, err := queue.ReadDeadLetters(reqCtx, q, queue.DeadLetterQueue(t.Name()), 100*time.Millisecond, 0, func(envelope *queue.Envelope) error {
+		var msg types.Message
+		assert.Equal(t, nil, json.Unmarshal(envelope.Body, &msg))
+		assert.Equal(t, queue.ReasonUnknownAction, envelope.Headers[queue.HeaderDeadLetterReason])
+		dead = append(dead, msg.Key)
+		return envelope.Ack()
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, read)
+	assert.Equal(t, []string{"bogus"}, dead)
+
+	cancel()
+	assert.Equal(t, nil, <-started)
+	wg.Wait()
+	assert.Equal(t, nil, q.Close())
+}
+
+func TestServer_BatchDelivery(t *testing.T) {
+	l := zap.NewNop()
+	server := New(l, jsonResults(io.Discard), nil, NewMemStore(l), benchWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(context.Background(), wg, i)
+	}
+	defer func() {
+		server.closePartitions()
+		wg.Wait()
+	}()
+	ctx := context.Background()
+
+	// batch is acked once all of its messages are applied
+	local := &localRequest{done: make(chan struct{})}
+	batch, err := queue.NewBatch([]*types.Message{
+		{Action: types.AddItem, Key: "a", Value: "1"},
+		{Action: types.AddItem, Key: "b", Value: "2"},
+		{Action: types.GetAll},
+	}, false)
+	assert.Equal(t, nil, err)
+	batch.Acknowledger = local
+	assert.Equal(t, nil, server.dispatchBatch(ctx, batch))
+	select {
+	case <-local.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("batch not settled")
+	}
+	assert.Equal(t, nil, local.err)
+
+	// malformed batch is dead lettered, rejected without requeue if the queue has no dead letter queue
+	ack := new(acknowledger)
+	assert.Equal(t, nil, server.dispatchBatch(ctx, &types.Message{Action: types.Batch, Compressed: []byte("garbage"), Acknowledger: ack}))
+	assert.Equal(t, &acknowledger{nacked: true}, ack)
+	dead := new(deadLetterer)
+	assert.Equal(t, nil, server.dispatchBatch(ctx, &types.Message{Action: types.Batch, Compressed: []byte("garbage"), Acknowledger: dead}))
+	assert.Equal(t, &deadLetterer{reason: queue.ReasonMalformed}, dead)
+
+	// empty batch is acked straight away
+	ack = new(acknowledger)
+	assert.Equal(t, nil, server.dispatchBatch(ctx, &types.Message{Action: types.Batch, Acknowledger: ack}))
+	assert.Equal(t, &acknowledger{acked: true}, ack)
+
+	// failed messages are requeued and dead lettered on their own, the batch is acked once the rest is settled
+	ack = new(acknowledger)
+	republished := new(republisher)
+	delivery := &batchDelivery{batch: &types.Message{Acknowledger: ack}, republisher: republished, pending: 4}
+	items := []*batchItem{
+		{delivery: delivery, message: &types.Message{Key: "a"}},
+		{delivery: delivery, message: &types.Message{Key: "b"}},
+		{delivery: delivery, message: &types.Message{Key: "c"}},
+		{delivery: delivery, message: &types.Message{Key: "d"}},
+	}
+	assert.Equal(t, nil, items[0].Nack(true))
+	assert.Equal(t, nil, items[1].DeadLetter(queue.ReasonUnknownAction, errors.New("unknown action")))
+	assert.Equal(t, nil, items[2].Ack())
+	assert.Equal(t, nil, items[2].Ack()) // settled once only
+	assert.Equal(t, &acknowledger{}, ack)
+	assert.Equal(t, nil, items[3].Nack(false)) // dropped
+	assert.Equal(t, &acknowledger{acked: true}, ack)
+	assert.Equal(t, []string{"a"}, republished.requeued)
+	assert.Equal(t, []string{"b"}, republished.deadLettered)
+
+	// a message failing to be published on its own requeues the batch as a whole
+	ack = new(acknowledger)
+	delivery = &batchDelivery{batch: &types.Message{Acknowledger: ack}, republisher: &republisher{err: errors.New("boom")}, pending: 2}
+	items = []*batchItem{{delivery: delivery, message: &types.Message{Key: "a"}}, {delivery: delivery, message: &types.Message{Key: "b"}}}
+	assert.NotEqual(t, nil, items[0].Nack(true))
+	assert.Equal(t, nil, items[1].Ack())
+	assert.Equal(t, &acknowledger{nacked: true, requeued: true}, ack)
+
+	// without a republisher a failed message nacks the batch once the rest is settled
+	ack = new(acknowledger)
+	delivery = &batchDelivery{batch: &types.Message{Acknowledger: ack}, pending: 3}
+	items = []*batchItem{{delivery: delivery}, {delivery: delivery}, {delivery: delivery}}
+	assert.Equal(t, nil, items[0].Nack(true))
+	assert.Equal(t, nil, items[1].Ack())
+	assert.Equal(t, &acknowledger{}, ack)
+	assert.Equal(t, nil, items[2].Ack())
+	assert.Equal(t, &acknowledger{nacked: true, requeued: true}, ack)
+
+	// and a dead lettered message dead letters the batch unless another one asked for requeue
+	dead = new(deadLetterer)
+	delivery = &batchDelivery{batch: &types.Message{Acknowledger: dead}, pending: 2}
+	items = []*batchItem{{delivery: delivery}, {delivery: delivery}}
+	assert.Equal(t, nil, items[0].DeadLetter(queue.ReasonUnknownAction, errors.New("unknown action")))
+	assert.Equal(t, nil, items[1].Ack())
+	assert.Equal(t, &deadLetterer{reason: queue.ReasonUnknownAction}, dead)
+}
+
+// republisher records the keys of the messages published on their own, it fails with err if it is set
+type republisher struct {
+	mu                     sync.Mutex
+	requeued, deadLettered []string
+	err                    error
+}
+
+func (r *republisher) RequeueMessage(message *types.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.requeued = append(r.requeued, message.Key)
+	return nil
+}
+
+func (r *republisher) DeadLetterMessage(message *types.Message, _ string, _ error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.deadLettered = append(r.deadLettered, message.Key)
+	return nil
+}
+
+// BenchmarkServer_Publish publishes adds end to end through the in-process queue, one message per delivery
+// against the batches built by the batcher
+func BenchmarkServer_Publish(b *testing.B) {
+	benchmarks := []struct {
+		name  string
+		batch *queue.BatchOptions
+	}{
+		{name: "single"},
+		{name: "batch_100", batch: &queue.BatchOptions{MaxMessages: 100, Linger: time.Millisecond}},
+		{name: "batch_1000", batch: &queue.BatchOptions{MaxMessages: 1000, Linger: time.Millisecond}},
+		{name: "batch_100_gzip", batch: &queue.BatchOptions{MaxMessages: 100, Linger: time.Millisecond, Compress: true}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			l := zap.NewNop()
+			name := b.Name()
+			var client queue.Queue = queue.NewMemory(l, name, queue.WithPublishPolicy(queue.PublishBuffer, b.N+1))
+			if bm.batch != nil {
+				client = queue.NewBatcher(l, client, *bm.batch)
+			}
+			q := queue.NewMemory(l, name)
+			server := New(l, jsonResults(io.Discard), q, NewMemStoreOptimised(l), benchWorkers)
+			var applied int64
+			done := make(chan struct{})
+			server.OnChange(func(types.Event) {
+				if atomic.AddInt64(&applied, 1) == int64(b.N) {
+					close(done)
+				}
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			started := make(chan error, 1)
+			go func() {
+				started <- server.Start(ctx)
+			}()
+			wg := new(sync.WaitGroup)
+			wg.Add(benchWorkers)
+			for i := 1; i <= benchWorkers; i++ {
+				go server.Process(ctx, wg, i)
+			}
+			messages := make([]*types.Message, b.N)
+			for i := range messages {
+				messages[i] = &types.Message{Action: types.AddItem, Key: "key-" + strconv.Itoa(i), Value: "value"}
+			}
+
+			b.ResetTimer()
+			for _, msg := range messages {
+				if err := client.Publish(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// the pending batch is published on close
+			_ = client.Close()
+			<-done
+			b.StopTimer()
+
+			cancel()
+			<-started
+			wg.Wait()
+			_ = q.Close()
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrItemTooLarge = errors.New("item is larger than the store capacity")
+
+// EvictionPolicy decides which key is evicted when the store is full
+type EvictionPolicy string
+
+const (
+	EvictLRU  EvictionPolicy = "lru"  // least recently used
+	EvictLFU  EvictionPolicy = "lfu"  // least frequently used
+	EvictFIFO EvictionPolicy = "fifo" // oldest by insertion timestamp
+)
+
+// EvictionNotifier is implemented by the stores removing items on their own to stay within the capacity
+type EvictionNotifier interface {
+	OnEvict(fn func(item))
+}
+
+// BoundedStats are the eviction counters of a bounded store
+type BoundedStats struct {
+	Items        int
+	Bytes        int64
+	Evictions    uint64
+	EvictedBytes uint64
+}
+
+// BoundedStore is a Store decorator which keeps the item count and size within the limits by evicting keys,
+// zero limit means unlimited
+type BoundedStore struct {
+	logger   *zap.Logger
+	store    Store
+	maxItems int
+	maxBytes int64
+
+	mu      sync.Mutex
+	policy  evictionPolicy
+	sizes   map[string]int64
+	bytes   int64
+	onEvict func(item)
+
+	evictions    uint64
+	evictedBytes uint64
+}
+
+var (
+	_ Store            = (*BoundedStore)(nil)
+	_ Expirer          = (*BoundedStore)(nil)
+	_ Snapshotter      = (*BoundedStore)(nil)
+	_ EvictionNotifier = (*BoundedStore)(nil)
+	_ Peeker           = (*BoundedStore)(nil)
+	_ Sizer            = (*BoundedStore)(nil)
+	_ HealthChecker    = (*BoundedStore)(nil)
+	_ Transactor       = (*BoundedStore)(nil)
+)
+
+// NewBoundedStore accounts the items already in the store (e.g. replayed from the log) and evicts the excess
+func NewBoundedStore(logger *zap.Logger, store Store, maxItems int, maxBytes int64, policy EvictionPolicy) (*BoundedStore, error) {
+	b := &BoundedStore{
+		logger:   logger,
+		store:    store,
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		sizes:    make(map[string]int64),
+	}
+	switch policy {
+	case EvictLRU:
+		b.policy = newLRUPolicy()
+	case EvictLFU:
+		b.policy = newRankPolicy(true)
+	case EvictFIFO:
+		b.policy = newRankPolicy(false)
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", policy)
+	}
+	ctx := context.Background()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, _item := range store.GetAll(ctx) {
+		b.account(_item.key, _item.value, _item.timestamp)
+	}
+	evicted, err := b.evict(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(evicted) > 0 {
+		logger.Warn("store exceeds the capacity, items evicted", zap.Int("count", len(evicted)))
+	}
+	return b, nil
+}
+
+// OnEvict registers the callback called for every evicted item
+func (b *BoundedStore) OnEvict(fn func(item)) {
+	b.mu.Lock()
+	b.onEvict = fn
+	b.mu.Unlock()
+}
+
+// Stats are reported by the metrics collector of the server
+func (b *BoundedStore) Stats() BoundedStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BoundedStats{
+		Items:        len(b.sizes),
+		Bytes:        b.bytes,
+		Evictions:    b.evictions,
+		EvictedBytes: b.evictedBytes,
+	}
+}
+
+func (b *BoundedStore) Health() error {
+	return storeHealth(b.store)
+}
+
+// Size is the accounting the limits are enforced with
+func (b *BoundedStore) Size() (int, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.sizes), b.bytes
+}
+
+func (b *BoundedStore) Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error) {
+	size := int64(len(key) + len(value))
+	if b.maxBytes > 0 && size > b.maxBytes {
+		return 0, ErrItemTooLarge
+	}
+	b.mu.Lock()
+	version, err := b.store.Add(ctx, key, value, timestamp, expiresAt, cond)
+	if err != nil {
+		b.mu.Unlock()
+		return version, err
+	}
+	b.account(key, value, timestamp.UnixNano())
+	// the added key is never the victim of its own insertion
+	evicted, err := b.evict(ctx, key)
+	onEvict := b.onEvict
+	b.mu.Unlock()
+	if onEvict != nil {
+		for _, _item := range evicted {
+			onEvict(_item)
+		}
+	}
+	return version, err
+}
+
+func (b *BoundedStore) Remove(ctx context.Context, key string, cond condition) (uint64, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	version, ok, err := b.store.Remove(ctx, key, cond)
+	if err != nil {
+		return version, false, err
+	}
+	b.forget(key)
+	return version, ok, nil
+}
+
+func (b *BoundedStore) Txn(ctx context.Context, ops []txnOp) ([]uint64, error) {
+	transactor, ok := b.store.(Transactor)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	for _, op := range ops {
+		if size := int64(len(op.key) + len(op.value)); !op.remove && b.maxBytes > 0 && size > b.maxBytes {
+			return nil, ErrItemTooLarge
+		}
+	}
+	b.mu.Lock()
+	versions, err := transactor.Txn(ctx, ops)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	for _, op := range ops {
+		if op.remove {
+			b.forget(op.key)
+			continue
+		}
+		b.account(op.key, op.value, op.timestamp)
+	}
+	// the transaction is applied as a whole, its keys are evicted afterwards like any other key
+	evicted, err := b.evict(ctx, "")
+	onEvict := b.onEvict
+	b.mu.Unlock()
+	if onEvict != nil {
+		for _, _item := range evicted {
+			onEvict(_item)
+		}
+	}
+	return versions, err
+}
+
+func (b *BoundedStore) Get(ctx context.Context, key string) (string, bool) {
+	value, ok := b.store.Get(ctx, key)
+	if ok {
+		b.mu.Lock()
+		if _, tracked := b.sizes[key]; tracked {
+			b.policy.access(key)
+		}
+		b.mu.Unlock()
+	}
+	return value, ok
+}
+
+// Lookup does not count as an access of the key
+func (b *BoundedStore) Lookup(ctx context.Context, key string) (item, bool) {
+	return b.store.Lookup(ctx, key)
+}
+
+// Peek does not count as an access of the key
+func (b *BoundedStore) Peek(ctx context.Context, key string) (string, bool) {
+	return peek(ctx, b.store, key)
+}
+
+func (b *BoundedStore) GetAll(ctx context.Context) []item {
+	return b.store.GetAll(ctx)
+}
+
+func (b *BoundedStore) Expire(ctx context.Context, now time.Time) []item {
+	expirer, ok := b.store.(Expirer)
+	if !ok {
+		return nil
+	}
+	expired := expirer.Expire(ctx, now)
+	b.mu.Lock()
+	for _, _item := range expired {
+		b.forget(_item.key)
+	}
+	b.mu.Unlock()
+	return expired
+}
+
+func (b *BoundedStore) Snapshot(ctx context.Context) error {
+	snapshotter, ok := b.store.(Snapshotter)
+	if !ok {
+		return ErrNotSupported
+	}
+	return snapshotter.Snapshot(ctx)
+}
+
+// account tracks the added or overwritten key, must be called with the lock held
+func (b *BoundedStore) account(key, value string, timestamp int64) {
+	size := int64(len(key) + len(value))
+	b.bytes += size - b.sizes[key]
+	b.sizes[key] = size
+	b.policy.add(key, timestamp)
+}
+
+// forget stops tracking the key, must be called with the lock held
+func (b *BoundedStore) forget(key string) {
+	size, ok := b.sizes[key]
+	if !ok {
+		return
+	}
+	b.bytes -= size
+	delete(b.sizes, key)
+	b.policy.remove(key)
+}
+
+// evict removes the victims until the store is within the limits, must be called with the lock held
+func (b *BoundedStore) evict(ctx context.Context, exclude string) ([]item, error) {
+	var evicted []item
+	for (b.maxItems > 0 && len(b.sizes) > b.maxItems) || (b.maxBytes > 0 && b.bytes > b.maxBytes) {
+		key, ok := b.policy.victim(exclude)
+		if !ok {
+			break
+		}
+		value, _ := b.store.Get(ctx, key)
+		_, removed, err := b.store.Remove(ctx, key, condition{})
+		if err != nil {
+			return evicted, fmt.Errorf("failed to evict %s: %v", key, err)
+		}
+		if !removed {
+			// expired in the store already, it is not counted nor published as an eviction
+			b.forget(key)
+			continue
+		}
+		b.evictions++
+		b.evictedBytes += uint64(b.sizes[key])
+		b.forget(key)
+		evicted = append(evicted, item{key: key, value: value})
+	}
+	return evicted, nil
+}
+
+type evictionPolicy interface {
+	add(key string, timestamp int64) // key is added or overwritten
+	access(key string)
+	remove(key string)
+	// victim returns the next key to evict other than the excluded one
+	victim(exclude string) (string, bool)
+}
+
+type lruPolicy struct {
+	order *list.List // most recently used first
+	elems map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) add(key string, _ int64) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) access(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) remove(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) victim(exclude string) (string, bool) {
+	for elem := p.order.Back(); elem != nil; elem = elem.Prev() {
+		if key := elem.Value.(string); key != exclude {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// rankPolicy evicts the key with the lowest rank, rank is the access count (lfu) or the insertion timestamp (fifo)
+type rankPolicy struct {
+	frequency bool
+	seq       int64 // tie breaker, older wins
+	entries   rankHeap
+	index     map[string]*rankEntry
+}
+
+type rankEntry struct {
+	key       string
+	rank, seq int64
+	pos       int
+}
+
+func newRankPolicy(frequency bool) *rankPolicy {
+	return &rankPolicy{frequency: frequency, index: make(map[string]*rankEntry)}
+}
+
+func (p *rankPolicy) add(key string, timestamp int64) {
+	p.seq++
+	entry, ok := p.index[key]
+	if !ok {
+		entry = &rankEntry{key: key}
+		p.index[key] = entry
+		heap.Push(&p.entries, entry)
+	}
+	if p.frequency {
+		entry.rank++
+	} else {
+		entry.rank = timestamp
+	}
+	entry.seq = p.seq
+	heap.Fix(&p.entries, entry.pos)
+}
+
+func (p *rankPolicy) access(key string) {
+	if !p.frequency {
+		return
+	}
+	p.seq++
+	if entry, ok := p.index[key]; ok {
+		entry.rank++
+		entry.seq = p.seq
+		heap.Fix(&p.entries, entry.pos)
+	}
+}
+
+func (p *rankPolicy) remove(key string) {
+	if entry, ok := p.index[key]; ok {
+		heap.Remove(&p.entries, entry.pos)
+		delete(p.index, key)
+	}
+}
+
+func (p *rankPolicy) victim(exclude string) (string, bool) {
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	if p.entries[0].key != exclude {
+		return p.entries[0].key, true
+	}
+	// excluded key is the root, the next lowest is one of its children
+	var next *rankEntry
+	for _, i := range []int{1, 2} {
+		if i < len(p.entries) && (next == nil || p.entries.Less(i, next.pos)) {
+			next = p.entries[i]
+		}
+	}
+	if next == nil {
+		return "", false
+	}
+	return next.key, true
+}
+
+type rankHeap []*rankEntry
+
+func (h rankHeap) Len() int { return len(h) }
+func (h rankHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h rankHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *rankHeap) Push(x interface{}) {
+	entry := x.(*rankEntry)
+	entry.pos = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *rankHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestBoundedStore_Evict(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	now := time.Now()
+	tests := []struct {
+		policy   EvictionPolicy
+		expected []string
+	}{
+		// A has the oldest timestamp and is read last, B is never read and C is read the most
+		{policy: EvictLRU, expected: []string{"A", "D", "E"}},
+		{policy: EvictLFU, expected: []string{"A", "C", "E"}},
+		{policy: EvictFIFO, expected: []string{"C", "D", "E"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			store, err := NewBoundedStore(l, NewMemStore(l), 3, 0, tt.policy)
+			assert.Equal(t, nil, err)
+			var evicted []string
+			store.OnEvict(func(_item item) {
+				evicted = append(evicted, _item.key)
+			})
+			_, err = store.Add(ctx, "A", "a", now, time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "B", "b", now.Add(1), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "C", "c", now.Add(2), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			for i := 0; i < 3; i++ {
+				store.Get(ctx, "C")
+			}
+			store.Get(ctx, "A")
+			store.Get(ctx, "A")
+			// the added key is never evicted by its own insertion, even with the lowest frequency
+			_, err = store.Add(ctx, "D", "d", now.Add(3), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "E", "e", now.Add(4), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+
+			stats := store.Stats()
+			assert.Equal(t, 3, stats.Items)
+			assert.Equal(t, uint64(2), stats.Evictions)
+			assert.Equal(t, tt.expected, keys(store.GetAll(ctx)))
+			assert.Equal(t, 2, len(evicted))
+		})
+	}
+}
+
+func TestBoundedStore_EvictExpired(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	now := time.Now()
+	store, err := NewBoundedStore(l, NewMemStore(l), 2, 0, EvictFIFO)
+	assert.Equal(t, nil, err)
+	var evicted []string
+	store.OnEvict(func(_item item) {
+		evicted = append(evicted, _item.key)
+	})
+
+	// expired key not swept yet is the victim, it is dropped without being counted as an eviction
+	_, err = store.Add(ctx, "A", "a", now, now.Add(-time.Millisecond), condition{})
+	assert.Equal(t, nil, err)
+	_, err = store.Add(ctx, "B", "b", now.Add(1), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, err = store.Add(ctx, "C", "c", now.Add(2), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"B", "C"}, keys(store.GetAll(ctx)))
+	assert.Equal(t, BoundedStats{Items: 2, Bytes: 4}, store.Stats())
+	assert.Equal(t, 0, len(evicted))
+
+	_, err = store.Add(ctx, "D", "d", now.Add(3), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, BoundedStats{Items: 2, Bytes: 4, Evictions: 1, EvictedBytes: 2}, store.Stats())
+	assert.Equal(t, []string{"B"}, evicted)
+}
+
+func TestBoundedStore_MaxBytes(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	inner := NewMemStore(l)
+	now := time.Now()
+	_, err := inner.Add(ctx, "A", "aaaa", now, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, err = inner.Add(ctx, "B", "bbbb", now.Add(1), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+
+	// existing items beyond the capacity are evicted straight away
+	store, err := NewBoundedStore(l, inner, 0, 6, EvictFIFO)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"B"}, keys(store.GetAll(ctx)))
+	assert.Equal(t, int64(5), store.Stats().Bytes)
+
+	_, err = store.Add(ctx, "C", "cccccc", now.Add(2), time.Time{}, condition{})
+	assert.Equal(t, ErrItemTooLarge, err)
+	_, err = store.Add(ctx, "B", "b", now.Add(3), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, err = store.Add(ctx, "C", "ccc", now.Add(4), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"B", "C"}, keys(store.GetAll(ctx)))
+	assert.Equal(t, BoundedStats{Items: 2, Bytes: 6, Evictions: 1, EvictedBytes: 5}, store.Stats())
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.uber.org/zap"
+)
+
+const (
+	outboxMinBackoff = 100 * time.Millisecond
+	outboxMaxBackoff = 5 * time.Second
+)
+
+// Outbox publishes the change events to the queue in the background, so the workers never wait for the queue.
+// it holds at most size events, events captured while it is full are dropped and counted
+type Outbox struct {
+	logger *zap.Logger
+	queue  queue.Queue
+	events chan types.Event
+
+	mu      sync.RWMutex // guards closed against the capture in flight
+	closed  bool
+	done    chan struct{} // closed by Close, a failing publish is no longer retried
+	stopped chan struct{} // closed once Run returns
+	dropped uint64
+}
+
+func NewOutbox(logger *zap.Logger, queue queue.Queue, size int) *Outbox {
+	return &Outbox{
+		logger:  logger,
+		queue:   queue,
+		events:  make(chan types.Event, size),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Capture enqueues the event without blocking, it is meant to be registered with Server.OnChange
+func (o *Outbox) Capture(event types.Event) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		return
+	}
+	select {
+	case o.events <- event:
+	default:
+		atomic.AddUint64(&o.dropped, 1)
+		droppedTotal.WithLabelValues(dropOutboxFull).Inc()
+	}
+}
+
+// Dropped is the number of events dropped because the outbox was full
+func (o *Outbox) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
+
+// Run publishes the events in order until the outbox is closed. a failed publish is retried with backoff,
+// so the events are not reordered, meanwhile the new events are held by the outbox
+func (o *Outbox) Run() {
+	defer close(o.stopped)
+	var reported uint64
+	for event := range o.events {
+		event := event
+		for attempt := 0; ; attempt++ {
+			err := o.queue.PublishEvent(&event)
+			if err == nil {
+				break
+			}
+			select {
+			case <-o.done:
+				o.logger.Error("failed to publish change event, event is dropped", zap.Uint64("seq", event.Seq), zap.String("key", event.Key), zap.Error(err))
+				droppedTotal.WithLabelValues(dropPublishFailed).Inc()
+			case <-time.After(backoff(attempt, outboxMinBackoff, outboxMaxBackoff)):
+				o.logger.Warn("failed to publish change event, retrying", zap.Uint64("seq", event.Seq), zap.Int("attempt", attempt+1), zap.Error(err))
+				continue
+			}
+			break
+		}
+		if dropped := o.Dropped(); dropped != reported {
+			o.logger.Warn("outbox was full, change events dropped", zap.Uint64("dropped", dropped-reported))
+			reported = dropped
+		}
+	}
+}
+
+// Close stops capturing and waits for the events in the outbox to be published, it must be called once
+// the workers are done. events failing to publish are not retried anymore
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+	o.closed = true
+	close(o.events)
+	o.mu.Unlock()
+	close(o.done)
+	<-o.stopped
+}
+
+// backoff doubles the delay with every attempt up to max
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
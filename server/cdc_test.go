@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestOutbox(t *testing.T) {
+	l := zap.NewNop()
+	s, err := NewBoundedStore(l, NewMemStore(l), 2, 0, EvictFIFO)
+	assert.Equal(t, nil, err)
+	q := &replyQueue{responses: make(map[string]*types.Response)}
+	// single worker, so the events of different keys are in the dispatch order
+	server := New(l, jsonResults(io.Discard), nil, s, 1)
+	outbox := NewOutbox(l, q, 100)
+	server.OnChange(outbox.Capture)
+	go outbox.Run()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go server.Process(context.Background(), wg, 1)
+	t1 := time.Now()
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: "a", Value: "1", Timestamp: t1, AppID: "client"},
+		&types.Message{Action: types.AddItem, Key: "a", Value: "2", Timestamp: t1, AppID: "client"},
+		&types.Message{Action: types.AddItem, Key: "b", Value: "3", Timestamp: t1.Add(time.Second), AppID: "client"},
+		// store holds two items, the oldest is evicted and published after the add evicting it
+		&types.Message{Action: types.AddItem, Key: "c", Value: "4", Timestamp: t1.Add(2 * time.Second), AppID: "client"},
+		&types.Message{Action: types.RemoveItem, Key: "a", AppID: "other"},
+		&types.Message{Action: types.RemoveItem, Key: "b", AppID: "other"},
+	)
+	server.closePartitions()
+	wg.Wait()
+	outbox.Close()
+
+	for i := range q.events {
+		q.events[i].Timestamp = time.Time{}
+	}
+	assert.Equal(t, []types.Event{
+		{Seq: 1, Action: types.AddItem, Key: "a", Value: "1", Origin: "client"},
+		{Seq: 2, Action: types.AddItem, Key: "a", Value: "2", OldValue: "1", Origin: "client"},
+		{Seq: 3, Action: types.AddItem, Key: "b", Value: "3", Origin: "client"},
+		{Seq: 4, Action: types.AddItem, Key: "c", Value: "4", Origin: "client"},
+		{Seq: 5, Action: types.Evict, Key: "a", OldValue: "2"},
+		{Seq: 6, Action: types.RemoveItem, Key: "b", OldValue: "3", Origin: "other"},
+	}, q.events)
+	assert.Equal(t, uint64(0), outbox.Dropped())
+	// captured after close is ignored
+	outbox.Capture(types.Event{Action: types.AddItem, Key: "b"})
+	assert.Equal(t, 6, len(q.events))
+}
+
+func TestOutbox_Full(t *testing.T) {
+	q := &replyQueue{responses: make(map[string]*types.Response)}
+	outbox := NewOutbox(zap.NewNop(), q, 2)
+	// nothing is published yet, so the outbox fills up and the capture does not block
+	for _, key := range []string{"a", "b", "c", "d"} {
+		outbox.Capture(types.Event{Action: types.AddItem, Key: key})
+	}
+	assert.Equal(t, uint64(2), outbox.Dropped())
+	go outbox.Run()
+	outbox.Close()
+	assert.Equal(t, []types.Event{{Action: types.AddItem, Key: "a"}, {Action: types.AddItem, Key: "b"}}, q.events)
+}
+
+// TestServer_Removed publishes the evictions and expirations with the owner of the key held, a key added again
+// before the eviction is published has its add published already, so the eviction is not
+func TestServer_Removed(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	store := NewMemStore(l)
+	server := New(l, jsonResults(io.Discard), nil, store, benchWorkers)
+	var events []string
+	var mu sync.Mutex
+	server.OnChange(func(event types.Event) {
+		mu.Lock()
+		events = append(events, event.Action.String()+" "+event.Key)
+		mu.Unlock()
+	})
+
+	_, err := store.Add(ctx, "a", "2", time.Now(), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	server.evicted(item{key: "a", value: "1", version: 1})
+	server.evicted(item{key: "b", value: "1", version: 2})
+	server.publishEvictions(ctx)
+	assert.Equal(t, []string{"evict b"}, events)
+
+	owner := &server.owners[server.partitionOfKey("c")]
+	owner.Lock()
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		server.removed(ctx, types.Expire, item{key: "c", value: "1"}, time.Now())
+	}()
+	select {
+	case <-published:
+		t.Fatal("expiration published while the owner of the key is applying a write")
+	case <-time.After(20 * time.Millisecond):
+	}
+	owner.Unlock()
+	<-published
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"evict b", "expire c"}, events)
+}
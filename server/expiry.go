@@ -0,0 +1,80 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// Expirer is implemented by the stores supporting per key ttl
+type Expirer interface {
+	// Expire removes the items expired by the given time and returns them
+	Expire(ctx context.Context, now time.Time) []item
+}
+
+// expired reports whether the item is past its expiry, items without ttl never expire
+func (i item) expired(now int64) bool {
+	return i.expiresAt != 0 && i.expiresAt <= now
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano
+func fromUnixNano(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+type expiryEntry struct {
+	key       string
+	expiresAt int64
+}
+
+// expiryHeap is a min-heap ordered by expiry time
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expiresAt < h[j].expiresAt }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// expiryQueue keeps the keys to be expired, it has its own lock so scheduling and sweeping do not hold the store lock.
+// an entry becomes stale when the key is overwritten or removed, so the store has to check the item expiry again
+type expiryQueue struct {
+	mu      sync.Mutex
+	entries expiryHeap
+}
+
+func (q *expiryQueue) schedule(key string, expiresAt int64) {
+	if expiresAt == 0 {
+		return
+	}
+	q.mu.Lock()
+	heap.Push(&q.entries, expiryEntry{key: key, expiresAt: expiresAt})
+	q.mu.Unlock()
+}
+
+// due pops the entries expired by now
+func (q *expiryQueue) due(now int64) []expiryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var entries []expiryEntry
+	for len(q.entries) > 0 && q.entries[0].expiresAt <= now {
+		entries = append(entries, heap.Pop(&q.entries).(expiryEntry))
+	}
+	return entries
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestStore_Expire(t *testing.T) {
+	l := zap.NewNop()
+	for name, store := range map[string]interface {
+		Store
+		Expirer
+	}{
+		"memstore":           NewMemStore(l),
+		"memstore_optimised": NewMemStoreOptimised(l),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now()
+			_, err := store.Add(ctx, "A", "a", now, time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "B", "b", now.Add(1), now.Add(-time.Millisecond), condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "C", "c", now.Add(2), now.Add(-time.Millisecond), condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "D", "d", now.Add(3), now.Add(time.Hour), condition{})
+			assert.Equal(t, nil, err)
+			// overwrite without ttl, the scheduled expiry is stale
+			_, err = store.Add(ctx, "C", "cc", now.Add(4), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+
+			// expired key is never returned even before it is swept
+			_, ok := store.Get(ctx, "B")
+			assert.Equal(t, false, ok)
+			value, ok := store.Get(ctx, "D")
+			assert.Equal(t, true, ok)
+			assert.Equal(t, "d", value)
+			assert.Equal(t, []string{"A", "D", "C"}, keys(store.GetAll(ctx)))
+
+			expired := store.Expire(ctx, now)
+			assert.Equal(t, []string{"B"}, keys(expired))
+			assert.Equal(t, 0, len(store.Expire(ctx, now)))
+			assert.Equal(t, []string{"D"}, keys(store.Expire(ctx, now.Add(2*time.Hour))))
+			assert.Equal(t, []string{"A", "C"}, keys(store.GetAll(ctx)))
+		})
+	}
+}
+
+func keys(items []item) []string {
+	out := make([]string, 0, len(items))
+	for _, _item := range items {
+		out = append(out, _item.key)
+	}
+	return out
+}
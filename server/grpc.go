@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/storepb"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcOrigin is the origin of the mutations made through the grpc api
+const grpcOrigin = "grpc"
+
+// GRPCServer serves the storepb.Store service, requests are applied through the server workers
+// the same as the http api
+type GRPCServer struct {
+	storepb.UnimplementedStoreServer
+	logger      *zap.Logger
+	server      *Server
+	listenAddrs string
+	grpcServer  *grpc.Server
+	// closed on stop, watch streams never end on their own so they are ended before the graceful stop
+	done chan struct{}
+}
+
+func NewGRPCServer(logger *zap.Logger, server *Server, listenAddrs string) *GRPCServer {
+	g := &GRPCServer{
+		logger:      logger,
+		server:      server,
+		listenAddrs: listenAddrs,
+		grpcServer:  grpc.NewServer(),
+		done:        make(chan struct{}),
+	}
+	storepb.RegisterStoreServer(g.grpcServer, g)
+	return g
+}
+
+func (g *GRPCServer) Start() {
+	g.logger.Info("Starting grpc server...", zap.String("listeningAddress", g.listenAddrs))
+	listener, err := net.Listen("tcp", g.listenAddrs)
+	if err != nil {
+		g.logger.Error("Failed to start grpc server", zap.Error(err))
+		return
+	}
+	if err := g.Serve(listener); err != nil {
+		g.logger.Error("Failed to start grpc server", zap.Error(err))
+	}
+}
+
+// Serve accepts the connections on the listener until the server is stopped
+func (g *GRPCServer) Serve(listener net.Listener) error {
+	err := g.grpcServer.Serve(listener)
+	if errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+func (g *GRPCServer) Stop() {
+	close(g.done)
+	g.grpcServer.GracefulStop()
+}
+
+func (g *GRPCServer) Add(ctx context.Context, req *storepb.AddRequest) (*storepb.AddResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is empty")
+	}
+	if req.GetTtl() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl is negative")
+	}
+	msg := &types.Message{Action: types.AddItem, Key: req.GetKey(), Value: req.GetValue(), TTL: req.GetTtl(), Timestamp: time.Now(), AppID: grpcOrigin}
+	switch cond := req.GetCondition().(type) {
+	case *storepb.AddRequest_IfVersion:
+		msg.Action, msg.Version = types.CompareAndSwap, cond.IfVersion
+	case *storepb.AddRequest_IfAbsent:
+		if cond.IfAbsent {
+			msg.Action = types.AddIfAbsent
+		}
+	}
+	resp, err := g.do(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return &storepb.AddResponse{Version: resp.Version}, nil
+}
+
+func (g *GRPCServer) Remove(ctx context.Context, req *storepb.RemoveRequest) (*storepb.RemoveResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is empty")
+	}
+	msg := &types.Message{Action: types.RemoveItem, Key: req.GetKey(), Timestamp: time.Now(), AppID: grpcOrigin}
+	if req.IfValue != nil {
+		msg.Action, msg.Value = types.RemoveIfValue, req.GetIfValue()
+	}
+	resp, err := g.do(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return &storepb.RemoveResponse{Version: resp.Version}, nil
+}
+
+func (g *GRPCServer) Get(ctx context.Context, req *storepb.GetRequest) (*storepb.GetResponse, error) {
+	if req.GetKey() == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is empty")
+	}
+	resp, err := g.do(ctx, &types.Message{Action: types.GetItem, Key: req.GetKey(), Timestamp: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return &storepb.GetResponse{Item: &storepb.Item{Key: resp.Key, Value: resp.Value, Version: resp.Version}}, nil
+}
+
+func (g *GRPCServer) GetAll(ctx context.Context, _ *storepb.GetAllRequest) (*storepb.GetAllResponse, error) {
+	resp, err := g.do(ctx, &types.Message{Action: types.GetAll, Timestamp: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*storepb.Item, 0, len(resp.Items))
+	for _, _item := range resp.Items {
+		items = append(items, &storepb.Item{Key: _item.Key, Value: _item.Value, Timestamp: timestamppb.New(_item.Timestamp), Version: _item.Version})
+	}
+	return &storepb.GetAllResponse{Items: items}, nil
+}
+
+func (g *GRPCServer) Watch(_ *storepb.WatchRequest, stream storepb.Store_WatchServer) error {
+	watcher := g.server.Watch(stream.Context(), 0)
+	for {
+		select {
+		case <-g.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case event, ok := <-watcher.Events():
+			if !ok {
+				if errors.Is(watcher.Err(), ErrWatcherLagged) {
+					return status.Error(codes.ResourceExhausted, watcher.Err().Error())
+				}
+				return status.FromContextError(watcher.Err()).Err()
+			}
+			if err := stream.Send(toEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// do applies the message and converts the failures to grpc status errors
+func (g *GRPCServer) do(ctx context.Context, msg *types.Message) (*types.Response, error) {
+	resp, err := g.server.Do(ctx, msg)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		g.logger.Error("failed to process grpc request", zap.String("action", msg.Action.String()), zap.String("key", msg.Key), zap.Error(err))
+		if errors.Is(err, ErrServerStopped) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	switch resp.Status {
+	case types.StatusOK:
+		return resp, nil
+	case types.StatusKeyNotFound:
+		return nil, status.Error(codes.NotFound, "key not found")
+	case types.StatusConflict:
+		// the client is expected to read the key again and retry, the same as a failed read-modify-write
+		return nil, status.Errorf(codes.Aborted, "condition does not hold, key is at version %d", resp.Version)
+	case types.StatusTooLarge:
+		return nil, status.Error(codes.InvalidArgument, resp.Error)
+	default:
+		return nil, status.Errorf(codes.Internal, "%s %s", resp.Status, resp.Error)
+	}
+}
+
+var eventActions = map[types.Action]storepb.Action{
+	types.AddItem:    storepb.Action_ACTION_ADD,
+	types.RemoveItem: storepb.Action_ACTION_REMOVE,
+	types.Expire:     storepb.Action_ACTION_EXPIRE,
+	types.Evict:      storepb.Action_ACTION_EVICT,
+}
+
+func toEvent(event types.Event) *storepb.Event {
+	return &storepb.Event{
+		Seq:       event.Seq,
+		Action:    eventActions[event.Action],
+		Key:       event.Key,
+		Value:     event.Value,
+		Timestamp: timestamppb.New(event.Timestamp),
+		OldValue:  event.OldValue,
+		Origin:    event.Origin,
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/storepb"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCServer(t *testing.T) {
+	l := zap.NewNop()
+	server := New(l, jsonResults(io.Discard), nil, NewMemStore(l), benchWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(context.Background(), wg, i)
+	}
+	listener := bufconn.Listen(1 << 20)
+	g := NewGRPCServer(l, server, "")
+	served := make(chan error, 1)
+	go func() {
+		served <- g.Serve(listener)
+	}()
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	client := storepb.NewStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &storepb.WatchRequest{})
+	assert.Equal(t, nil, err)
+	// the watcher is registered once the stream is established, a mutation afterwards is always received
+	waitWatchers(t, server, 1)
+
+	_, err = client.Add(ctx, &storepb.AddRequest{Key: "111", Value: "222"})
+	assert.Equal(t, nil, err)
+	_, err = client.Add(ctx, &storepb.AddRequest{Key: "333", Value: "444"})
+	assert.Equal(t, nil, err)
+	_, err = client.Remove(ctx, &storepb.RemoveRequest{Key: "333"})
+	assert.Equal(t, nil, err)
+	_, err = client.Remove(ctx, &storepb.RemoveRequest{Key: "333"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Get(ctx, &storepb.GetRequest{Key: "333"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Add(ctx, &storepb.AddRequest{Key: ""})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// conditional writes fail with aborted if the condition does not hold
+	_, err = client.Add(ctx, &storepb.AddRequest{Key: "111", Value: "000", Condition: &storepb.AddRequest_IfAbsent{IfAbsent: true}})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	added, err := client.Add(ctx, &storepb.AddRequest{Key: "111", Value: "223", Condition: &storepb.AddRequest_IfVersion{IfVersion: 1}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(3), added.GetVersion())
+	ifValue := "222"
+	_, err = client.Remove(ctx, &storepb.RemoveRequest{Key: "111", IfValue: &ifValue})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	got, err := client.Get(ctx, &storepb.GetRequest{Key: "111"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "223", got.GetItem().GetValue())
+	assert.Equal(t, uint64(3), got.GetItem().GetVersion())
+	all, err := client.GetAll(ctx, &storepb.GetAllRequest{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(all.GetItems()))
+	assert.Equal(t, "111", all.GetItems()[0].GetKey())
+
+	// only the applied mutations are watched, the failed remove and the conflicts are not
+	expected := []struct {
+		action     storepb.Action
+		key, value string
+	}{
+		{storepb.Action_ACTION_ADD, "111", "222"},
+		{storepb.Action_ACTION_ADD, "333", "444"},
+		{storepb.Action_ACTION_REMOVE, "333", ""},
+		{storepb.Action_ACTION_ADD, "111", "223"},
+	}
+	for i, e := range expected {
+		event, err := stream.Recv()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint64(i+1), event.GetSeq())
+		assert.Equal(t, e.action, event.GetAction())
+		assert.Equal(t, e.key, event.GetKey())
+		assert.Equal(t, e.value, event.GetValue())
+	}
+
+	// stop ends the watch stream as well
+	g.Stop()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, nil, <-served)
+	server.closePartitions()
+	wg.Wait()
+}
+
+func TestServer_WatchLagged(t *testing.T) {
+	server := New(zap.NewNop(), jsonResults(io.Discard), nil, nil, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := server.Watch(ctx, 2)
+	fast := server.Watch(ctx, 10)
+	for _, key := range []string{"a", "b", "c"} {
+		server.watchers.publish(types.Event{Action: types.AddItem, Key: key, Value: key, Timestamp: time.Now()})
+	}
+
+	// slow watcher is dropped on the third event, the events before are still delivered
+	var keys []string
+	for event := range slow.Events() {
+		keys = append(keys, event.Key)
+	}
+	assert.Equal(t, []string{"a", "b"}, keys)
+	assert.Equal(t, ErrWatcherLagged, slow.Err())
+	assert.Equal(t, 3, len(fast.Events()))
+
+	cancel()
+	for range fast.Events() {
+	}
+	assert.Equal(t, context.Canceled, fast.Err())
+}
+
+func waitWatchers(t *testing.T, server *Server, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		server.watchers.mu.Lock()
+		registered := len(server.watchers.watchers)
+		server.watchers.mu.Unlock()
+		if registered == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d watchers are not registered", n)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+)
+
+// ErrDraining fails the readiness once the server is shutting down, so no new requests are routed to it
+var ErrDraining = errors.New("server is draining")
+
+var errNotConsuming = errors.New("queue consumer is not running")
+
+const (
+	// heartbeatInterval is how often an idle worker reports it is alive
+	heartbeatInterval = time.Second
+	// heartbeatTimeout is how long a worker can be busy with one message before it is reported as stuck
+	heartbeatTimeout = 30 * time.Second
+)
+
+// health is the state the probes are answered from
+type health struct {
+	draining  int32
+	consuming int32
+	// heartbeats are the unix nano of the last heartbeat by partition, zero if the worker is not running
+	heartbeats []int64
+	interval   time.Duration
+	timeout    time.Duration
+}
+
+func newHealth(partitions int) health {
+	return health{
+		heartbeats: make([]int64, partitions),
+		interval:   heartbeatInterval,
+		timeout:    heartbeatTimeout,
+	}
+}
+
+// Drain fails the readiness from now on, it is called first on shutdown so the load balancers stop routing
+// to the server while the in flight messages are completed
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.health.draining, 1)
+}
+
+// Live reports the checks of the liveness probe, the server should be restarted if any of them fails
+func (s *Server) Live() map[string]error {
+	return map[string]error{
+		"workers": s.checkWorkers(),
+	}
+}
+
+// Ready reports the checks of the readiness probe: the server is not draining, connected to the broker and consuming,
+// the workers are alive and the store is available. queue checks are skipped if the server has no queue
+func (s *Server) Ready() map[string]error {
+	checks := map[string]error{
+		"workers": s.checkWorkers(),
+		"store":   storeHealth(s.store),
+	}
+	if atomic.LoadInt32(&s.health.draining) == 1 {
+		checks["draining"] = ErrDraining
+	} else {
+		checks["draining"] = nil
+	}
+	if s.queue != nil {
+		checks["queue"] = queue.Health(s.queue)
+		checks["consumer"] = nil
+		if atomic.LoadInt32(&s.health.consuming) == 0 {
+			checks["consumer"] = errNotConsuming
+		}
+	}
+	return checks
+}
+
+// checkWorkers fails if a partition has no worker or its worker is stuck
+func (s *Server) checkWorkers() error {
+	now := time.Now().UnixNano()
+	for partition := range s.health.heartbeats {
+		heartbeat := atomic.LoadInt64(&s.health.heartbeats[partition])
+		if heartbeat == 0 {
+			return fmt.Errorf("worker of partition %d is not running", partition)
+		}
+		if since := time.Duration(now - heartbeat); since > s.health.timeout {
+			return fmt.Errorf("worker of partition %d is stuck for %s", partition, since.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// heartbeat marks the worker of the partition alive, zero time marks it stopped
+func (s *Server) heartbeat(partition int, at time.Time) {
+	var value int64
+	if !at.IsZero() {
+		value = at.UnixNano()
+	}
+	atomic.StoreInt64(&s.health.heartbeats[partition], value)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestServer_Health(t *testing.T) {
+	l := zap.NewNop()
+	q := queue.NewMemory(l, t.Name())
+	server := New(l, jsonResults(io.Discard), q, NewMemStore(l), 2)
+	// heartbeats are set by hand, idle workers do not refresh them during the test
+	server.health.interval = time.Hour
+	failing := func(checks map[string]error) []string {
+		var names []string
+		for _, name := range []string{"workers", "store", "draining", "queue", "consumer"} {
+			if checks[name] != nil {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	assert.Equal(t, []string{"workers"}, failing(server.Live()))
+	assert.Equal(t, []string{"workers", "consumer"}, failing(server.Ready()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start(ctx)
+	}()
+	wg.Add(2)
+	for i := 1; i <= 2; i++ {
+		go server.Process(ctx, wg, i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(failing(server.Ready())) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, len(failing(server.Ready())))
+	assert.Equal(t, 0, len(failing(server.Live())))
+
+	// a worker busy with one message for too long is stuck
+	server.heartbeat(0, time.Now().Add(-time.Minute))
+	assert.Equal(t, "worker of partition 0 is stuck for 1m0s", server.Live()["workers"].Error())
+	server.heartbeat(0, time.Now())
+
+	ts := httptest.NewServer(NewAPI(l, server, "").Handler())
+	defer ts.Close()
+	probe := func(path string) (int, healthReport) {
+		t.Helper()
+		res, err := ts.Client().Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var report healthReport
+		assert.Equal(t, nil, json.NewDecoder(res.Body).Decode(&report))
+		return res.StatusCode, report
+	}
+	code, report := probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthReport{Status: "ok", Checks: map[string]string{"workers": "ok", "store": "ok", "draining": "ok", "queue": "ok", "consumer": "ok"}}, report)
+
+	// draining fails the readiness only, the server is still alive
+	server.Drain()
+	code, report = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, ErrDraining.Error(), report.Checks["draining"])
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	cancel()
+	assert.Equal(t, nil, <-started)
+	wg.Wait()
+	assert.Equal(t, nil, q.Close())
+	assert.Equal(t, []string{"workers", "draining", "queue", "consumer"}, failing(server.Ready()))
+	code, _ = probe("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestWALStore_Health(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	wal, err := NewWALStore(l, NewMemStore(l), filepath.Join(t.TempDir(), "wal.log"), SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	store, err := NewBoundedStore(l, wal, 10, 0, EvictLRU)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, store.Health())
+
+	// failed append makes the store unavailable until a write succeeds again
+	assert.Equal(t, nil, wal.file.Close())
+	_, err = store.Add(ctx, "a", "1", time.Now(), time.Time{}, condition{})
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, nil, store.Health())
+
+	_ = wal.Close() // the file is closed already
+	assert.Equal(t, errWALClosed, store.Health())
+}
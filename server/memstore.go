@@ -13,62 +13,187 @@ type MemStore struct {
 	logger *zap.Logger
 	mu     *sync.RWMutex
 	cache  map[string]item
+	bytes  int64
+	expiry *expiryQueue
+	// version is the last version given to an item, guarded by mu
+	version uint64
 }
 
 type item struct {
 	key, value string
 	timestamp  int64
+	expiresAt  int64 // zero if the item never expires
+	// version is drawn from a counter of the store on every write, so it increases with every overwrite
+	// and a removed or expired key never gets a version it had before
+	version uint64
 }
 
-var _ Store = (*MemStore)(nil)
+var (
+	_ Store   = (*MemStore)(nil)
+	_ Expirer = (*MemStore)(nil)
+	_ Sizer   = (*MemStore)(nil)
+
+	_ Transactor = (*MemStore)(nil)
+	_ restorer   = (*MemStore)(nil)
+)
 
 func NewMemStore(logger *zap.Logger) *MemStore {
 	return &MemStore{
 		logger: logger,
 		mu:     new(sync.RWMutex),
 		cache:  make(map[string]item),
+		expiry: new(expiryQueue),
 	}
 }
 
-func (m *MemStore) Add(ctx context.Context, key, value string, timestamp time.Time) {
+func (m *MemStore) Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error) {
 	m.mu.Lock()
-	m.cache[key] = item{
+	current, exists := m.lookup(key)
+	if !cond.holds(current, exists) {
+		m.mu.Unlock()
+		return current.version, ErrConflict
+	}
+	_item := item{
 		key:       key,
 		value:     value,
 		timestamp: timestamp.UnixNano(),
+		expiresAt: unixNano(expiresAt),
+		version:   m.nextVersion(),
 	}
+	m.put(_item)
 	m.mu.Unlock()
+	m.expiry.schedule(key, _item.expiresAt)
+	return _item.version, nil
+}
+
+// restore loads the item as it is, with its version
+func (m *MemStore) restore(_item item) {
+	m.mu.Lock()
+	m.put(_item)
+	m.version = maxVersion(m.version, _item.version)
+	m.mu.Unlock()
+	m.expiry.schedule(_item.key, _item.expiresAt)
+}
+
+func (m *MemStore) lastVersion() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version
 }
 
-func (m *MemStore) Remove(ctx context.Context, key string) bool {
+func (m *MemStore) restoreVersion(version uint64) {
+	m.mu.Lock()
+	m.version = maxVersion(m.version, version)
+	m.mu.Unlock()
+}
+
+// nextVersion returns the version of the next write, must be called with the lock held
+func (m *MemStore) nextVersion() uint64 {
+	m.version++
+	return m.version
+}
+
+// put stores the item, must be called with the lock held
+func (m *MemStore) put(_item item) {
+	m.bytes += _item.size() - m.cache[_item.key].size()
+	m.cache[_item.key] = _item
+}
+
+func (m *MemStore) Remove(ctx context.Context, key string, cond condition) (uint64, bool, error) {
 	defer m.mu.Unlock()
 	m.mu.Lock()
-	_, ok := m.cache[key]
+	_item, ok := m.cache[key]
+	// expired key is reported as not found, same as Get
+	current, exists := live(_item, ok)
+	if exists && !cond.holds(current, exists) {
+		return current.version, false, ErrConflict
+	}
 	if ok {
 		delete(m.cache, key)
+		m.bytes -= _item.size()
 	}
-	return ok
+	return current.version, exists, nil
+}
+
+func (m *MemStore) Txn(ctx context.Context, ops []txnOp) ([]uint64, error) {
+	m.mu.Lock()
+	writes, versions, err := stage(ops, m.lookup, m.nextVersion)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	for _, write := range writes {
+		if write.live {
+			m.put(write.item)
+			continue
+		}
+		if _item, ok := m.cache[write.key]; ok {
+			delete(m.cache, write.key)
+			m.bytes -= _item.size()
+		}
+	}
+	m.mu.Unlock()
+	m.expiry.scheduleWrites(writes)
+	return versions, nil
 }
 
 func (m *MemStore) Get(ctx context.Context, key string) (string, bool) {
 	defer m.mu.RUnlock()
 	m.mu.RLock()
 	_item, ok := m.cache[key]
-	if ok {
-		return _item.value, ok
+	if ok && !_item.expired(time.Now().UnixNano()) {
+		return _item.value, true
 	}
-	return "", ok
+	return "", false
+}
+
+func (m *MemStore) Lookup(ctx context.Context, key string) (item, bool) {
+	defer m.mu.RUnlock()
+	m.mu.RLock()
+	return m.lookup(key)
+}
+
+// lookup returns the item if it is live, must be called with the lock held
+func (m *MemStore) lookup(key string) (item, bool) {
+	_item, ok := m.cache[key]
+	return live(_item, ok)
 }
 
 func (m *MemStore) GetAll(ctx context.Context) []item {
 	defer m.mu.RUnlock()
 	m.mu.RLock()
+	now := time.Now().UnixNano()
 	sorted := make([]item, 0, len(m.cache))
 	for _, _item := range m.cache {
-		sorted = append(sorted, _item)
+		if !_item.expired(now) {
+			sorted = append(sorted, _item)
+		}
 	}
 	sort.Slice(sorted, func(i, j int) bool {
 		return sorted[i].timestamp < sorted[j].timestamp
 	})
 	return sorted
 }
+
+// Expire removes the due items one by one, so the lock is never held for the whole sweep
+func (m *MemStore) Expire(ctx context.Context, now time.Time) []item {
+	var expired []item
+	for _, entry := range m.expiry.due(now.UnixNano()) {
+		m.mu.Lock()
+		_item, ok := m.cache[entry.key]
+		// entry is stale if the key is overwritten with a different ttl
+		if ok && _item.expiresAt == entry.expiresAt {
+			delete(m.cache, entry.key)
+			m.bytes -= _item.size()
+			expired = append(expired, _item)
+		}
+		m.mu.Unlock()
+	}
+	return expired
+}
+
+func (m *MemStore) Size() (int, int64) {
+	defer m.mu.RUnlock()
+	m.mu.RLock()
+	return len(m.cache), m.bytes
+}
@@ -2,79 +2,230 @@ package server
 
 import (
 	"context"
-	"sort"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// MemStoreOptimised keeps the items in an intrusive doubly linked list in insertion order, same as the shards
+// of ShardedStore, so add and remove are O(1) and GetAll returns the items in order without sorting.
+// timestamps are kept as data only, an overwritten key moves to the tail
 type MemStoreOptimised struct {
 	logger *zap.Logger
 	mu     *sync.RWMutex
-	items  []item
-	cache  map[string]int
+	root   *node // sentinel, root.next is the oldest and root.prev is the latest item
+	cache  map[string]*node
+	bytes  int64
+	expiry *expiryQueue
+	// last version given, same counter as MemStore
+	version uint64
 }
 
+type node struct {
+	item
+	prev, next *node
+}
+
+var (
+	_ Store   = (*MemStoreOptimised)(nil)
+	_ Expirer = (*MemStoreOptimised)(nil)
+	_ Sizer   = (*MemStoreOptimised)(nil)
+
+	_ Transactor = (*MemStoreOptimised)(nil)
+	_ restorer   = (*MemStoreOptimised)(nil)
+)
+
 func NewMemStoreOptimised(logger *zap.Logger) *MemStoreOptimised {
+	root := new(node)
+	root.prev, root.next = root, root
 	return &MemStoreOptimised{
 		logger: logger,
 		mu:     new(sync.RWMutex),
-		items:  make([]item, 0),
-		// index of items used as value for map instead of item to reduce the size of cache
-		cache: make(map[string]int),
+		root:   root,
+		cache:  make(map[string]*node),
+		expiry: new(expiryQueue),
 	}
 }
 
-func (m *MemStoreOptimised) Add(ctx context.Context, key, value string, timestamp time.Time) {
-	defer m.mu.Unlock()
+func (m *MemStoreOptimised) Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error) {
 	m.mu.Lock()
+	n, ok := m.cache[key]
+	current, exists := m.live(n, ok)
+	if !cond.holds(current, exists) {
+		m.mu.Unlock()
+		return current.version, ErrConflict
+	}
 	val := item{
 		key:       key,
 		value:     value,
 		timestamp: timestamp.UnixNano(),
+		expiresAt: unixNano(expiresAt),
+		version:   m.nextVersion(),
 	}
-	if index, ok := m.cache[key]; ok {
-		// key exist already, update the value
-		m.items[index] = val
-		return
+	m.put(val)
+	m.mu.Unlock()
+	m.expiry.schedule(key, val.expiresAt)
+	return val.version, nil
+}
+
+// restore loads the item as it is, with its version
+func (m *MemStoreOptimised) restore(val item) {
+	m.mu.Lock()
+	m.put(val)
+	m.version = maxVersion(m.version, val.version)
+	m.mu.Unlock()
+	m.expiry.schedule(val.key, val.expiresAt)
+}
+
+func (m *MemStoreOptimised) lastVersion() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.version
+}
+
+func (m *MemStoreOptimised) restoreVersion(version uint64) {
+	m.mu.Lock()
+	m.version = maxVersion(m.version, version)
+	m.mu.Unlock()
+}
+
+// nextVersion returns the version of the next write, must be called with the lock held
+func (m *MemStoreOptimised) nextVersion() uint64 {
+	m.version++
+	return m.version
+}
+
+// put stores the item, must be called with the lock held
+func (m *MemStoreOptimised) put(val item) {
+	n, ok := m.cache[val.key]
+	if ok {
+		// key exist already, it moves to the tail same as a new insertion
+		m.unlink(n)
+		m.bytes -= n.size()
+		n.item = val
+	} else {
+		n = &node{item: val}
+		m.cache[val.key] = n
+	}
+	m.bytes += n.size()
+	m.append(n)
+}
+
+// live returns the item of the node if it is live, must be called with the lock held
+func (m *MemStoreOptimised) live(n *node, ok bool) (item, bool) {
+	if !ok {
+		return item{}, false
 	}
-	m.items = append(m.items, val)  // append the value
-	m.cache[key] = len(m.items) - 1 // update the index
+	return live(n.item, true)
 }
 
-func (m *MemStoreOptimised) Remove(ctx context.Context, key string) bool {
+// append links the node after the latest item
+func (m *MemStoreOptimised) append(n *node) {
+	n.prev, n.next = m.root.prev, m.root
+	m.root.prev.next = n
+	m.root.prev = n
+}
+
+func (m *MemStoreOptimised) unlink(n *node) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next = nil, nil
+}
+
+func (m *MemStoreOptimised) Remove(ctx context.Context, key string, cond condition) (uint64, bool, error) {
 	defer m.mu.Unlock()
 	m.mu.Lock()
-	index, ok := m.cache[key]
+	n, ok := m.cache[key]
+	// expired key is reported as not found, same as Get
+	current, exists := m.live(n, ok)
+	if exists && !cond.holds(current, exists) {
+		return current.version, false, ErrConflict
+	}
 	if ok {
-		m.items = append(m.items[:index], m.items[index+1:]...)
+		m.unlink(n)
 		delete(m.cache, key)
+		m.bytes -= n.size()
+	}
+	return current.version, exists, nil
+}
 
-		for i := index; i < len(m.items); i++ {
-			m.cache[m.items[i].key] = i
+func (m *MemStoreOptimised) Txn(ctx context.Context, ops []txnOp) ([]uint64, error) {
+	m.mu.Lock()
+	writes, versions, err := stage(ops, func(key string) (item, bool) {
+		n, ok := m.cache[key]
+		return m.live(n, ok)
+	}, m.nextVersion)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	for _, write := range writes {
+		if write.live {
+			m.put(write.item)
+			continue
+		}
+		if n, ok := m.cache[write.key]; ok {
+			m.unlink(n)
+			delete(m.cache, write.key)
+			m.bytes -= n.size()
 		}
 	}
-	return ok
+	m.mu.Unlock()
+	m.expiry.scheduleWrites(writes)
+	return versions, nil
 }
 
 func (m *MemStoreOptimised) Get(ctx context.Context, key string) (string, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	index, ok := m.cache[key]
-	if ok {
-		return m.items[index].value, ok
+	n, ok := m.cache[key]
+	if ok && !n.expired(time.Now().UnixNano()) {
+		return n.value, true
 	}
-	return "", ok
+	return "", false
+}
+
+func (m *MemStoreOptimised) Lookup(ctx context.Context, key string) (item, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, ok := m.cache[key]
+	return m.live(n, ok)
 }
 
 func (m *MemStoreOptimised) GetAll(ctx context.Context) []item {
 	defer m.mu.RUnlock()
 	m.mu.RLock()
-	sorted := make([]item, len(m.items))
-	copy(sorted, m.items)
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].timestamp < sorted[j].timestamp
-	})
+	now := time.Now().UnixNano()
+	sorted := make([]item, 0, len(m.cache))
+	for n := m.root.next; n != m.root; n = n.next {
+		if !n.expired(now) {
+			sorted = append(sorted, n.item)
+		}
+	}
 	return sorted
 }
+
+// Expire removes the due items one by one, so the lock is never held for the whole sweep
+func (m *MemStoreOptimised) Expire(ctx context.Context, now time.Time) []item {
+	var expired []item
+	for _, entry := range m.expiry.due(now.UnixNano()) {
+		m.mu.Lock()
+		n, ok := m.cache[entry.key]
+		// entry is stale if the key is overwritten with a different ttl
+		if ok && n.expiresAt == entry.expiresAt {
+			expired = append(expired, n.item)
+			m.unlink(n)
+			delete(m.cache, entry.key)
+			m.bytes -= n.size()
+		}
+		m.mu.Unlock()
+	}
+	return expired
+}
+
+func (m *MemStoreOptimised) Size() (int, int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.cache), m.bytes
+}
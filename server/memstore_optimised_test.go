@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestMemStoreOptimised_Order(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStoreOptimised(zap.NewNop())
+	now := time.Now()
+	// items are kept in insertion order whatever their timestamps are
+	for _, add := range []struct {
+		key    string
+		offset time.Duration
+	}{
+		{key: "b", offset: 2},
+		{key: "d", offset: 4},
+		{key: "a", offset: 1},
+		{key: "c", offset: 3},
+		{key: "e", offset: 4},
+		{key: "first", offset: 0},
+	} {
+		_, err := store.Add(ctx, add.key, "value", now.Add(add.offset), time.Time{}, condition{})
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, []string{"b", "d", "a", "c", "e", "first"}, keys(store.GetAll(ctx)))
+
+	_, ok, err := store.Remove(ctx, "c", condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	_, ok, err = store.Remove(ctx, "b", condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	_, ok, err = store.Remove(ctx, "first", condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, []string{"d", "a", "e"}, keys(store.GetAll(ctx)))
+	count, _ := store.Size()
+	assert.Equal(t, 3, count)
+}
+
+func TestMemStoreOptimised_Overwrite(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStoreOptimised(zap.NewNop())
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c"} {
+		_, err := store.Add(ctx, key, "value", now.Add(time.Duration(i)), time.Time{}, condition{})
+		assert.Equal(t, nil, err)
+	}
+	_, size := store.Size()
+
+	// overwritten key moves to the tail, value, timestamp, bytes and version are updated
+	version, err := store.Add(ctx, "b", "new value", now.Add(-1), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(4), version)
+	assert.Equal(t, []string{"a", "c", "b"}, keys(store.GetAll(ctx)))
+	val, ok := store.Lookup(ctx, "b")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "new value", val.value)
+	assert.Equal(t, now.Add(-1).UnixNano(), val.timestamp)
+	assert.Equal(t, uint64(4), val.version)
+	count, bytes := store.Size()
+	assert.Equal(t, 3, count)
+	assert.Equal(t, size+int64(len("new value")-len("value")), bytes)
+
+	_, err = store.Add(ctx, "a", "value", now, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"c", "b", "a"}, keys(store.GetAll(ctx)))
+	count, _ = store.Size()
+	assert.Equal(t, 3, count)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reasons of the dropped messages and events
+const (
+	dropRedeliveryFailed = "redelivery_failed" // message exceeded the max retries and the queue has no dead letter queue
+	dropWatcherLagged    = "watcher_lagged"    // watcher fell behind and is stopped
+	dropOutboxFull       = "cdc_outbox_full"   // change event captured while the outbox is full
+	dropPublishFailed    = "cdc_publish_failed"
+)
+
+var (
+	processedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "server",
+		Name:      "messages_processed_total",
+		Help:      "Messages processed by the workers by action and status.",
+	}, []string{"action", "status"})
+	droppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "server",
+		Name:      "dropped_total",
+		Help:      "Messages and change events dropped by the server by reason.",
+	}, []string{"reason"})
+	workerBusySeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "server",
+		Name:      "worker_busy_seconds_total",
+		Help:      "Time spent by the worker processing the messages.",
+	}, []string{"worker"})
+	processingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "clique",
+		Subsystem: "server",
+		Name:      "processing_duration_seconds",
+		Help:      "Latency of the processed messages by action.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to 2.6s
+	}, []string{"action"})
+	removedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clique",
+		Subsystem: "store",
+		Name:      "removed_total",
+		Help:      "Items removed by the sweeper and the evictor by action.",
+	}, []string{"action"})
+)
+
+var (
+	partitionDepthDesc = prometheus.NewDesc("clique_server_partition_depth", "Messages waiting in the worker partition channel.", []string{"partition"}, nil)
+	storeItemsDesc     = prometheus.NewDesc("clique_store_items", "Items held by the store, expired items not swept yet included.", nil, nil)
+	storeBytesDesc     = prometheus.NewDesc("clique_store_bytes", "Size of the keys and values held by the store.", nil, nil)
+
+	storeEvictionsDesc    = prometheus.NewDesc("clique_store_evictions_total", "Items evicted by the bounded store to stay within its capacity.", nil, nil)
+	storeEvictedBytesDesc = prometheus.NewDesc("clique_store_evicted_bytes_total", "Size of the keys and values evicted by the bounded store.", nil, nil)
+)
+
+var _ prometheus.Collector = (*Server)(nil)
+
+// Describe and Collect report the gauges read at scrape time, the server is registered as a collector
+func (s *Server) Describe(ch chan<- *prometheus.Desc) {
+	ch <- partitionDepthDesc
+	if _, ok := s.store.(Sizer); ok {
+		ch <- storeItemsDesc
+		ch <- storeBytesDesc
+	}
+	if _, ok := s.store.(*BoundedStore); ok {
+		ch <- storeEvictionsDesc
+		ch <- storeEvictedBytesDesc
+	}
+}
+
+func (s *Server) Collect(ch chan<- prometheus.Metric) {
+	for i, partition := range s.partitions {
+		ch <- prometheus.MustNewConstMetric(partitionDepthDesc, prometheus.GaugeValue, float64(len(partition)), strconv.Itoa(i))
+	}
+	if sizer, ok := s.store.(Sizer); ok {
+		items, bytes := sizer.Size()
+		ch <- prometheus.MustNewConstMetric(storeItemsDesc, prometheus.GaugeValue, float64(items))
+		ch <- prometheus.MustNewConstMetric(storeBytesDesc, prometheus.GaugeValue, float64(bytes))
+	}
+	if bounded, ok := s.store.(*BoundedStore); ok {
+		stats := bounded.Stats()
+		ch <- prometheus.MustNewConstMetric(storeEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+		ch <- prometheus.MustNewConstMetric(storeEvictedBytesDesc, prometheus.CounterValue, float64(stats.EvictedBytes))
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	l := zap.NewNop()
+	counters := map[string]func() float64{
+		"add ok":                 counter(processedTotal.WithLabelValues("add", "ok")),
+		"remove key_not_found":   counter(processedTotal.WithLabelValues("remove", "key_not_found")),
+		"unknown unknown_action": counter(processedTotal.WithLabelValues("unknown", "unknown_action")),
+		"add error":              counter(processedTotal.WithLabelValues("add", "error")),
+		dropRedeliveryFailed:     counter(droppedTotal.WithLabelValues(dropRedeliveryFailed)),
+		types.Evict.String():     counter(removedTotal.WithLabelValues(types.Evict.String())),
+	}
+	before := make(map[string]float64)
+	for name, value := range counters {
+		before[name] = value()
+	}
+
+	// bounded store evicts the oldest key on the third add
+	store, err := NewBoundedStore(l, NewMemStore(l), 2, 0, EvictFIFO)
+	assert.Equal(t, nil, err)
+	server := New(l, jsonResults(io.Discard), nil, store, 1)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go server.Process(context.Background(), wg, 1)
+	now := time.Now()
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: "a", Value: "1", Timestamp: now, Acknowledger: new(acknowledger)},
+		&types.Message{Action: types.AddItem, Key: "b", Value: "22", Timestamp: now.Add(1), Acknowledger: new(acknowledger)},
+		&types.Message{Action: types.AddItem, Key: "c", Value: "333", Timestamp: now.Add(2), Acknowledger: new(acknowledger)},
+		&types.Message{Action: types.RemoveItem, Key: "a", Acknowledger: new(acknowledger)},
+		&types.Message{Action: "bogus", Acknowledger: new(acknowledger)},
+	)
+	server.closePartitions()
+	wg.Wait()
+
+	// nil store makes every write panic, the message out of retries is dropped
+	failing := New(l, jsonResults(io.Discard), nil, nil, 1)
+	wg.Add(1)
+	go failing.Process(context.Background(), wg, 1)
+	dispatch(t, failing,
+		&types.Message{Action: types.AddItem, Key: "a", Value: "1", Acknowledger: new(acknowledger)},
+		&types.Message{Action: types.AddItem, Key: "a", Value: "1", Redelivered: true, Retries: 1, Acknowledger: new(acknowledger)},
+	)
+	failing.closePartitions()
+	wg.Wait()
+
+	for name, delta := range map[string]float64{
+		"add ok":                 3,
+		"remove key_not_found":   1,
+		"unknown unknown_action": 1,
+		"add error":              2,
+		dropRedeliveryFailed:     1,
+		types.Evict.String():     1,
+	} {
+		assert.Equal(t, before[name]+delta, counters[name]())
+	}
+	// unknown actions share a series
+	assert.Equal(t, 0.0, testutil.ToFloat64(processedTotal.WithLabelValues("bogus", "unknown_action")))
+
+	// store keeps b and c, the partition channel is drained
+	expected := `
+# HELP clique_server_partition_depth Messages waiting in the worker partition channel.
+# TYPE clique_server_partition_depth gauge
+clique_server_partition_depth{partition="0"} 0
+# HELP clique_store_bytes Size of the keys and values held by the store.
+# TYPE clique_store_bytes gauge
+clique_store_bytes 7
+# HELP clique_store_evicted_bytes_total Size of the keys and values evicted by the bounded store.
+# TYPE clique_store_evicted_bytes_total counter
+clique_store_evicted_bytes_total 2
+# HELP clique_store_evictions_total Items evicted by the bounded store to stay within its capacity.
+# TYPE clique_store_evictions_total counter
+clique_store_evictions_total 1
+# HELP clique_store_items Items held by the store, expired items not swept yet included.
+# TYPE clique_store_items gauge
+clique_store_items 2
+`
+	assert.Equal(t, nil, testutil.CollectAndCompare(server, strings.NewReader(expected)))
+}
+
+func TestStore_Size(t *testing.T) {
+	l := zap.NewNop()
+	bounded, err := NewBoundedStore(l, NewMemStore(l), 0, 0, EvictLRU)
+	assert.Equal(t, nil, err)
+	for name, store := range map[string]interface {
+		Store
+		Expirer
+		Sizer
+	}{
+		"memstore":           NewMemStore(l),
+		"memstore_optimised": NewMemStoreOptimised(l),
+		"sharded":            NewShardedStore(l, 4),
+		"bounded":            bounded,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now()
+			_, err := store.Add(ctx, "A", "a", now, time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "B", "bb", now.Add(1), now.Add(-time.Millisecond), condition{})
+			assert.Equal(t, nil, err)
+			_, err = store.Add(ctx, "C", "c", now.Add(2), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			// overwrite accounts the difference
+			_, err = store.Add(ctx, "C", "cccc", now.Add(3), time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			items, bytes := store.Size()
+			assert.Equal(t, 3, items)
+			assert.Equal(t, int64(2+3+5), bytes)
+
+			_, _, err = store.Remove(ctx, "A", condition{})
+			assert.Equal(t, nil, err)
+			store.Expire(ctx, now)
+			items, bytes = store.Size()
+			assert.Equal(t, 1, items)
+			assert.Equal(t, int64(5), bytes)
+		})
+	}
+}
+
+// counter reads the current value, the metrics are global so the test checks the deltas
+func counter(c prometheus.Collector) func() float64 {
+	return func() float64 { return testutil.ToFloat64(c) }
+}
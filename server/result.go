@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+)
+
+// OutputFormat is the format of the results written to the output file
+type OutputFormat string
+
+const (
+	OutputJSON OutputFormat = "json" // one json object per line (ndjson)
+	OutputCSV  OutputFormat = "csv"  // header row is written when the output is empty
+	OutputText OutputFormat = "text" // human readable lines
+)
+
+// textTimeFormat matches the timestamp of the standard logger the text lines used to be written with
+const textTimeFormat = "2006/01/02 15:04:05.000000"
+
+var csvHeader = []string{"time", "workerId", "action", "key", "value", "ttl", "version", "items", "status", "error", "latencyNs"}
+
+// Result is the outcome of a processed message, expire and evict results are written by the sweeper
+// and the evictor so they have no worker id
+type Result struct {
+	Time     time.Time    `json:"time"`
+	WorkerID int          `json:"workerId,omitempty"`
+	Action   types.Action `json:"action"`
+	Key      string       `json:"key,omitempty"`
+	Value    string       `json:"value,omitempty"`
+	// TTL of an added key in milliseconds
+	TTL int64 `json:"ttl,omitempty"`
+	// Version of the key written, removed or read, the current version on conflict
+	Version uint64        `json:"version,omitempty"`
+	Items   []types.Item  `json:"items,omitempty"`
+	Status  types.Status  `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Latency time.Duration `json:"latencyNs"`
+}
+
+// ResultWriter writes the results to the output, it is safe for concurrent use
+type ResultWriter interface {
+	WriteResult(*Result) error
+}
+
+// resultWriter encodes a result into the buffer and writes it with a single write,
+// so the lines of the workers are never interleaved
+type resultWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	buf    bytes.Buffer
+	encode func(*bytes.Buffer, *Result) error
+}
+
+// NewResultWriter creates the writer of the given format
+func NewResultWriter(w io.Writer, format OutputFormat) (ResultWriter, error) {
+	rw := &resultWriter{w: w}
+	switch format {
+	case OutputJSON:
+		rw.encode = encodeJSON
+	case OutputCSV:
+		empty := emptyFunc(w)
+		rw.encode = func(buf *bytes.Buffer, r *Result) error {
+			if empty() {
+				if err := encodeCSV(buf, csvHeader); err != nil {
+					return err
+				}
+			}
+			return encodeCSVResult(buf, r)
+		}
+	case OutputText:
+		rw.encode = encodeText
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return rw, nil
+}
+
+func (rw *resultWriter) WriteResult(r *Result) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.buf.Reset()
+	if err := rw.encode(&rw.buf, r); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(rw.buf.Bytes())
+	return err
+}
+
+func encodeJSON(buf *bytes.Buffer, r *Result) error {
+	return json.NewEncoder(buf).Encode(r)
+}
+
+func encodeCSVResult(buf *bytes.Buffer, r *Result) error {
+	var items string
+	if len(r.Items) > 0 {
+		data, err := json.Marshal(r.Items)
+		if err != nil {
+			return err
+		}
+		items = string(data)
+	}
+	var ttl string
+	if r.TTL > 0 {
+		ttl = strconv.FormatInt(r.TTL, 10)
+	}
+	var version string
+	if r.Version > 0 {
+		version = strconv.FormatUint(r.Version, 10)
+	}
+	var workerID string
+	if r.WorkerID > 0 {
+		workerID = strconv.Itoa(r.WorkerID)
+	}
+	return encodeCSV(buf, []string{
+		r.Time.UTC().Format(time.RFC3339Nano), workerID, r.Action.String(), r.Key, r.Value, ttl, version, items,
+		r.Status.String(), r.Error, strconv.FormatInt(int64(r.Latency), 10),
+	})
+}
+
+func encodeCSV(buf *bytes.Buffer, record []string) error {
+	w := csv.NewWriter(buf)
+	if err := w.Write(record); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func encodeText(buf *bytes.Buffer, r *Result) error {
+	buf.WriteString(r.Time.UTC().Format(textTimeFormat))
+	switch {
+	case r.WorkerID > 0:
+		fmt.Fprintf(buf, " worker id:%d", r.WorkerID)
+	case r.Action == types.Expire:
+		buf.WriteString(" sweeper")
+	case r.Action == types.Evict:
+		buf.WriteString(" evictor")
+	}
+	fmt.Fprintf(buf, " performed action:%s", r.Action)
+	if r.Key != "" {
+		fmt.Fprintf(buf, " key:%s", r.Key)
+	}
+	if r.Value != "" {
+		fmt.Fprintf(buf, " value:%s", r.Value)
+	}
+	if r.TTL > 0 {
+		fmt.Fprintf(buf, " ttl:%dms", r.TTL)
+	}
+	if r.Version > 0 {
+		fmt.Fprintf(buf, " version:%d", r.Version)
+	}
+	if r.Action == types.GetAll || r.Action == types.Txn {
+		items := make([]string, 0, len(r.Items))
+		for _, _item := range r.Items {
+			items = append(items, _item.Key+"="+_item.Value)
+		}
+		fmt.Fprintf(buf, " items:[%s] itemsLength:%d", strings.Join(items, " "), len(r.Items))
+	}
+	fmt.Fprintf(buf, " status:%s", r.Status)
+	if r.Error != "" {
+		fmt.Fprintf(buf, " error:%q", r.Error)
+	}
+	fmt.Fprintf(buf, " latency:%s\n", r.Latency)
+	return nil
+}
+
+// emptyFunc returns the func reporting whether nothing is written to the output yet. an output reporting its size
+// (e.g. a rotating file) is checked on every write, so every segment starts with the header. a file is checked once
+// and the other outputs are considered empty until the first write
+func emptyFunc(w io.Writer) func() bool {
+	if sized, ok := w.(interface{ Size() int64 }); ok {
+		return func() bool { return sized.Size() == 0 }
+	}
+	empty := true
+	if f, ok := w.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil {
+			empty = info.Size() == 0
+		}
+	}
+	return func() bool {
+		wasEmpty := empty
+		empty = false
+		return wasEmpty
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/helper"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestResultWriter(t *testing.T) {
+	at := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	results := []*Result{
+		{Time: at, WorkerID: 1, Action: types.AddItem, Key: "a", Value: "1", TTL: 100, Version: 2, Status: types.StatusOK, Latency: time.Microsecond},
+		{Time: at, WorkerID: 2, Action: types.GetAll, Items: []types.Item{{Key: "a", Value: "1", Timestamp: at}}, Status: types.StatusOK, Latency: 2 * time.Microsecond},
+		{Time: at, Action: types.Expire, Key: "a", Value: "1", Status: types.StatusOK},
+		{Time: at, WorkerID: 3, Action: types.RemoveItem, Key: "b", Status: types.StatusError, Error: "disk, full"},
+		{Time: at, WorkerID: 1, Action: types.CompareAndSwap, Key: "a", Value: "2", Version: 3, Status: types.StatusConflict},
+	}
+	write := func(format OutputFormat) string {
+		t.Helper()
+		var buf bytes.Buffer
+		w, err := NewResultWriter(&buf, format)
+		assert.Equal(t, nil, err)
+		for _, result := range results {
+			assert.Equal(t, nil, w.WriteResult(result))
+		}
+		return buf.String()
+	}
+
+	// every line is a json object
+	lines := strings.Split(strings.TrimSpace(write(OutputJSON)), "\n")
+	assert.Equal(t, len(results), len(lines))
+	for i, line := range lines {
+		var result Result
+		assert.Equal(t, nil, json.Unmarshal([]byte(line), &result))
+		assert.Equal(t, results[i].Action, result.Action)
+		assert.Equal(t, results[i].Latency, result.Latency)
+	}
+	assert.Equal(t, `{"time":"2023-05-01T10:00:00Z","workerId":2,"action":"getall","items":[{"key":"a","value":"1","timestamp":"2023-05-01T10:00:00Z"}],"status":"ok","latencyNs":2000}`, lines[1])
+
+	assert.Equal(t, `time,workerId,action,key,value,ttl,version,items,status,error,latencyNs
+2023-05-01T10:00:00Z,1,add,a,1,100,2,,ok,,1000
+2023-05-01T10:00:00Z,2,getall,,,,,"[{""key"":""a"",""value"":""1"",""timestamp"":""2023-05-01T10:00:00Z""}]",ok,,2000
+2023-05-01T10:00:00Z,,expire,a,1,,,,ok,,0
+2023-05-01T10:00:00Z,3,remove,b,,,,,error,"disk, full",0
+2023-05-01T10:00:00Z,1,cas,a,2,,3,,conflict,,0
+`, write(OutputCSV))
+
+	assert.Equal(t, `2023/05/01 10:00:00.000000 worker id:1 performed action:add key:a value:1 ttl:100ms version:2 status:ok latency:1µs
+2023/05/01 10:00:00.000000 worker id:2 performed action:getall items:[a=1] itemsLength:1 status:ok latency:2µs
+2023/05/01 10:00:00.000000 sweeper performed action:expire key:a value:1 status:ok latency:0s
+2023/05/01 10:00:00.000000 worker id:3 performed action:remove key:b status:error error:"disk, full" latency:0s
+2023/05/01 10:00:00.000000 worker id:1 performed action:cas key:a value:2 version:3 status:conflict latency:0s
+`, write(OutputText))
+
+	_, err := NewResultWriter(&bytes.Buffer{}, "xml")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestResultWriter_CSVHeader(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "output.csv")
+	// header is written only once, appending to the output after a restart does not repeat it
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o664)
+		assert.Equal(t, nil, err)
+		w, err := NewResultWriter(f, OutputCSV)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, nil, w.WriteResult(&Result{Action: types.GetItem, Key: "a", Status: types.StatusKeyNotFound}))
+		assert.Equal(t, nil, f.Close())
+	}
+	data, err := os.ReadFile(name)
+	assert.Equal(t, nil, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, strings.Join(csvHeader, ","), lines[0])
+}
+
+func TestResultWriter_CSVRotation(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "output.csv")
+	// every result fills up a segment, so every segment starts with the header
+	f, err := helper.OpenRotatingFile(zap.NewNop(), name, helper.RotateOptions{MaxSize: 1})
+	assert.Equal(t, nil, err)
+	w, err := NewResultWriter(f, OutputCSV)
+	assert.Equal(t, nil, err)
+	for _, key := range []string{"a", "b"} {
+		assert.Equal(t, nil, w.WriteResult(&Result{Action: types.GetItem, Key: key, Status: types.StatusKeyNotFound}))
+	}
+	assert.Equal(t, nil, f.Close())
+	segments, err := helper.Segments(name)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(segments))
+	for _, segment := range segments {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(name), segment.Name))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, strings.Join(csvHeader, ","), strings.Split(string(data), "\n")[0])
+	}
+}
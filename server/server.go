@@ -2,33 +2,75 @@ package server
 
 import (
 	"context"
-	"io"
-	"log"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bhakiyakalimuthu/server-clique/queue"
 	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+const tracerName = "github.com/bhakiyakalimuthu/server-clique/server"
+
 type Server struct {
 	logger *zap.Logger
 	queue  queue.Queue
 	store  Store
 	file   *os.File
-	cChan  chan *types.Message // consumer channel
+	// results of the processed messages are written to the output
+	results ResultWriter
+	// consumer channels, one per worker. messages are partitioned by key,
+	// so the operations on the same key are applied in publish order
+	partitions []chan task
+	closeOnce  sync.Once
+	// stopped is closed once the workers are stopped, dispatchMu keeps the partitions open while a message is sent
+	stopped    chan struct{}
+	dispatchMu sync.RWMutex
+	// txnMu orders the txns spanning several partitions the same way in every partition they are sent to
+	txnMu sync.Mutex
+	// owners are held by the worker of the partition while it applies a message, the evictions and expirations
+	// of the keys of the partition are published with it held so they are ordered with the writes of the key
+	owners []sync.Mutex
+	// evictions are the items evicted by the store, published by the worker whose write evicted them
+	evictionsMu sync.Mutex
+	evictions   []item
+	next        uint32 // round robin counter for the messages without key
+	watchers    watchHub
+	health      health
+	// failed message is requeued up to maxRetries times, then it is dead lettered
+	maxRetries int
 }
 
-func New(logger *zap.Logger, writer io.Writer, queue queue.Queue, store Store, cChan chan *types.Message) *Server {
-	log.SetOutput(writer)
-	log.SetFlags(log.LstdFlags | log.LUTC | log.Lmicroseconds)
-	return &Server{
-		logger: logger,
-		queue:  queue,
-		store:  store,
-		cChan:  cChan,
+func New(logger *zap.Logger, results ResultWriter, queue queue.Queue, store Store, workerPoolSize int) *Server {
+	partitions := make([]chan task, workerPoolSize)
+	for i := range partitions {
+		partitions[i] = make(chan task, 1)
+	}
+	s := &Server{
+		logger:     logger,
+		queue:      queue,
+		store:      store,
+		results:    results,
+		partitions: partitions,
+		stopped:    make(chan struct{}),
+		owners:     make([]sync.Mutex, workerPoolSize),
+		health:     newHealth(workerPoolSize),
+		maxRetries: 1,
+	}
+	if notifier, ok := store.(EvictionNotifier); ok {
+		notifier.OnEvict(s.evicted)
 	}
+	return s
 }
 
 func (s *Server) Start(ctx context.Context) error {
@@ -38,19 +80,28 @@ func (s *Server) Start(ctx context.Context) error {
 		s.logger.Error("failed to consume message", zap.Error(err))
 		return err
 	}
+	atomic.StoreInt32(&s.health.consuming, 1)
 	defer func() {
-		close(s.cChan)  // close consumer channel
-		s.file.Close()  // close opened file
-		s.queue.Close() // gracefully close the connection
+		atomic.StoreInt32(&s.health.consuming, 0)
+		s.closePartitions() // close consumer channels
+		s.file.Close()      // close opened file
 	}()
 	for {
 		select {
-		case msg := <-pChan:
-			select {
-			case <-ctx.Done():
+		case msg, ok := <-pChan:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("queue consumer channel closed")
+			}
+			// blocks until the worker is free, unacknowledged messages are held back by the broker meanwhile
+			dispatch := s.Dispatch
+			if msg.Action == types.Batch {
+				dispatch = s.dispatchBatch
+			}
+			if err := dispatch(ctx, msg); err != nil {
 				return nil
-			case s.cChan <- msg:
-			default:
 			}
 
 		case <-ctx.Done():
@@ -59,39 +110,619 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
+// SetMaxRetries sets how many times a failed message is requeued before it is dead lettered,
+// it has to be set before the workers are started
+func (s *Server) SetMaxRetries(maxRetries int) {
+	s.maxRetries = maxRetries
+}
+
+// ErrServerStopped is returned by Dispatch once the workers are stopped, e.g. the api requests made while shutting down
+var ErrServerStopped = errors.New("server is stopped")
+
+// Dispatch routes the message to the worker owning its key, blocks until the worker accepts it
+// or the context is done. the dispatch span continues the trace of the message, or of the context
+// if the message carries none (e.g. the api requests)
+func (s *Server) Dispatch(ctx context.Context, msg *types.Message) error {
+	partitions := s.partitionsOf(msg)
+	// the message is applied by the worker of the last partition
+	partition := partitions[len(partitions)-1]
+	ctx, span := otel.Tracer(tracerName).Start(queue.Extract(ctx, msg), "dispatch "+msg.Action.String(),
+		trace.WithAttributes(attribute.Int("clique.partition", partition)))
+	defer span.End()
+	queue.Inject(ctx, msg)
+	s.dispatchMu.RLock()
+	defer s.dispatchMu.RUnlock()
+	err := s.dispatch(ctx, partitions, msg)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// dispatch sends the message to the worker of the last partition. a txn spanning several partitions holds
+// the workers of the other ones at a barrier until it is applied, so it is ordered with the messages of all its keys
+func (s *Server) dispatch(ctx context.Context, partitions []int, msg *types.Message) error {
+	select {
+	case <-s.stopped:
+		return ErrServerStopped
+	default:
+	}
+	last := len(partitions) - 1
+	if last == 0 {
+		return s.send(ctx, partitions[0], task{msg: msg})
+	}
+	// every partition gets the barriers in the same order, so the held workers never wait for each other in a cycle
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	barrier := newTxnBarrier(partitions)
+	for _, partition := range partitions[:last] {
+		if err := s.send(ctx, partition, task{barrier: barrier}); err != nil {
+			// the txn is not dispatched, the workers held already are released
+			barrier.release()
+			return err
+		}
+	}
+	if err := s.send(ctx, partitions[last], task{msg: msg, barrier: barrier}); err != nil {
+		barrier.release()
+		return err
+	}
+	return nil
+}
+
+func (s *Server) send(ctx context.Context, partition int, t task) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.stopped:
+		return ErrServerStopped
+	case s.partitions[partition] <- t:
+		return nil
+	}
+}
+
+// task is a message sent to a worker, or a barrier holding the worker while a txn spanning its partition is applied
+type task struct {
+	msg     *types.Message
+	barrier *txnBarrier
+}
+
+// txnBarrier holds the workers of the partitions of a txn, the worker applying the txn waits for all of them
+type txnBarrier struct {
+	partitions []int // partitions of the txn in ascending order, the last one applies it
+	arrived    sync.WaitGroup
+	done       chan struct{}
+}
+
+func newTxnBarrier(partitions []int) *txnBarrier {
+	b := &txnBarrier{partitions: partitions, done: make(chan struct{})}
+	b.arrived.Add(len(partitions) - 1)
+	return b
+}
+
+// hold is called by the held worker, it returns once the txn is applied
+func (b *txnBarrier) hold() {
+	b.arrived.Done()
+	<-b.done
+}
+
+// wait returns once all the held workers reached the barrier
+func (b *txnBarrier) wait() {
+	b.arrived.Wait()
+}
+
+func (b *txnBarrier) release() {
+	close(b.done)
+}
+
+// Do applies the message through the workers and waits for the response, so the requests made in process
+// (e.g. by the http api) are ordered with the queue messages of the same key and logged the same way
+func (s *Server) Do(ctx context.Context, msg *types.Message) (*types.Response, error) {
+	local := &localRequest{done: make(chan struct{})}
+	msg.Acknowledger = local
+	if err := s.Dispatch(ctx, msg); err != nil {
+		return nil, err
+	}
+	select {
+	case <-local.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if local.err != nil {
+		return nil, local.err
+	}
+	return local.resp, nil
+}
+
+var errProcessingFailed = errors.New("failed to process message")
+
+// localRequest is the reply path of Do, worker sets the response before settling the message
+type localRequest struct {
+	resp *types.Response
+	err  error
+	done chan struct{}
+}
+
+func (l *localRequest) Ack() error {
+	close(l.done)
+	return nil
+}
+
+// Nack reports the failure to the caller, there is no broker to requeue the message to
+func (l *localRequest) Nack(bool) error {
+	l.err = errProcessingFailed
+	close(l.done)
+	return nil
+}
+
+// DeadLetter completes the request, there is no dead letter queue and the caller has the response already
+func (l *localRequest) DeadLetter(string, error) error {
+	close(l.done)
+	return nil
+}
+
+// partitionsOf returns the partitions owning the keys of the message in ascending order, the partitions
+// of the keys of its ops for a txn
+func (s *Server) partitionsOf(msg *types.Message) []int {
+	if msg.Action != types.Txn || len(msg.Ops) == 0 {
+		return []int{s.partitionOf(msg)}
+	}
+	owned := make([]bool, len(s.partitions))
+	for _, op := range msg.Ops {
+		owned[s.partitionOfKey(op.Key)] = true
+	}
+	partitions := make([]int, 0, len(msg.Ops))
+	for partition, ok := range owned {
+		if ok {
+			partitions = append(partitions, partition)
+		}
+	}
+	return partitions
+}
+
+func (s *Server) partitionOf(msg *types.Message) int {
+	if msg.Key == "" {
+		// getall and unknown actions have no ordering requirement, spread them across the workers
+		return int(atomic.AddUint32(&s.next, 1) % uint32(len(s.partitions)))
+	}
+	return s.partitionOfKey(msg.Key)
+}
+
+func (s *Server) partitionOfKey(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.partitions)))
+}
+
+// closePartitions stops the workers once the messages already dispatched are processed,
+// the blocked and later dispatches fail with ErrServerStopped
+func (s *Server) closePartitions() {
+	s.closeOnce.Do(func() {
+		close(s.stopped)
+		s.dispatchMu.Lock()
+		defer s.dispatchMu.Unlock()
+		for _, partition := range s.partitions {
+			close(partition)
+		}
+	})
+}
+
+// Process applies the messages of the partition owned by the worker, worker ids are expected
+// to be consecutive so every partition is owned by a worker
 func (s *Server) Process(ctx context.Context, wg *sync.WaitGroup, workerID int) {
+	partition := workerID % len(s.partitions)
 	defer func() {
+		s.heartbeat(partition, time.Time{})
 		s.logger.Warn("worker exiting!!!", zap.Int("workerID", workerID))
 		wg.Done()
 	}()
-	for msg := range s.cChan {
+	// idle worker keeps the heartbeat fresh, a worker busy with one message for too long is reported stuck
+	ticker := time.NewTicker(s.health.interval)
+	defer ticker.Stop()
+	for {
+		s.heartbeat(partition, time.Now())
+		var t task
+		select {
+		case <-ticker.C:
+			continue
+		case next, ok := <-s.partitions[partition]:
+			if !ok {
+				return
+			}
+			t = next
+		}
+		msg := t.msg
+		if msg == nil && t.barrier != nil {
+			// a txn on the keys of the partition is applied by another worker meanwhile
+			t.barrier.hold()
+			continue
+		}
 		if msg == nil {
 			// handle edge case, when the connection is closed nil might get passed
 			s.logger.Debug("received nil msg value")
 			return
 		}
-		switch msg.Action {
-		case types.AddItem:
-			s.store.Add(ctx, msg.Key, msg.Value, msg.Timestamp)
-			log.Printf("worker id:%d performed action:%s key:%s value:%s\n", workerID, msg.Action.String(), msg.Key, msg.Value)
-		case types.RemoveItem:
-			if ok := s.store.Remove(ctx, msg.Key); !ok {
-				s.logger.Error("key not found", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key))
-				continue
+		start := time.Now()
+		msgCtx, span := otel.Tracer(tracerName).Start(queue.Extract(ctx, msg), "process "+msg.Action.String(),
+			trace.WithAttributes(attribute.Int("clique.worker", workerID)))
+		owned := []int{partition}
+		if t.barrier != nil {
+			// the held workers own no lock, so the owners are taken once all of them reached the barrier
+			t.barrier.wait()
+			owned = t.barrier.partitions
+		}
+		s.lockOwners(owned)
+		resp, err := s.handle(msgCtx, workerID, msg)
+		s.unlockOwners(owned)
+		if t.barrier != nil {
+			t.barrier.release()
+		}
+		s.publishEvictions(ctx)
+		s.writeResult(workerID, msg, resp, err, time.Since(start))
+		if resp != nil {
+			span.SetAttributes(attribute.String("clique.status", resp.Status.String()))
+		}
+		span.End()
+		if err != nil {
+			s.logger.Error("failed to process message", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key), zap.Int("retries", msg.Retries), zap.Error(err))
+			s.fail(workerID, msg, err)
+			continue
+		}
+		s.respond(workerID, msg, resp)
+		if reason := unprocessableReasons[resp.Status]; reason != "" {
+			// message would fail again, it is kept in the dead letter queue instead
+			if err := msg.DeadLetter(reason, unprocessable(msg, resp)); err != nil {
+				s.logger.Error("failed to dead letter message", zap.Int("workerID", workerID), zap.Error(err))
 			}
-			log.Printf("worker id:%d performed action:%s key:%s\n", workerID, msg.Action.String(), msg.Key)
-		case types.GetItem:
-			val, ok := s.store.Get(ctx, msg.Key)
-			if !ok {
-				s.logger.Error("key not found", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key))
-				continue
+			continue
+		}
+		// acknowledge only after the message is applied to the store
+		if err := msg.Ack(); err != nil {
+			s.logger.Error("failed to ack message", zap.Int("workerID", workerID), zap.Error(err))
+		}
+	}
+}
+
+// fail requeues the message which failed to be processed, it is dead lettered once it failed more than
+// the max retries. the failure of the in process requests is reported to the caller
+func (s *Server) fail(workerID int, msg *types.Message, err error) {
+	if _, local := msg.Acknowledger.(*localRequest); local || msg.Retries < s.maxRetries {
+		if err := msg.Nack(true); err != nil {
+			s.logger.Error("failed to nack message", zap.Int("workerID", workerID), zap.Error(err))
+		}
+		return
+	}
+	if _, ok := msg.Acknowledger.(types.DeadLetterer); !ok {
+		// the queue has no dead letter queue, the message is rejected
+		droppedTotal.WithLabelValues(dropRedeliveryFailed).Inc()
+	}
+	if err := msg.DeadLetter(queue.ReasonRetriesExceeded, err); err != nil {
+		s.logger.Error("failed to dead letter message", zap.Int("workerID", workerID), zap.Error(err))
+	}
+}
+
+// unprocessableReasons are the dead letter reasons of the responses of the messages which would fail again
+var unprocessableReasons = map[types.Status]string{
+	types.StatusUnknownAction: queue.ReasonUnknownAction,
+	types.StatusTooLarge:      queue.ReasonTooLarge,
+}
+
+// tooLarge tells whether the write was refused for its size, it is not retried as it would be refused again
+func tooLarge(err error) bool {
+	return errors.Is(err, ErrItemTooLarge) || errors.Is(err, ErrRecordTooLarge)
+}
+
+// unprocessable returns the reason of the unprocessable response
+func unprocessable(msg *types.Message, resp *types.Response) error {
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return fmt.Errorf("unknown action %q", msg.Action)
+}
+
+// handle applies the message to the store, a panic while applying is reported as error as well
+func (s *Server) handle(ctx context.Context, workerID int, msg *types.Message) (resp *types.Response, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "store "+msg.Action.String(),
+		trace.WithAttributes(attribute.String("clique.key", msg.Key)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while processing message: %v", r)
+		}
+	}()
+	resp = &types.Response{Action: msg.Action, Key: msg.Key, Status: types.StatusOK}
+	switch msg.Action {
+	case types.AddItem, types.CompareAndSwap, types.AddIfAbsent:
+		var expiresAt time.Time
+		if msg.TTL > 0 {
+			expiresAt = time.Now().Add(time.Duration(msg.TTL) * time.Millisecond)
+		}
+		old := s.oldValue(ctx, msg.Key)
+		version, err := s.store.Add(ctx, msg.Key, msg.Value, msg.Timestamp, expiresAt, conditionOf(msg))
+		resp.Version = version
+		if errors.Is(err, ErrConflict) {
+			s.logger.Warn("condition does not hold", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key), zap.Uint64("version", version))
+			resp.Status = types.StatusConflict
+			break
+		}
+		if tooLarge(err) {
+			s.logger.Error("item is too large", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key), zap.Error(err))
+			resp.Status, resp.Error = types.StatusTooLarge, err.Error()
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// conditional writes are watched as plain adds and removes
+		s.watchers.publish(types.Event{Action: types.AddItem, Key: msg.Key, Value: msg.Value, OldValue: old, Timestamp: msg.Timestamp, Origin: msg.AppID})
+	case types.RemoveItem, types.RemoveIfValue:
+		old := s.oldValue(ctx, msg.Key)
+		version, ok, err := s.store.Remove(ctx, msg.Key, conditionOf(msg))
+		resp.Version = version
+		if errors.Is(err, ErrConflict) {
+			s.logger.Warn("condition does not hold", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key), zap.Uint64("version", version))
+			resp.Status = types.StatusConflict
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			s.logger.Error("key not found", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key))
+			resp.Status = types.StatusKeyNotFound
+			break
+		}
+		s.watchers.publish(types.Event{Action: types.RemoveItem, Key: msg.Key, OldValue: old, Timestamp: time.Now(), Origin: msg.AppID})
+	case types.GetItem:
+		val, ok := s.store.Get(ctx, msg.Key)
+		if !ok {
+			s.logger.Error("key not found", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("key", msg.Key))
+			resp.Status = types.StatusKeyNotFound
+			break
+		}
+		resp.Value = val
+		// read on the worker owning the key, so it is the version of the value unless the key expired meanwhile
+		if current, ok := s.store.Lookup(ctx, msg.Key); ok {
+			resp.Version = current.version
+		}
+	case types.Txn:
+		transactor, ok := s.store.(Transactor)
+		if !ok {
+			s.logger.Error("store does not support transactions", zap.Int("workerID", workerID))
+			resp.Status = types.StatusNotSupported
+			break
+		}
+		ops, err := txnOps(msg)
+		if err != nil {
+			s.logger.Error("invalid txn", zap.Int("workerID", workerID), zap.Error(err))
+			resp.Status, resp.Error = types.StatusUnknownAction, err.Error()
+			break
+		}
+		old := s.oldValues(ctx, ops)
+		versions, err := transactor.Txn(ctx, ops)
+		var conflict *txnConflict
+		if errors.As(err, &conflict) {
+			s.logger.Warn("condition does not hold", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.Int("op", conflict.op), zap.String("key", conflict.key), zap.Uint64("version", conflict.version))
+			resp.Status, resp.Error, resp.Key, resp.Version = types.StatusConflict, conflict.Error(), conflict.key, conflict.version
+			break
+		}
+		if errors.Is(err, ErrNotSupported) {
+			s.logger.Error("store does not support transactions", zap.Int("workerID", workerID))
+			resp.Status = types.StatusNotSupported
+			break
+		}
+		if tooLarge(err) {
+			s.logger.Error("txn is too large", zap.Int("workerID", workerID), zap.Error(err))
+			resp.Status, resp.Error = types.StatusTooLarge, err.Error()
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Items = make([]types.Item, 0, len(ops))
+		events := make([]types.Event, 0, len(ops))
+		for i, op := range ops {
+			resp.Items = append(resp.Items, types.Item{Key: op.key, Value: op.value, Timestamp: msg.Timestamp, Version: versions[i]})
+			switch {
+			case !op.remove:
+				events = append(events, types.Event{Action: types.AddItem, Key: op.key, Value: op.value, OldValue: old[op.key], Timestamp: msg.Timestamp, Origin: msg.AppID})
+				old[op.key] = op.value
+			case versions[i] > 0: // removing a missing key is a noop
+				events = append(events, types.Event{Action: types.RemoveItem, Key: op.key, OldValue: old[op.key], Timestamp: time.Now(), Origin: msg.AppID})
+				delete(old, op.key)
+			}
+		}
+		s.watchers.publish(events...)
+	case types.GetAll:
+		resp.Items = toItems(s.store.GetAll(ctx))
+	case types.Snapshot:
+		err := ErrNotSupported
+		if snapshotter, ok := s.store.(Snapshotter); ok {
+			err = snapshotter.Snapshot(ctx)
+		}
+		if errors.Is(err, ErrNotSupported) {
+			s.logger.Error("store does not support snapshots", zap.Int("workerID", workerID))
+			resp.Status = types.StatusNotSupported
+			break
+		}
+		// failed snapshot is not retried, previous snapshot and the log are still intact
+		if err != nil {
+			s.logger.Error("failed to take snapshot", zap.Int("workerID", workerID), zap.Error(err))
+			resp.Status, resp.Error = types.StatusError, err.Error()
+		}
+	default:
+		s.logger.Error("unknown action", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()))
+		resp.Status = types.StatusUnknownAction
+	}
+	return resp, nil
+}
+
+// conditionOf returns the condition of the conditional write actions, the other actions are unconditional
+func conditionOf(msg *types.Message) condition {
+	switch msg.Action {
+	case types.CompareAndSwap:
+		return ifVersion(msg.Version)
+	case types.AddIfAbsent:
+		return ifVersion(0)
+	case types.RemoveIfValue:
+		return ifValue(msg.Value)
+	default:
+		return condition{}
+	}
+}
+
+// oldValue reads the value before the mutation when it is watched. it is read on the worker owning the key,
+// so no other message of the key is applied in between
+func (s *Server) oldValue(ctx context.Context, key string) string {
+	if !s.watchers.active() {
+		return ""
+	}
+	value, _ := peek(ctx, s.store, key)
+	return value
+}
+
+// oldValues reads the values of the keys of a txn before it is applied when they are watched, the workers
+// owning the keys are held meanwhile so no other message of the keys is applied in between
+func (s *Server) oldValues(ctx context.Context, ops []txnOp) map[string]string {
+	old := make(map[string]string, len(ops))
+	if !s.watchers.active() {
+		return old
+	}
+	for _, op := range ops {
+		if _, ok := old[op.key]; !ok {
+			old[op.key], _ = peek(ctx, s.store, op.key)
+		}
+	}
+	return old
+}
+
+// writeResult writes the outcome of the message to the output and the metrics, a failed message is written
+// with the error status
+func (s *Server) writeResult(workerID int, msg *types.Message, resp *types.Response, err error, latency time.Duration) {
+	result := &Result{Time: time.Now(), WorkerID: workerID, Action: msg.Action, Key: msg.Key, Latency: latency}
+	if err != nil {
+		result.Status, result.Error = types.StatusError, err.Error()
+	} else {
+		result.Status, result.Error, result.Value, result.Items, result.Version = resp.Status, resp.Error, resp.Value, resp.Items, resp.Version
+		switch msg.Action {
+		case types.AddItem, types.CompareAndSwap, types.AddIfAbsent:
+			result.Value, result.TTL = msg.Value, msg.TTL
+		case types.RemoveIfValue:
+			result.Value = msg.Value
+		}
+	}
+	observe(result)
+	s.write(result)
+}
+
+// observe counts the processed message, unknown actions share a label so the clients cannot blow up the series
+func observe(result *Result) {
+	action := result.Action.String()
+	if result.Status == types.StatusUnknownAction {
+		action = "unknown"
+	}
+	processedTotal.WithLabelValues(action, result.Status.String()).Inc()
+	processingSeconds.WithLabelValues(action).Observe(result.Latency.Seconds())
+	workerBusySeconds.WithLabelValues(strconv.Itoa(result.WorkerID)).Add(result.Latency.Seconds())
+}
+
+func (s *Server) write(result *Result) {
+	if err := s.results.WriteResult(result); err != nil {
+		s.logger.Error("failed to write result", zap.String("action", result.Action.String()), zap.String("key", result.Key), zap.Error(err))
+	}
+}
+
+// lockOwners takes the owners of the partitions, they are given in ascending order
+func (s *Server) lockOwners(partitions []int) {
+	for _, partition := range partitions {
+		s.owners[partition].Lock()
+	}
+}
+
+func (s *Server) unlockOwners(partitions []int) {
+	for _, partition := range partitions {
+		s.owners[partition].Unlock()
+	}
+}
+
+// evicted keeps the item evicted by a bounded store, it is called by the worker whose write evicted it while
+// the worker holds its owner, so the eviction is published once the worker released it
+func (s *Server) evicted(_item item) {
+	removedTotal.WithLabelValues(types.Evict.String()).Inc()
+	s.evictionsMu.Lock()
+	s.evictions = append(s.evictions, _item)
+	s.evictionsMu.Unlock()
+}
+
+// publishEvictions writes the evicted keys to the output the same way as the removes
+func (s *Server) publishEvictions(ctx context.Context) {
+	s.evictionsMu.Lock()
+	evictions := s.evictions
+	s.evictions = nil
+	s.evictionsMu.Unlock()
+	for _, _item := range evictions {
+		s.removed(ctx, types.Evict, _item, time.Now())
+	}
+}
+
+// removed publishes the eviction or expiration of the item with the owner of the key held, so it is ordered with
+// the writes of the key. no event is published if the key was added again meanwhile, its add is published already
+func (s *Server) removed(ctx context.Context, action types.Action, _item item, at time.Time) {
+	owner := &s.owners[s.partitionOfKey(_item.key)]
+	owner.Lock()
+	if _, ok := s.store.Lookup(ctx, _item.key); !ok {
+		s.watchers.publish(types.Event{Action: action, Key: _item.key, OldValue: _item.value, Timestamp: at})
+	}
+	owner.Unlock()
+	s.write(&Result{Time: at, Action: action, Key: _item.key, Value: _item.value, Status: types.StatusOK})
+}
+
+// Sweep evicts the expired keys every interval until the context is done
+func (s *Server) Sweep(ctx context.Context, interval time.Duration) {
+	expirer, ok := s.store.(Expirer)
+	if !ok {
+		s.logger.Warn("store does not support expiration, sweeper is not started")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired := expirer.Expire(ctx, now)
+			removedTotal.WithLabelValues(types.Expire.String()).Add(float64(len(expired)))
+			for _, _item := range expired {
+				s.removed(ctx, types.Expire, _item, now)
 			}
-			log.Printf("worker id:%d performed action:%s key:%s value:%s\n", workerID, msg.Action.String(), msg.Key, val)
-		case types.GetAll:
-			lists := s.store.GetAll(ctx)
-			log.Printf("worker id:%d performed action:%s items:%v itemsLength:%d\n", workerID, msg.Action.String(), lists, len(lists))
-		default:
-			s.logger.Error("unknown action", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()))
 		}
 	}
 }
+
+// respond sends the response back to the client, only if the client is waiting for it
+func (s *Server) respond(workerID int, msg *types.Message, resp *types.Response) {
+	if local, ok := msg.Acknowledger.(*localRequest); ok {
+		local.resp = resp
+		return
+	}
+	if msg.ReplyTo == "" || s.queue == nil {
+		return
+	}
+	if err := s.queue.Reply(msg, resp); err != nil {
+		s.logger.Error("failed to send response", zap.Int("workerID", workerID), zap.String("action", msg.Action.String()), zap.String("correlationID", msg.CorrelationID), zap.Error(err))
+	}
+}
+
+func toItems(items []item) []types.Item {
+	out := make([]types.Item, 0, len(items))
+	for _, _item := range items {
+		out = append(out, types.Item{Key: _item.key, Value: _item.value, Timestamp: time.Unix(0, _item.timestamp), Version: _item.version})
+	}
+	return out
+}
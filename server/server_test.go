@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/bhakiyakalimuthu/server-clique/queue"
 	"github.com/bhakiyakalimuthu/server-clique/types"
 	"github.com/go-playground/assert/v2"
 	"go.uber.org/zap"
@@ -21,9 +23,8 @@ func TestServer_Process(t *testing.T) {
 	ctx := context.Background()
 	wg := new(sync.WaitGroup)
 	w := io.Discard
-	cChan := make(chan *types.Message, 1)
 
-	server := New(l, w, nil, s, cChan)
+	server := New(l, jsonResults(w), nil, s, 1)
 
 	wg.Add(1)
 	go func() {
@@ -32,7 +33,7 @@ func TestServer_Process(t *testing.T) {
 
 	t1 := time.Now()
 	msg := &types.Message{Action: "add", Key: "111", Value: "222", Timestamp: t1}
-	cChan <- msg
+	assert.Equal(t, nil, server.Dispatch(ctx, msg))
 	<-time.After(time.Millisecond * 100)
 	a1, ok := s.Get(ctx, "111")
 	assert.Equal(t, true, ok)
@@ -40,7 +41,7 @@ func TestServer_Process(t *testing.T) {
 
 	t2 := time.Now()
 	_msg := &types.Message{Action: "add", Key: "333", Value: "444", Timestamp: t2}
-	cChan <- _msg
+	assert.Equal(t, nil, server.Dispatch(ctx, _msg))
 	<-time.After(time.Millisecond * 100)
 	_actual, ok := s.Get(ctx, "333")
 	assert.Equal(t, true, ok)
@@ -50,62 +51,312 @@ func TestServer_Process(t *testing.T) {
 	assert.Equal(t, false, ok)
 	<-time.After(time.Millisecond * 100)
 	out := s.GetAll(ctx)
-	expected := []item{{key: "111", value: "222", timestamp: t1.UnixNano()}, {key: "333", value: "444", timestamp: t2.UnixNano()}}
+	expected := []item{{key: "111", value: "222", timestamp: t1.UnixNano(), version: 1}, {key: "333", value: "444", timestamp: t2.UnixNano(), version: 2}}
 	assert.Equal(t, expected, out)
 
-	close(cChan) // close the channel to signal the end of messages
-	wg.Wait()    // wait for all goroutines to finish
+	server.closePartitions() // close the channel to signal the end of messages
+	wg.Wait()                // wait for all goroutines to finish
 }
 
+// replyQueue is a queue.Queue stub which records the responses and the change events sent by the server
+type replyQueue struct {
+	mu        sync.Mutex
+	responses map[string]*types.Response
+	events    []types.Event
+}
+
+func (r *replyQueue) Publish(*types.Message) error { return nil }
+
+func (r *replyQueue) Request(context.Context, *types.Message) (*types.Response, error) {
+	return nil, nil
+}
+
+func (r *replyQueue) Reply(msg *types.Message, resp *types.Response) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses[msg.CorrelationID] = resp
+	return nil
+}
+
+func (r *replyQueue) PublishEvent(event *types.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, *event)
+	return nil
+}
+
+func (r *replyQueue) Consume(context.Context) (<-chan *types.Message, error) { return nil, nil }
+
+func (r *replyQueue) Close() error { return nil }
+
+func TestServer_ProcessReply(t *testing.T) {
+	l := zap.NewNop()
+	s := NewMemStore(l)
+	q := &replyQueue{responses: make(map[string]*types.Response)}
+
+	ctx := context.Background()
+	wg := new(sync.WaitGroup)
+	server := New(l, jsonResults(io.Discard), q, s, 1)
+	wg.Add(1)
+	go server.Process(ctx, wg, 1)
+
+	t1 := time.Now()
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: "111", Value: "222", Timestamp: t1},
+		&types.Message{Action: types.GetItem, Key: "111", ReplyTo: "client", CorrelationID: "1"},
+		&types.Message{Action: types.GetItem, Key: "333", ReplyTo: "client", CorrelationID: "2"},
+		&types.Message{Action: types.GetAll, ReplyTo: "client", CorrelationID: "3"},
+	)
+	server.closePartitions()
+	wg.Wait()
+
+	assert.Equal(t, 3, len(q.responses))
+	assert.Equal(t, &types.Response{Action: types.GetItem, Key: "111", Value: "222", Version: 1, Status: types.StatusOK}, q.responses["1"])
+	assert.Equal(t, &types.Response{Action: types.GetItem, Key: "333", Status: types.StatusKeyNotFound}, q.responses["2"])
+	assert.Equal(t, []types.Item{{Key: "111", Value: "222", Timestamp: time.Unix(0, t1.UnixNano()), Version: 1}}, q.responses["3"].Items)
+}
+
+// acknowledger records how the message delivery was settled
+type acknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *acknowledger) Ack() error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledger) Nack(requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func TestServer_ProcessAck(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	wg := new(sync.WaitGroup)
+
+	// nil store makes every write panic, which has to be reported as processing failure
+	server := New(l, jsonResults(io.Discard), nil, nil, 1)
+	wg.Add(1)
+	go server.Process(ctx, wg, 1)
+	added, failed, redelivered := new(acknowledger), new(acknowledger), new(acknowledger)
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: "111", Value: "222", Acknowledger: failed},
+		&types.Message{Action: types.AddItem, Key: "111", Value: "222", Redelivered: true, Retries: 1, Acknowledger: redelivered},
+	)
+	server.closePartitions()
+	wg.Wait()
+	assert.Equal(t, &acknowledger{nacked: true, requeued: true}, failed)
+	assert.Equal(t, &acknowledger{nacked: true, requeued: false}, redelivered)
+
+	server = New(l, jsonResults(io.Discard), nil, NewMemStore(l), 1)
+	wg.Add(1)
+	go server.Process(ctx, wg, 1)
+	dispatch(t, server, &types.Message{Action: types.AddItem, Key: "111", Value: "222", Acknowledger: added})
+	server.closePartitions()
+	wg.Wait()
+	assert.Equal(t, &acknowledger{acked: true}, added)
+}
+
+// deadLetterer records the reason the message was dead lettered for
+type deadLetterer struct {
+	acknowledger
+	reason string
+}
+
+func (d *deadLetterer) DeadLetter(reason string, _ error) error {
+	d.reason = reason
+	return nil
+}
+
+func TestServer_ProcessDeadLetter(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	wg := new(sync.WaitGroup)
+
+	server := New(l, jsonResults(io.Discard), nil, nil, 1)
+	server.SetMaxRetries(2)
+	wg.Add(1)
+	go server.Process(ctx, wg, 1)
+	retried, exceeded, unknown := new(deadLetterer), new(deadLetterer), new(deadLetterer)
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: "111", Value: "222", Retries: 1, Acknowledger: retried},
+		&types.Message{Action: types.AddItem, Key: "111", Value: "222", Retries: 2, Acknowledger: exceeded},
+		&types.Message{Action: "bogus", Key: "111", Acknowledger: unknown},
+	)
+	server.closePartitions()
+	wg.Wait()
+	assert.Equal(t, &deadLetterer{acknowledger: acknowledger{nacked: true, requeued: true}}, retried)
+	assert.Equal(t, &deadLetterer{reason: queue.ReasonRetriesExceeded}, exceeded)
+	assert.Equal(t, &deadLetterer{reason: queue.ReasonUnknownAction}, unknown)
+
+	// write larger than the store accepts is answered and dead lettered straight away, it is not retried
+	store, err := NewBoundedStore(l, NewMemStore(l), 0, 8, EvictLRU)
+	assert.Equal(t, nil, err)
+	q := &replyQueue{responses: make(map[string]*types.Response)}
+	server = New(l, jsonResults(io.Discard), q, store, 1)
+	wg.Add(1)
+	go server.Process(ctx, wg, 1)
+	tooLarge, txnTooLarge := new(deadLetterer), new(deadLetterer)
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: "111", Value: "too large", ReplyTo: "client", CorrelationID: "add", Acknowledger: tooLarge},
+		&types.Message{Action: types.Txn, Ops: []types.Op{{Action: types.AddItem, Key: "111", Value: "too large"}}, ReplyTo: "client", CorrelationID: "txn", Acknowledger: txnTooLarge},
+	)
+	server.closePartitions()
+	wg.Wait()
+	assert.Equal(t, &deadLetterer{reason: queue.ReasonTooLarge}, tooLarge)
+	assert.Equal(t, &deadLetterer{reason: queue.ReasonTooLarge}, txnTooLarge)
+	assert.Equal(t, types.StatusTooLarge, q.responses["add"].Status)
+	assert.Equal(t, types.StatusTooLarge, q.responses["txn"].Status)
+}
+
+func TestServer_ProcessKeyOrdering(t *testing.T) {
+	l := zap.NewNop()
+	s := NewMemStore(l)
+	q := &replyQueue{responses: make(map[string]*types.Response)}
+
+	ctx := context.Background()
+	wg := new(sync.WaitGroup)
+	server := New(l, jsonResults(io.Discard), q, s, benchWorkers)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(ctx, wg, i)
+	}
+
+	// every remove must find the key added right before it, other keys are interleaved to keep all the workers busy
+	const rounds = 5000
+	for i := 0; i < rounds; i++ {
+		value := strconv.Itoa(i)
+		dispatch(t, server,
+			&types.Message{Action: types.AddItem, Key: "hot", Value: value, Timestamp: time.Now()},
+			&types.Message{Action: types.AddItem, Key: "cold-" + value, Value: value, Timestamp: time.Now()},
+			&types.Message{Action: types.RemoveItem, Key: "hot", ReplyTo: "client", CorrelationID: value},
+		)
+	}
+	dispatch(t, server, &types.Message{Action: types.AddItem, Key: "hot", Value: "last", Timestamp: time.Now()})
+	server.closePartitions()
+	wg.Wait()
+
+	assert.Equal(t, rounds, len(q.responses))
+	for _, resp := range q.responses {
+		assert.Equal(t, types.StatusOK, resp.Status)
+	}
+	value, ok := s.Get(ctx, "hot")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "last", value)
+}
+
+func TestServer_Start(t *testing.T) {
+	l := zap.NewNop()
+	s := NewMemStore(l)
+	// client and server are connected through the in-process queue, no broker is needed
+	q := queue.NewMemory(l, t.Name())
+	client := queue.NewMemory(l, t.Name())
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	server := New(l, jsonResults(io.Discard), q, s, benchWorkers)
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start(ctx)
+	}()
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(ctx, wg, i)
+	}
+
+	request := func(msg *types.Message) *types.Response {
+		t.Helper()
+		reqCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		resp, err := client.Request(reqCtx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: "111", Value: "222"}))
+	assert.Equal(t, nil, client.Publish(&types.Message{Action: types.AddItem, Key: "333", Value: "444"}))
+	assert.Equal(t, nil, client.Publish(&types.Message{Action: types.RemoveItem, Key: "333"}))
+	// the get of a key is processed after the earlier messages of the same key
+	resp := request(&types.Message{Action: types.GetItem, Key: "111"})
+	assert.Equal(t, types.StatusOK, resp.Status)
+	assert.Equal(t, "222", resp.Value)
+	resp = request(&types.Message{Action: types.GetItem, Key: "333"})
+	assert.Equal(t, types.StatusKeyNotFound, resp.Status)
+	resp = request(&types.Message{Action: types.GetAll})
+	assert.Equal(t, 1, len(resp.Items))
+	assert.Equal(t, "111", resp.Items[0].Key)
+
+	cancel()
+	assert.Equal(t, nil, <-started)
+	wg.Wait()
+	assert.Equal(t, nil, q.Close())
+
+	// the apis are still serving once the consumer stopped, their requests fail instead of panicking
+	_, err := server.Do(context.Background(), &types.Message{Action: types.GetItem, Key: "111"})
+	assert.Equal(t, ErrServerStopped, err)
+}
+
+func dispatch(t *testing.T, server *Server, msgs ...*types.Message) {
+	t.Helper()
+	for _, msg := range msgs {
+		if err := server.Dispatch(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// benchWorkers is the worker pool size used by the server
+const benchWorkers = 5
+
 func BenchmarkServer_Memstore(b *testing.B) {
 	l := zap.NewNop()
 	writer := io.Discard
 	store := NewMemStore(l)
-	cChan := make(chan *types.Message)
-
-	server := New(l, writer, nil, store, cChan)
+	server := New(l, jsonResults(writer), nil, store, benchWorkers)
 
 	ctx := context.Background()
 	var wg sync.WaitGroup
 
 	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
+	for i := 1; i <= benchWorkers; i++ {
 		wg.Add(1)
 		go server.Process(ctx, &wg, i)
 	}
 	msg := genMessage()
 	// Simulate sending messages to the server
 	for i := 0; i < b.N; i++ {
-		cChan <- msg[i] // create a test message
+		_ = server.Dispatch(ctx, msg[i]) // create a test message
 	}
 
-	close(cChan) // close the channel to signal the end of messages
-	wg.Wait()    // wait for all goroutines to finish
+	server.closePartitions() // close the channel to signal the end of messages
+	wg.Wait()                // wait for all goroutines to finish
 }
 
 func BenchmarkServer_MemstoreOptimised(b *testing.B) {
 	l := zap.NewNop()
 	writer := io.Discard
 	store := NewMemStoreOptimised(l)
-	cChan := make(chan *types.Message)
-
-	server := New(l, writer, nil, store, cChan)
+	server := New(l, jsonResults(writer), nil, store, benchWorkers)
 
 	ctx := context.Background()
 	var wg sync.WaitGroup
 
 	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
+	for i := 1; i <= benchWorkers; i++ {
 		wg.Add(1)
 		go server.Process(ctx, &wg, i)
 	}
 	msg := genMessage()
 	// Simulate sending messages to the server
 	for i := 0; i < b.N; i++ {
-		cChan <- msg[i] // create a test message
+		_ = server.Dispatch(ctx, msg[i]) // create a test message
 	}
 
-	close(cChan) // close the channel to signal the end of messages
+	server.closePartitions() // close the channel to signal the end of messages
 
 	wg.Wait() // wait for all goroutines to finish
 }
@@ -166,3 +417,12 @@ func genMessage() []*types.Message {
 	}
 	return testMessages
 }
+
+// jsonResults writes the results as ndjson
+func jsonResults(w io.Writer) ResultWriter {
+	results, err := NewResultWriter(w, OutputJSON)
+	if err != nil {
+		panic(err)
+	}
+	return results
+}
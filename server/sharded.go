@@ -0,0 +1,345 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ShardedStore spreads the keys over lock striped shards, so operations on different shards do not contend.
+// every add takes a global sequence number and GetAll merges the shards by it, so the items are returned in insertion order
+type ShardedStore struct {
+	logger *zap.Logger
+	seq    uint64 // last sequence number, updated atomically
+	// version is the last version given to an item, updated atomically. it is shared by the shards,
+	// so a removed key never gets a version it had before whichever shard it is in
+	version uint64
+	shards  []*shard
+	// txnMu is held shared by the transactions and exclusively by GetAll, so GetAll never observes a part of a transaction.
+	// the single key writes do not take it
+	txnMu sync.RWMutex
+}
+
+// shard keeps its items in a linked list ordered by sequence number,
+// the number is taken with the shard lock held so appending to the tail keeps the order
+type shard struct {
+	mu     sync.RWMutex
+	root   *shardNode // sentinel, root.next is the oldest and root.prev is the latest item
+	cache  map[string]*shardNode
+	bytes  int64
+	expiry expiryQueue
+}
+
+type shardNode struct {
+	item
+	seq        uint64
+	prev, next *shardNode
+}
+
+var (
+	_ Store   = (*ShardedStore)(nil)
+	_ Expirer = (*ShardedStore)(nil)
+	_ Sizer   = (*ShardedStore)(nil)
+
+	_ Transactor = (*ShardedStore)(nil)
+	_ restorer   = (*ShardedStore)(nil)
+)
+
+// NewShardedStore creates the store with the given number of shards, at least one
+func NewShardedStore(logger *zap.Logger, shards int) *ShardedStore {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &ShardedStore{
+		logger: logger,
+		shards: make([]*shard, shards),
+	}
+	for i := range s.shards {
+		root := new(shardNode)
+		root.prev, root.next = root, root
+		s.shards[i] = &shard{root: root, cache: make(map[string]*shardNode)}
+	}
+	return s
+}
+
+func (s *ShardedStore) shardOf(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardedStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *ShardedStore) Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error) {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+	n, ok := sh.cache[key]
+	current, exists := sh.live(n, ok)
+	if !cond.holds(current, exists) {
+		sh.mu.Unlock()
+		return current.version, ErrConflict
+	}
+	_item := item{
+		key:       key,
+		value:     value,
+		timestamp: timestamp.UnixNano(),
+		expiresAt: unixNano(expiresAt),
+		version:   s.nextVersion(),
+	}
+	s.put(sh, _item)
+	sh.mu.Unlock()
+	sh.expiry.schedule(key, _item.expiresAt)
+	return _item.version, nil
+}
+
+// restore loads the item as it is, with its version
+func (s *ShardedStore) restore(_item item) {
+	sh := s.shardOf(_item.key)
+	sh.mu.Lock()
+	s.put(sh, _item)
+	sh.mu.Unlock()
+	sh.expiry.schedule(_item.key, _item.expiresAt)
+	s.restoreVersion(_item.version)
+}
+
+func (s *ShardedStore) lastVersion() uint64 {
+	return atomic.LoadUint64(&s.version)
+}
+
+func (s *ShardedStore) restoreVersion(version uint64) {
+	for {
+		last := atomic.LoadUint64(&s.version)
+		if last >= version || atomic.CompareAndSwapUint64(&s.version, last, version) {
+			return
+		}
+	}
+}
+
+func (s *ShardedStore) nextVersion() uint64 {
+	return atomic.AddUint64(&s.version, 1)
+}
+
+// put stores the item in the shard, must be called with the shard lock held
+func (s *ShardedStore) put(sh *shard, _item item) {
+	n, ok := sh.cache[_item.key]
+	if ok {
+		// overwritten key moves to the tail, same as a new insertion
+		sh.unlink(n)
+		sh.bytes -= n.size()
+	} else {
+		n = new(shardNode)
+		sh.cache[_item.key] = n
+	}
+	n.item = _item
+	sh.bytes += n.size()
+	n.seq = atomic.AddUint64(&s.seq, 1)
+	sh.append(n)
+}
+
+func (s *ShardedStore) Remove(ctx context.Context, key string, cond condition) (uint64, bool, error) {
+	sh := s.shardOf(key)
+	defer sh.mu.Unlock()
+	sh.mu.Lock()
+	n, ok := sh.cache[key]
+	// expired key is reported as not found, same as Get
+	current, exists := sh.live(n, ok)
+	if exists && !cond.holds(current, exists) {
+		return current.version, false, ErrConflict
+	}
+	if ok {
+		sh.unlink(n)
+		delete(sh.cache, key)
+		sh.bytes -= n.size()
+	}
+	return current.version, exists, nil
+}
+
+// Txn locks the shards of the ops in index order, so the concurrent transactions never deadlock,
+// and applies the ops with all of them held
+func (s *ShardedStore) Txn(ctx context.Context, ops []txnOp) ([]uint64, error) {
+	s.txnMu.RLock()
+	defer s.txnMu.RUnlock()
+	locked := make([]bool, len(s.shards))
+	for _, op := range ops {
+		locked[s.shardIndex(op.key)] = true
+	}
+	for i, sh := range s.shards {
+		if locked[i] {
+			sh.mu.Lock()
+		}
+	}
+	writes, versions, err := stage(ops, func(key string) (item, bool) {
+		sh := s.shardOf(key)
+		n, ok := sh.cache[key]
+		return sh.live(n, ok)
+	}, s.nextVersion)
+	for _, write := range writes {
+		sh := s.shardOf(write.key)
+		if write.live {
+			s.put(sh, write.item)
+			continue
+		}
+		if n, ok := sh.cache[write.key]; ok {
+			sh.unlink(n)
+			delete(sh.cache, write.key)
+			sh.bytes -= n.size()
+		}
+	}
+	for i, sh := range s.shards {
+		if locked[i] {
+			sh.mu.Unlock()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, write := range writes {
+		if write.live {
+			s.shardOf(write.key).expiry.schedule(write.key, write.expiresAt)
+		}
+	}
+	return versions, nil
+}
+
+func (s *ShardedStore) Get(ctx context.Context, key string) (string, bool) {
+	sh := s.shardOf(key)
+	defer sh.mu.RUnlock()
+	sh.mu.RLock()
+	n, ok := sh.cache[key]
+	if ok && !n.expired(time.Now().UnixNano()) {
+		return n.value, true
+	}
+	return "", false
+}
+
+func (s *ShardedStore) Lookup(ctx context.Context, key string) (item, bool) {
+	sh := s.shardOf(key)
+	defer sh.mu.RUnlock()
+	sh.mu.RLock()
+	n, ok := sh.cache[key]
+	return sh.live(n, ok)
+}
+
+// GetAll copies every shard under its own lock and merges the copies by sequence number.
+// the shards are not locked together, so an add racing with GetAll may or may not be in the result,
+// a transaction is either in the result as a whole or not at all
+func (s *ShardedStore) GetAll(ctx context.Context) []item {
+	s.txnMu.Lock()
+	defer s.txnMu.Unlock()
+	now := time.Now().UnixNano()
+	runs := make(mergeHeap, 0, len(s.shards))
+	total := 0
+	for _, sh := range s.shards {
+		run := sh.items(now)
+		if len(run) > 0 {
+			runs = append(runs, run)
+			total += len(run)
+		}
+	}
+	// k-way merge, every run is already ordered by sequence number
+	heap.Init(&runs)
+	sorted := make([]item, 0, total)
+	for len(runs) > 0 {
+		run := runs[0]
+		sorted = append(sorted, run[0].item)
+		if len(run) == 1 {
+			heap.Pop(&runs)
+			continue
+		}
+		runs[0] = run[1:]
+		heap.Fix(&runs, 0)
+	}
+	return sorted
+}
+
+// Expire sweeps the shards one by one, removing the due items one per lock acquisition
+func (s *ShardedStore) Expire(ctx context.Context, now time.Time) []item {
+	var expired []item
+	for _, sh := range s.shards {
+		for _, entry := range sh.expiry.due(now.UnixNano()) {
+			sh.mu.Lock()
+			n, ok := sh.cache[entry.key]
+			// entry is stale if the key is overwritten with a different ttl
+			if ok && n.expiresAt == entry.expiresAt {
+				expired = append(expired, n.item)
+				sh.unlink(n)
+				delete(sh.cache, entry.key)
+				sh.bytes -= n.size()
+			}
+			sh.mu.Unlock()
+		}
+	}
+	return expired
+}
+
+// Size sums up the shards, every shard is read under its own lock
+func (s *ShardedStore) Size() (int, int64) {
+	var items int
+	var bytes int64
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		items += len(sh.cache)
+		bytes += sh.bytes
+		sh.mu.RUnlock()
+	}
+	return items, bytes
+}
+
+// items returns the live items of the shard ordered by sequence number
+func (sh *shard) items(now int64) []seqItem {
+	defer sh.mu.RUnlock()
+	sh.mu.RLock()
+	out := make([]seqItem, 0, len(sh.cache))
+	for n := sh.root.next; n != sh.root; n = n.next {
+		if !n.expired(now) {
+			out = append(out, seqItem{item: n.item, seq: n.seq})
+		}
+	}
+	return out
+}
+
+// live returns the item of the node if it is live, must be called with the lock held
+func (sh *shard) live(n *shardNode, ok bool) (item, bool) {
+	if !ok {
+		return item{}, false
+	}
+	return live(n.item, true)
+}
+
+func (sh *shard) append(n *shardNode) {
+	n.prev, n.next = sh.root.prev, sh.root
+	sh.root.prev.next = n
+	sh.root.prev = n
+}
+
+func (sh *shard) unlink(n *shardNode) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	n.prev, n.next = nil, nil
+}
+
+type seqItem struct {
+	item
+	seq uint64
+}
+
+// mergeHeap is a min-heap of the shard runs ordered by the sequence number of their head
+type mergeHeap [][]seqItem
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i][0].seq < h[j][0].seq }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.([]seqItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestShardedStore_GetAll(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	store := NewShardedStore(l, 4)
+	now := time.Now()
+	var expected []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		expected = append(expected, key)
+		_, err := store.Add(ctx, key, "value", now, time.Time{}, condition{})
+		assert.Equal(t, nil, err)
+	}
+	// overwritten key moves to the end, removed key is gone
+	_, err := store.Add(ctx, "key-3", "new value", now, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, ok, err := store.Remove(ctx, "key-7", condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	expected = append(append(append(expected[:3:3], expected[4:7]...), expected[8:]...), "key-3")
+	assert.Equal(t, expected, keys(store.GetAll(ctx)))
+
+	value, ok := store.Get(ctx, "key-3")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "new value", value)
+
+	// expired key is hidden before the sweep and removed by it
+	_, err = store.Add(ctx, "ttl", "value", now, now.Add(-time.Millisecond), condition{})
+	assert.Equal(t, nil, err)
+	_, ok = store.Get(ctx, "ttl")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, expected, keys(store.GetAll(ctx)))
+	assert.Equal(t, []string{"ttl"}, keys(store.Expire(ctx, now)))
+}
+
+func TestShardedStore_Concurrent(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	store := NewShardedStore(l, 8)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key-%d-%d", w, i)
+				_, _ = store.Add(ctx, key, "value", time.Now(), time.Time{}, condition{})
+				if i%2 == 0 {
+					_, _, _ = store.Remove(ctx, key, condition{})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	all := store.GetAll(ctx)
+	assert.Equal(t, 8*500, len(all))
+	// the keys of one writer keep their insertion order in the merged result
+	last := make(map[int]int)
+	for _, _item := range all {
+		var w, i int
+		_, _ = fmt.Sscanf(_item.key, "key-%d-%d", &w, &i)
+		prev, ok := last[w]
+		assert.Equal(t, true, !ok || prev < i)
+		last[w] = i
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// number of snapshots kept on the disk, the previous snapshot is the fallback when the latest is corrupted
+const snapshotsRetained = 2
+
+// Snapshotter is implemented by the stores which can take a point-in-time snapshot on demand
+type Snapshotter interface {
+	Snapshot(ctx context.Context) error
+}
+
+var _ Snapshotter = (*WALStore)(nil)
+
+type snapshot struct {
+	LSN       uint64         `json:"lsn"` // last log record included in the snapshot
+	Timestamp time.Time      `json:"timestamp"`
+	Items     []snapshotItem `json:"items"`
+	// Version is the last version given by the store, the removed keys may have had a version above the items
+	Version uint64 `json:"version,omitempty"`
+}
+
+type snapshotItem struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	// Version is zero in the snapshots taken before the items were versioned
+	Version uint64 `json:"version,omitempty"`
+}
+
+func (s snapshotItem) item() item {
+	version := s.Version
+	if version == 0 {
+		version = 1
+	}
+	return item{key: s.Key, value: s.Value, timestamp: s.Timestamp, expiresAt: s.ExpiresAt, version: version}
+}
+
+// Snapshot writes the ordered store contents to the disk and compacts the log up to the previous snapshot,
+// so the log records after the fallback snapshot are always kept
+func (w *WALStore) Snapshot(ctx context.Context) error {
+	w.snapshotMu.Lock()
+	defer w.snapshotMu.Unlock()
+	select {
+	case <-w.done:
+		return errors.New("wal is closed")
+	default:
+	}
+
+	// writes are blocked only while the items are copied
+	w.mu.Lock()
+	lsn := w.lsn
+	items := w.store.GetAll(ctx)
+	var version uint64
+	if r, ok := w.store.(restorer); ok {
+		version = r.lastVersion()
+	}
+	w.mu.Unlock()
+
+	lsns, err := w.snapshotLSNs()
+	if err != nil {
+		return err
+	}
+	if len(lsns) > 0 && lsns[0] == lsn {
+		return nil // nothing written since the latest snapshot
+	}
+	snap := &snapshot{LSN: lsn, Timestamp: time.Now(), Items: make([]snapshotItem, 0, len(items)), Version: version}
+	for _, _item := range items {
+		snap.Items = append(snap.Items, snapshotItem{Key: _item.key, Value: _item.value, Timestamp: _item.timestamp, ExpiresAt: _item.expiresAt, Version: _item.version})
+	}
+	if err := writeSnapshot(w.snapshotName(lsn), snap); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	w.logger.Info("snapshot taken", zap.Uint64("lsn", lsn), zap.Int("items", len(items)))
+
+	lsns = append([]uint64{lsn}, lsns...)
+	if len(lsns) < snapshotsRetained {
+		return nil
+	}
+	for _, old := range lsns[snapshotsRetained:] {
+		if err := os.Remove(w.snapshotName(old)); err != nil {
+			w.logger.Warn("failed to remove old snapshot", zap.Uint64("lsn", old), zap.Error(err))
+		}
+	}
+	return w.compact(lsns[snapshotsRetained-1])
+}
+
+func (w *WALStore) snapshotLoop(interval time.Duration) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.Snapshot(context.Background()); err != nil {
+				w.logger.Error("failed to take snapshot", zap.Error(err))
+			}
+		}
+	}
+}
+
+// restoreSnapshot loads the latest valid snapshot into the store and returns its lsn
+func (w *WALStore) restoreSnapshot() (uint64, error) {
+	lsns, err := w.snapshotLSNs()
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	// items are added through the store api if it cannot restore them, they start over from version one then
+	restorer, versioned := w.store.(restorer)
+	for _, lsn := range lsns {
+		snap, err := readSnapshot(w.snapshotName(lsn))
+		if err != nil {
+			w.logger.Error("corrupted snapshot, falling back to the previous one", zap.Uint64("lsn", lsn), zap.Error(err))
+			continue
+		}
+		for _, _item := range snap.Items {
+			if versioned {
+				restorer.restore(_item.item())
+				continue
+			}
+			if _, err := w.store.Add(ctx, _item.Key, _item.Value, time.Unix(0, _item.Timestamp), fromUnixNano(_item.ExpiresAt), condition{}); err != nil {
+				return 0, fmt.Errorf("failed to restore snapshot: %v", err)
+			}
+		}
+		if versioned {
+			restorer.restoreVersion(snap.Version)
+		}
+		w.logger.Info("snapshot restored", zap.Uint64("lsn", snap.LSN), zap.Int("items", len(snap.Items)))
+		return snap.LSN, nil
+	}
+	return 0, nil
+}
+
+func (w *WALStore) snapshotName(lsn uint64) string {
+	// zero padded, so the names are sorted by lsn
+	return fmt.Sprintf("%s.snapshot.%020d", w.fileName, lsn)
+}
+
+// snapshotLSNs returns the lsn of the snapshots on the disk, latest first
+func (w *WALStore) snapshotLSNs() ([]uint64, error) {
+	prefix := w.fileName + ".snapshot."
+	names, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	lsns := make([]uint64, 0, len(names))
+	for _, name := range names {
+		lsn, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 64)
+		if err != nil {
+			continue // temporary file of an interrupted snapshot
+		}
+		lsns = append(lsns, lsn)
+	}
+	sort.Slice(lsns, func(i, j int) bool {
+		return lsns[i] > lsns[j]
+	})
+	return lsns, nil
+}
+
+// compact rewrites the log without the records up to the given lsn, the records are copied without the lock
+// and the lock is held only to copy the records appended meanwhile and to swap the files
+func (w *WALStore) compact(upTo uint64) error {
+	w.mu.Lock()
+	end, err := w.file.Seek(0, io.SeekCurrent)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, kept, dropped, err := w.compactTo(upTo, end)
+	if err != nil {
+		return fmt.Errorf("failed to compact wal: %v", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.swap(tmp, end); err != nil {
+		return fmt.Errorf("failed to compact wal: %v", err)
+	}
+	w.logger.Info("wal compacted", zap.Uint64("upTo", upTo), zap.Int("kept", kept), zap.Int("dropped", dropped))
+	return nil
+}
+
+// compactTo copies the records after the given lsn up to the end offset into a temporary file,
+// the log is read at offsets so the appends are not blocked
+func (w *WALStore) compactTo(upTo uint64, end int64) (*os.File, int, int, error) {
+	tmp, err := os.OpenFile(w.fileName+".compact", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o664)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(w.file, 0, end))
+	var kept, dropped int
+	for {
+		payload, _, err := readFrame(reader, maxRecordSize)
+		if errors.Is(err, io.EOF) {
+			return tmp, kept, dropped, nil
+		}
+		rec := new(walRecord)
+		if err == nil {
+			err = json.Unmarshal(payload, rec)
+		}
+		if err == nil && rec.LSN > upTo {
+			err = writeFrame(tmp, payload)
+			kept++
+		} else if err == nil {
+			dropped++
+		}
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+			return nil, 0, 0, err
+		}
+	}
+}
+
+// swap appends the records written after the end offset to the compacted file and replaces the log with it,
+// must be called with the lock held
+func (w *WALStore) swap(tmp *os.File, end int64) error {
+	size, err := w.file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = io.Copy(tmp, io.NewSectionReader(w.file, end, size-end))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), w.fileName)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	_ = w.file.Close()
+	w.file = tmp
+	w.dirty = false
+	return syncDir(w.fileName)
+}
+
+func writeSnapshot(fileName string, snap *snapshot) error {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// written to a temporary file first, a crash never leaves a half written snapshot behind
+	tmpName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o664)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(f, payload); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	return syncDir(fileName)
+}
+
+func readSnapshot(fileName string) (*snapshot, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// snapshot is a single frame holding the whole store, it cannot be longer than the file
+	payload, _, err := readFrame(bufio.NewReader(f), info.Size()-walHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	snap := new(snapshot)
+	if err := json.Unmarshal(payload, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// syncDir persists the directory entry of a renamed file
+func syncDir(fileName string) error {
+	dir, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
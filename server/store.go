@@ -2,12 +2,123 @@ package server
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+// ErrNotSupported is returned by the store decorators when the underlying store lacks the capability
+var ErrNotSupported = errors.New("operation is not supported by the store")
+
+// ErrConflict is returned by a conditional write whose condition does not hold, the store is left unchanged
+var ErrConflict = errors.New("condition does not hold")
+
 type Store interface {
-	Add(ctx context.Context, key, value string, timestamp time.Time)
-	Remove(ctx context.Context, key string) bool
+	// Add inserts or overwrites the item if the condition holds and returns the version the item is stored with,
+	// item expires at expiresAt unless it is zero. ErrConflict is returned with the current version otherwise
+	Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error)
+	// Remove removes the item if the condition holds and returns the version it had, false if the key does not exist.
+	// ErrConflict is returned with the current version if the condition does not hold
+	Remove(ctx context.Context, key string, cond condition) (uint64, bool, error)
 	Get(ctx context.Context, key string) (string, bool)
+	// Lookup returns the item with its version, it has no side effects unlike the Get of some decorators
+	Lookup(ctx context.Context, key string) (item, bool)
 	GetAll(ctx context.Context) []item
 }
+
+// condition guards a write against the current item of the key, the zero value always holds
+type condition struct {
+	kind    conditionKind
+	version uint64
+	value   string
+}
+
+type conditionKind int
+
+const (
+	condNone    conditionKind = iota
+	condVersion               // key has the version, zero if the key must not exist
+	condValue                 // key exists with the value
+)
+
+// ifVersion holds if the key has the version, version zero holds if the key does not exist
+func ifVersion(version uint64) condition {
+	return condition{kind: condVersion, version: version}
+}
+
+// ifValue holds if the key exists with the value
+func ifValue(value string) condition {
+	return condition{kind: condValue, value: value}
+}
+
+// holds checks the condition against the current item, current is the zero item if the key does not exist
+func (c condition) holds(current item, exists bool) bool {
+	switch c.kind {
+	case condVersion:
+		return current.version == c.version
+	case condValue:
+		return exists && current.value == c.value
+	default:
+		return true
+	}
+}
+
+// live returns the item if it exists and is not expired, the zero item otherwise
+func live(_item item, ok bool) (item, bool) {
+	if !ok || _item.expired(time.Now().UnixNano()) {
+		return item{}, false
+	}
+	return _item, true
+}
+
+// Peeker is implemented by the store decorators whose Get has side effects (e.g. counting the access for the eviction),
+// Peek reads the value without them
+type Peeker interface {
+	Peek(ctx context.Context, key string) (string, bool)
+}
+
+// peek reads the value through Peek if the store supports it
+func peek(ctx context.Context, store Store, key string) (string, bool) {
+	if peeker, ok := store.(Peeker); ok {
+		return peeker.Peek(ctx, key)
+	}
+	return store.Get(ctx, key)
+}
+
+// restorer is implemented by the stores which can load an item together with its version,
+// the snapshots are restored through it so the versions survive a restart
+type restorer interface {
+	restore(_item item)
+	// lastVersion is the last version given by the store, restoreVersion makes the store count on from it
+	lastVersion() uint64
+	restoreVersion(version uint64)
+}
+
+func maxVersion(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// HealthChecker is implemented by the stores which can become unavailable, e.g. the write-ahead log failing to write
+type HealthChecker interface {
+	Health() error
+}
+
+// storeHealth checks the store if it supports the health check, the other stores are always available
+func storeHealth(store Store) error {
+	if checker, ok := store.(HealthChecker); ok {
+		return checker.Health()
+	}
+	return nil
+}
+
+// Sizer reports the number of items and the size of their keys and values, expired items not swept yet included
+type Sizer interface {
+	Size() (items int, bytes int64)
+}
+
+// size of the item as accounted by the stores
+func (i item) size() int64 {
+	return int64(len(i.key) + len(i.value))
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sliceStore is the previous slice based MemStoreOptimised, kept as the baseline of the store benchmarks
+type sliceStore struct {
+	mu    sync.RWMutex
+	items []item
+	cache map[string]int
+}
+
+func (m *sliceStore) Add(ctx context.Context, key, value string, timestamp, _ time.Time, _ condition) (uint64, error) {
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	val := item{key: key, value: value, timestamp: timestamp.UnixNano()}
+	if index, ok := m.cache[key]; ok {
+		m.items[index] = val
+		return 0, nil
+	}
+	m.items = append(m.items, val)
+	m.cache[key] = len(m.items) - 1
+	return 0, nil
+}
+
+func (m *sliceStore) Remove(ctx context.Context, key string, _ condition) (uint64, bool, error) {
+	defer m.mu.Unlock()
+	m.mu.Lock()
+	index, ok := m.cache[key]
+	if ok {
+		m.items = append(m.items[:index], m.items[index+1:]...)
+		delete(m.cache, key)
+		for i := index; i < len(m.items); i++ {
+			m.cache[m.items[i].key] = i
+		}
+	}
+	return 0, ok, nil
+}
+
+func (m *sliceStore) Get(ctx context.Context, key string) (string, bool) {
+	defer m.mu.RUnlock()
+	m.mu.RLock()
+	if index, ok := m.cache[key]; ok {
+		return m.items[index].value, true
+	}
+	return "", false
+}
+
+func (m *sliceStore) GetAll(ctx context.Context) []item {
+	defer m.mu.RUnlock()
+	m.mu.RLock()
+	sorted := make([]item, len(m.items))
+	copy(sorted, m.items)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].timestamp < sorted[j].timestamp
+	})
+	return sorted
+}
+
+const benchShards = 64
+
+type benchStore interface {
+	Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error)
+	Remove(ctx context.Context, key string, cond condition) (uint64, bool, error)
+	Get(ctx context.Context, key string) (string, bool)
+	GetAll(ctx context.Context) []item
+}
+
+// BenchmarkStore compares the stores by size, 10M keys are skipped in short mode.
+// remove re-adds the key afterwards to keep the size, so it measures a remove and an add
+func BenchmarkStore(b *testing.B) {
+	l := zap.NewNop()
+	stores := []struct {
+		name string
+		new  func() benchStore
+	}{
+		{name: "memstore", new: func() benchStore { return NewMemStore(l) }},
+		{name: "memstore_slice", new: func() benchStore { return &sliceStore{cache: make(map[string]int)} }},
+		{name: "memstore_optimised", new: func() benchStore { return NewMemStoreOptimised(l) }},
+		{name: "sharded", new: func() benchStore { return NewShardedStore(l, benchShards) }},
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{name: "1k", size: 1_000},
+		{name: "100k", size: 100_000},
+		{name: "10M", size: 10_000_000},
+	}
+	ctx := context.Background()
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			for _, sz := range sizes {
+				b.Run(sz.name, func(b *testing.B) {
+					if sz.size >= 10_000_000 && testing.Short() {
+						b.Skip("skipping 10M keys in short mode")
+					}
+					store := st.new()
+					keys := make([]string, sz.size)
+					now := time.Now()
+					for i := range keys {
+						keys[i] = fmt.Sprintf("key-%d", i)
+						_, _ = store.Add(ctx, keys[i], "value", now.Add(time.Duration(i)), time.Time{}, condition{})
+					}
+					ts := now.Add(time.Duration(sz.size))
+
+					b.Run("add", func(b *testing.B) {
+						for i := 0; i < b.N; i++ {
+							ts = ts.Add(1)
+							_, _ = store.Add(ctx, keys[i%len(keys)], "value", ts, time.Time{}, condition{})
+						}
+					})
+					b.Run("remove", func(b *testing.B) {
+						for i := 0; i < b.N; i++ {
+							ts = ts.Add(1)
+							key := keys[(i*7919)%len(keys)] // spread the removes over the whole store
+							_, _, _ = store.Remove(ctx, key, condition{})
+							_, _ = store.Add(ctx, key, "value", ts, time.Time{}, condition{})
+						}
+					})
+					b.Run("getall", func(b *testing.B) {
+						for i := 0; i < b.N; i++ {
+							_ = store.GetAll(ctx)
+						}
+					})
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkStoreParallel runs a mixed workload of one add per three gets from all the goroutines,
+// run it with -cpu 1,2,4,8 to see the throughput scaling with GOMAXPROCS
+func BenchmarkStoreParallel(b *testing.B) {
+	l := zap.NewNop()
+	stores := []struct {
+		name string
+		new  func() Store
+	}{
+		{name: "memstore", new: func() Store { return NewMemStore(l) }},
+		{name: "memstore_optimised", new: func() Store { return NewMemStoreOptimised(l) }},
+		{name: "sharded", new: func() Store { return NewShardedStore(l, benchShards) }},
+	}
+	ctx := context.Background()
+	keys := make([]string, 100_000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	for _, st := range stores {
+		b.Run(st.name, func(b *testing.B) {
+			store := st.new()
+			now := time.Now()
+			for _, key := range keys {
+				_, _ = store.Add(ctx, key, "value", now, time.Time{}, condition{})
+			}
+			var worker uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// every goroutine walks the keys from its own offset, so they do not hit the same keys
+				i := int(atomic.AddUint32(&worker, 1)) * 7919
+				for pb.Next() {
+					i++
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						_, _ = store.Add(ctx, key, "value", time.Now(), time.Time{}, condition{})
+						continue
+					}
+					store.Get(ctx, key)
+				}
+			})
+		})
+	}
+}
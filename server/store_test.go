@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestStore_Conditions(t *testing.T) {
+	l := zap.NewNop()
+	stores := []struct {
+		name string
+		new  func(t *testing.T) Store
+	}{
+		{name: "memstore", new: func(*testing.T) Store { return NewMemStore(l) }},
+		{name: "memstore_optimised", new: func(*testing.T) Store { return NewMemStoreOptimised(l) }},
+		{name: "sharded", new: func(*testing.T) Store { return NewShardedStore(l, 4) }},
+		{name: "wal", new: func(t *testing.T) Store {
+			wal, err := NewWALStore(l, NewMemStore(l), filepath.Join(t.TempDir(), "wal.log"), SyncNever, 0, 0)
+			assert.Equal(t, nil, err)
+			t.Cleanup(func() { _ = wal.Close() })
+			return wal
+		}},
+		{name: "bounded", new: func(t *testing.T) Store {
+			bounded, err := NewBoundedStore(l, NewMemStore(l), 10, 0, EvictLRU)
+			assert.Equal(t, nil, err)
+			return bounded
+		}},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := st.new(t)
+			now := time.Now()
+
+			// version zero matches the missing key only
+			version, err := store.Add(ctx, "a", "1", now, time.Time{}, ifVersion(0))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, uint64(1), version)
+			version, err = store.Add(ctx, "a", "2", now, time.Time{}, ifVersion(0))
+			assert.Equal(t, ErrConflict, err)
+			assert.Equal(t, uint64(1), version)
+
+			version, err = store.Add(ctx, "a", "2", now, time.Time{}, ifVersion(1))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, uint64(2), version)
+			version, err = store.Add(ctx, "a", "3", now, time.Time{}, ifVersion(1))
+			assert.Equal(t, ErrConflict, err)
+			assert.Equal(t, uint64(2), version)
+			version, err = store.Add(ctx, "a", "3", now, time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			assert.Equal(t, uint64(3), version)
+			_item, ok := store.Lookup(ctx, "a")
+			assert.Equal(t, true, ok)
+			assert.Equal(t, "3", _item.value)
+			assert.Equal(t, uint64(3), _item.version)
+
+			// conflicting remove leaves the key as it is
+			version, ok, err = store.Remove(ctx, "a", ifValue("2"))
+			assert.Equal(t, ErrConflict, err)
+			assert.Equal(t, false, ok)
+			assert.Equal(t, uint64(3), version)
+			version, ok, err = store.Remove(ctx, "missing", ifValue("2"))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, false, ok)
+			assert.Equal(t, uint64(0), version)
+			version, ok, err = store.Remove(ctx, "a", ifValue("3"))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, true, ok)
+			assert.Equal(t, uint64(3), version)
+
+			// removed key never gets a version it had before, a stale compare and swap fails
+			version, err = store.Add(ctx, "a", "4", now, time.Time{}, ifVersion(0))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, uint64(4), version)
+			version, err = store.Add(ctx, "a", "5", now, time.Time{}, ifVersion(3))
+			assert.Equal(t, ErrConflict, err)
+			assert.Equal(t, uint64(4), version)
+			_, ok, err = store.Remove(ctx, "a", condition{})
+			assert.Equal(t, nil, err)
+			assert.Equal(t, true, ok)
+			version, err = store.Add(ctx, "a", "4", now, time.Time{}, condition{})
+			assert.Equal(t, nil, err)
+			assert.Equal(t, uint64(5), version)
+			_, err = store.Add(ctx, "a", "6", now, time.Time{}, ifVersion(4))
+			assert.Equal(t, ErrConflict, err)
+
+			// expired key counts as missing
+			_, err = store.Add(ctx, "ttl", "1", now, now.Add(-time.Millisecond), condition{})
+			assert.Equal(t, nil, err)
+			version, err = store.Add(ctx, "ttl", "2", now, time.Time{}, ifVersion(0))
+			assert.Equal(t, nil, err)
+			assert.Equal(t, uint64(7), version)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/queue"
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+func TestServer_Tracing(t *testing.T) {
+	l := zap.NewNop()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	}()
+
+	q := queue.NewMemory(l, t.Name())
+	client := queue.NewMemory(l, t.Name())
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := new(sync.WaitGroup)
+	server := New(l, jsonResults(io.Discard), q, NewMemStore(l), 1)
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start(ctx)
+	}()
+	wg.Add(1)
+	go server.Process(ctx, wg, 1)
+
+	parentCtx, parent := otel.Tracer("test").Start(ctx, "parent")
+	assert.Equal(t, nil, queue.PublishContext(parentCtx, client, &types.Message{Action: types.AddItem, Key: "111", Value: "222"}))
+	parent.End()
+
+	// publish -> dequeue -> dispatch -> process -> store, all in the trace of the publisher
+	spans := make(map[string]tracetest.SpanStub)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spans) < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		for _, span := range exporter.GetSpans() {
+			if span.SpanContext.TraceID() == parent.SpanContext().TraceID() {
+				spans[span.Name] = span
+			}
+		}
+	}
+	cancel()
+	assert.Equal(t, nil, <-started)
+	wg.Wait()
+	assert.Equal(t, nil, q.Close())
+
+	parentID := parent.SpanContext().SpanID()
+	for _, name := range []string{"publish add", "dequeue add", "dispatch add", "process add", "store add"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("span %q is not recorded", name)
+		}
+		assert.Equal(t, parentID, span.Parent.SpanID())
+		parentID = span.SpanContext.SpanID()
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+)
+
+// Transactor is implemented by the stores which can apply several writes atomically
+type Transactor interface {
+	// Txn applies the writes in order, all or nothing, and returns the version of every write: the version of an add,
+	// the version of a removed key or zero if it did not exist. if a condition does not hold nothing is applied
+	// and a *txnConflict is returned, it matches ErrConflict
+	Txn(ctx context.Context, ops []txnOp) ([]uint64, error)
+}
+
+// txnOp is a write of a transaction, an add unless remove is set
+type txnOp struct {
+	remove     bool
+	key, value string
+	timestamp  int64
+	expiresAt  int64 // zero if the item never expires
+	cond       condition
+}
+
+// txnConflict reports the first op of a transaction whose condition does not hold
+type txnConflict struct {
+	op      int
+	key     string
+	version uint64 // current version of the key, zero if it does not exist
+}
+
+func (e *txnConflict) Error() string {
+	return fmt.Sprintf("op %d: condition does not hold, key %s is at version %d", e.op, e.key, e.version)
+}
+
+func (e *txnConflict) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// txnWrite is the final state of a key written by a transaction, the key is removed unless it is live
+type txnWrite struct {
+	item
+	live bool
+}
+
+// stage evaluates the ops in order against the current items, an op sees the writes of the ops before it.
+// every add takes the version returned by next. it returns the final state of the written keys in the order
+// they are first written, the stores apply them with their locks held
+func stage(ops []txnOp, lookup func(key string) (item, bool), next func() uint64) ([]txnWrite, []uint64, error) {
+	index := make(map[string]int, len(ops))
+	writes := make([]txnWrite, 0, len(ops))
+	versions := make([]uint64, len(ops))
+	for i, op := range ops {
+		at, staged := index[op.key]
+		if !staged {
+			current, exists := lookup(op.key)
+			if !exists {
+				current = item{key: op.key}
+			}
+			at = len(writes)
+			index[op.key] = at
+			writes = append(writes, txnWrite{item: current, live: exists})
+		}
+		current := writes[at]
+		if !op.cond.holds(current.item, current.live) {
+			return nil, nil, &txnConflict{op: i, key: op.key, version: current.version}
+		}
+		if op.remove {
+			versions[i] = current.version
+			writes[at] = txnWrite{item: item{key: op.key}}
+			continue
+		}
+		next := item{key: op.key, value: op.value, timestamp: op.timestamp, expiresAt: op.expiresAt, version: next()}
+		versions[i] = next.version
+		writes[at] = txnWrite{item: next, live: true}
+	}
+	return writes, versions, nil
+}
+
+// unconditional returns the ops without their conditions, the write-ahead log applies the logged transactions with them
+func unconditional(ops []txnOp) []txnOp {
+	out := make([]txnOp, len(ops))
+	for i, op := range ops {
+		op.cond = condition{}
+		out[i] = op
+	}
+	return out
+}
+
+// scheduleWrites queues the expiry of the items written by a transaction
+func (q *expiryQueue) scheduleWrites(writes []txnWrite) {
+	for _, write := range writes {
+		if write.live {
+			q.schedule(write.key, write.expiresAt)
+		}
+	}
+}
+
+// txnOps converts the ops of the message, every op takes the timestamp of the message
+func txnOps(msg *types.Message) ([]txnOp, error) {
+	ops := make([]txnOp, 0, len(msg.Ops))
+	now := time.Now()
+	for i, op := range msg.Ops {
+		out := txnOp{key: op.Key, timestamp: msg.Timestamp.UnixNano()}
+		switch op.Action {
+		case types.AddItem:
+			out.value = op.Value
+			if op.TTL > 0 {
+				out.expiresAt = now.Add(time.Duration(op.TTL) * time.Millisecond).UnixNano()
+			}
+		case types.RemoveItem:
+			out.remove = true
+		default:
+			return nil, fmt.Errorf("op %d has unknown action %q", i, op.Action)
+		}
+		if op.IfVersion != nil {
+			out.cond = ifVersion(*op.IfVersion)
+		}
+		ops = append(ops, out)
+	}
+	return ops, nil
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+// txnStores are the stores supporting transactions
+func txnStores(l *zap.Logger) []struct {
+	name string
+	new  func(t *testing.T) Store
+} {
+	return []struct {
+		name string
+		new  func(t *testing.T) Store
+	}{
+		{name: "memstore", new: func(*testing.T) Store { return NewMemStore(l) }},
+		{name: "memstore_optimised", new: func(*testing.T) Store { return NewMemStoreOptimised(l) }},
+		{name: "sharded", new: func(*testing.T) Store { return NewShardedStore(l, 8) }},
+		{name: "wal", new: func(t *testing.T) Store {
+			wal, err := NewWALStore(l, NewShardedStore(l, 8), filepath.Join(t.TempDir(), "wal.log"), SyncNever, 0, 0)
+			assert.Equal(t, nil, err)
+			t.Cleanup(func() { _ = wal.Close() })
+			return wal
+		}},
+		{name: "bounded", new: func(t *testing.T) Store {
+			bounded, err := NewBoundedStore(l, NewMemStoreOptimised(l), 100, 0, EvictLRU)
+			assert.Equal(t, nil, err)
+			return bounded
+		}},
+	}
+}
+
+func TestStore_Txn(t *testing.T) {
+	for _, st := range txnStores(zap.NewNop()) {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := st.new(t)
+			transactor := store.(Transactor)
+			now := time.Now().UnixNano()
+
+			versions, err := transactor.Txn(ctx, []txnOp{
+				{key: "a", value: "1", timestamp: now},
+				{key: "b", value: "1", timestamp: now},
+				{key: "a", value: "2", timestamp: now, cond: ifVersion(1)}, // sees the write before it
+				{key: "c", remove: true},
+			})
+			assert.Equal(t, nil, err)
+			assert.Equal(t, []uint64{1, 2, 3, 0}, versions)
+			written := keys(store.GetAll(ctx))
+			sort.Strings(written)
+			assert.Equal(t, []string{"a", "b"}, written)
+
+			// nothing is applied if a condition does not hold
+			versions, err = transactor.Txn(ctx, []txnOp{
+				{key: "a", remove: true, cond: ifVersion(3)},
+				{key: "d", value: "1", timestamp: now},
+				{key: "b", value: "2", timestamp: now, cond: ifVersion(3)},
+			})
+			assert.Equal(t, true, errors.Is(err, ErrConflict))
+			assert.Equal(t, &txnConflict{op: 2, key: "b", version: 2}, err)
+			assert.Equal(t, 0, len(versions))
+			_item, ok := store.Lookup(ctx, "a")
+			assert.Equal(t, true, ok)
+			assert.Equal(t, uint64(3), _item.version)
+			_, ok = store.Lookup(ctx, "d")
+			assert.Equal(t, false, ok)
+
+			versions, err = transactor.Txn(ctx, []txnOp{
+				{key: "a", remove: true, cond: ifVersion(3)},
+				{key: "b", value: "2", timestamp: now, cond: ifVersion(2)},
+			})
+			assert.Equal(t, nil, err)
+			// the conflicting txn may have drawn versions, they are never given again
+			assert.Equal(t, uint64(3), versions[0])
+			assert.Equal(t, true, versions[1] > 3)
+			value, ok := store.Get(ctx, "b")
+			assert.Equal(t, true, ok)
+			assert.Equal(t, "2", value)
+			_, ok = store.Lookup(ctx, "a")
+			assert.Equal(t, false, ok)
+		})
+	}
+}
+
+// TestStore_TxnIsolation moves units between the accounts with concurrent transactions, every GetAll has to see
+// the total unchanged and the pair of keys written and removed together either both or none
+func TestStore_TxnIsolation(t *testing.T) {
+	const (
+		accounts = 4
+		balance  = 100
+		workers  = 8
+		moves    = 200
+	)
+	for _, st := range txnStores(zap.NewNop()) {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := st.new(t)
+			transactor := store.(Transactor)
+			now := time.Now().UnixNano()
+			var setup []txnOp
+			for i := 0; i < accounts; i++ {
+				setup = append(setup, txnOp{key: fmt.Sprintf("account-%d", i), value: strconv.Itoa(balance), timestamp: now})
+			}
+			_, err := transactor.Txn(ctx, setup)
+			assert.Equal(t, nil, err)
+
+			done := make(chan struct{})
+			readErr := make(chan error, 1)
+			go func() {
+				defer close(readErr)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					total, pair := 0, 0
+					for _, _item := range store.GetAll(ctx) {
+						switch _item.key {
+						case "pair-x", "pair-y":
+							pair++
+						default:
+							value, _ := strconv.Atoi(_item.value)
+							total += value
+						}
+					}
+					if total != accounts*balance || pair == 1 {
+						readErr <- fmt.Errorf("partial transaction observed, total %d pair keys %d", total, pair)
+						return
+					}
+				}
+			}()
+
+			wg := new(sync.WaitGroup)
+			wg.Add(workers)
+			for w := 0; w < workers; w++ {
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < moves; i++ {
+						from, to := fmt.Sprintf("account-%d", (w+i)%accounts), fmt.Sprintf("account-%d", (w+i+1)%accounts)
+						// read-modify-write guarded by the versions, retried on conflict
+						for {
+							src, _ := store.Lookup(ctx, from)
+							dst, _ := store.Lookup(ctx, to)
+							srcBalance, _ := strconv.Atoi(src.value)
+							dstBalance, _ := strconv.Atoi(dst.value)
+							_, err := transactor.Txn(ctx, []txnOp{
+								{key: from, value: strconv.Itoa(srcBalance - 1), timestamp: time.Now().UnixNano(), cond: ifVersion(src.version)},
+								{key: to, value: strconv.Itoa(dstBalance + 1), timestamp: time.Now().UnixNano(), cond: ifVersion(dst.version)},
+							})
+							if err == nil {
+								break
+							}
+							if !errors.Is(err, ErrConflict) {
+								t.Error(err)
+								return
+							}
+						}
+						remove := i%2 == 1
+						if _, err := transactor.Txn(ctx, []txnOp{
+							{key: "pair-x", value: "x", timestamp: time.Now().UnixNano(), remove: remove},
+							{key: "pair-y", value: "y", timestamp: time.Now().UnixNano(), remove: remove},
+						}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(done)
+			assert.Equal(t, nil, <-readErr)
+
+			total := 0
+			for i := 0; i < accounts; i++ {
+				_item, ok := store.Lookup(ctx, fmt.Sprintf("account-%d", i))
+				assert.Equal(t, true, ok)
+				value, _ := strconv.Atoi(_item.value)
+				total += value
+			}
+			assert.Equal(t, accounts*balance, total)
+		})
+	}
+}
+
+func TestWALStore_TxnReplay(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	now := time.Now().UnixNano()
+	_, err = wal.Txn(ctx, []txnOp{{key: "a", value: "1", timestamp: now}, {key: "b", value: "1", timestamp: now}})
+	assert.Equal(t, nil, err)
+	_, err = wal.Txn(ctx, []txnOp{{key: "a", remove: true}, {key: "b", value: "2", timestamp: now, cond: ifVersion(2)}})
+	assert.Equal(t, nil, err)
+	// conflicting transactions are not logged
+	_, err = wal.Txn(ctx, []txnOp{{key: "c", value: "1", timestamp: now}, {key: "b", value: "3", timestamp: now, cond: ifVersion(2)}})
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+	expected := wal.GetAll(ctx)
+	assert.Equal(t, nil, wal.Close())
+
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, wal.GetAll(ctx))
+	assert.Equal(t, []item{{key: "b", value: "2", timestamp: now, version: 3}}, wal.GetAll(ctx))
+	assert.Equal(t, uint64(2), wal.lsn)
+	assert.Equal(t, nil, wal.Close())
+}
+
+func TestServer_Txn(t *testing.T) {
+	l := zap.NewNop()
+	server := New(l, jsonResults(io.Discard), nil, NewShardedStore(l, 4), benchWorkers)
+	var events []types.Event
+	var mu sync.Mutex
+	server.OnChange(func(event types.Event) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	})
+	wg := new(sync.WaitGroup)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(context.Background(), wg, i)
+	}
+	defer func() {
+		server.closePartitions()
+		wg.Wait()
+	}()
+	ctx := context.Background()
+	zero, one, two := uint64(0), uint64(1), uint64(2)
+	at := time.Now()
+
+	resp, err := server.Do(ctx, &types.Message{Action: types.Txn, Timestamp: at, Ops: []types.Op{
+		{Action: types.AddItem, Key: "a", Value: "1", IfVersion: &zero},
+		{Action: types.AddItem, Key: "b", Value: "1"},
+	}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, types.StatusOK, resp.Status)
+	assert.Equal(t, []types.Item{{Key: "a", Value: "1", Timestamp: at, Version: 1}, {Key: "b", Value: "1", Timestamp: at, Version: 2}}, resp.Items)
+
+	resp, err = server.Do(ctx, &types.Message{Action: types.Txn, Timestamp: at, Ops: []types.Op{
+		{Action: types.RemoveItem, Key: "a", IfVersion: &one},
+		{Action: types.AddItem, Key: "b", Value: "2", IfVersion: &zero},
+	}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, types.StatusConflict, resp.Status)
+	assert.Equal(t, "b", resp.Key)
+	assert.Equal(t, uint64(2), resp.Version)
+
+	resp, err = server.Do(ctx, &types.Message{Action: types.Txn, Timestamp: at, Ops: []types.Op{
+		{Action: types.RemoveItem, Key: "a", IfVersion: &one},
+		{Action: types.AddItem, Key: "b", Value: "2", IfVersion: &two},
+	}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, types.StatusOK, resp.Status)
+
+	resp, err = server.Do(ctx, &types.Message{Action: types.Txn, Ops: []types.Op{{Action: types.GetItem, Key: "b"}}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, types.StatusUnknownAction, resp.Status)
+
+	// the events of a txn are consecutive and the conflict has none
+	mu.Lock()
+	defer mu.Unlock()
+	actions := make([]string, 0, len(events))
+	for _, event := range events {
+		actions = append(actions, fmt.Sprintf("%d %s %s %s %s", event.Seq, event.Action, event.Key, event.Value, event.OldValue))
+	}
+	assert.Equal(t, []string{"1 add a 1 ", "2 add b 1 ", "3 remove a  1", "4 add b 2 1"}, actions)
+}
+
+// gatedStore blocks the adds of the value until the gate is closed
+type gatedStore struct {
+	*MemStore
+	value string
+	gate  chan struct{}
+}
+
+func (g *gatedStore) Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error) {
+	if value == g.value {
+		<-g.gate
+	}
+	return g.MemStore.Add(ctx, key, value, timestamp, expiresAt, cond)
+}
+
+// TestServer_TxnOrdering holds the worker owning a key of a txn, the txn has to wait for the messages
+// of the key published before it whichever worker applies it
+func TestServer_TxnOrdering(t *testing.T) {
+	l := zap.NewNop()
+	store := &gatedStore{MemStore: NewMemStore(l), value: "blocked", gate: make(chan struct{})}
+	server := New(l, jsonResults(io.Discard), nil, store, benchWorkers)
+	var events []string
+	var mu sync.Mutex
+	server.OnChange(func(event types.Event) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf("%s %s %s %s", event.Action, event.Key, event.Value, event.OldValue))
+		mu.Unlock()
+	})
+	wg := new(sync.WaitGroup)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(context.Background(), wg, i)
+	}
+	other := "b"
+	for i := 0; server.partitionOfKey(other) == server.partitionOfKey("a"); i++ {
+		other = "b" + strconv.Itoa(i)
+	}
+
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		dispatch(t, server,
+			&types.Message{Action: types.AddItem, Key: "a", Value: "blocked"},
+			&types.Message{Action: types.AddItem, Key: "a", Value: "single"},
+			&types.Message{Action: types.Txn, Ops: []types.Op{
+				{Action: types.AddItem, Key: "a", Value: "txn"},
+				{Action: types.AddItem, Key: other, Value: "txn"},
+			}},
+			&types.Message{Action: types.RemoveItem, Key: other},
+		)
+	}()
+	// the txn is held while the worker owning a is blocked
+	time.Sleep(50 * time.Millisecond)
+	close(store.gate)
+	<-dispatched
+	server.closePartitions()
+	wg.Wait()
+
+	value, _ := store.Get(context.Background(), "a")
+	assert.Equal(t, "txn", value)
+	_, ok := store.Get(context.Background(), other)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, []string{
+		"add a blocked ",
+		"add a single blocked",
+		"add a txn single",
+		"add " + other + " txn ",
+		"remove " + other + "  txn",
+	}, events)
+}
+
+// TestServer_TxnDispatchCancelled cancels a txn while the worker applying it is busy, the workers of its other
+// partitions are held already and have to be released
+func TestServer_TxnDispatchCancelled(t *testing.T) {
+	l := zap.NewNop()
+	store := &gatedStore{MemStore: NewMemStore(l), value: "blocked", gate: make(chan struct{})}
+	server := New(l, jsonResults(io.Discard), nil, store, benchWorkers)
+	wg := new(sync.WaitGroup)
+	wg.Add(benchWorkers)
+	for i := 1; i <= benchWorkers; i++ {
+		go server.Process(context.Background(), wg, i)
+	}
+	// the txn is applied by the worker of the last partition
+	first, last := "a", "b"
+	for i := 0; server.partitionOfKey(first) == server.partitionOfKey(last); i++ {
+		last = "b" + strconv.Itoa(i)
+	}
+	if server.partitionOfKey(first) > server.partitionOfKey(last) {
+		first, last = last, first
+	}
+
+	// the worker of the last partition is blocked and its channel is full
+	dispatch(t, server,
+		&types.Message{Action: types.AddItem, Key: last, Value: "blocked"},
+		&types.Message{Action: types.AddItem, Key: last, Value: "queued"},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := server.Dispatch(ctx, &types.Message{Action: types.Txn, Ops: []types.Op{
+		{Action: types.AddItem, Key: first, Value: "txn"},
+		{Action: types.AddItem, Key: last, Value: "txn"},
+	}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the worker of the other partition is not held by the cancelled txn
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := server.Do(ctx, &types.Message{Action: types.AddItem, Key: first, Value: "after"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, types.StatusOK, resp.Status)
+	value, _ := store.Get(context.Background(), first)
+	assert.Equal(t, "after", value)
+
+	close(store.gate)
+	stopped := make(chan struct{})
+	go func() {
+		server.closePartitions()
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("workers are not stopped")
+	}
+	value, _ = store.Get(context.Background(), last)
+	assert.Equal(t, "queued", value)
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+	"go.uber.org/zap"
+)
+
+// SyncPolicy decides when the write-ahead log is flushed to the disk
+type SyncPolicy string
+
+const (
+	SyncAlways   SyncPolicy = "always"   // fsync after every record
+	SyncInterval SyncPolicy = "interval" // fsync periodically
+	SyncNever    SyncPolicy = "never"    // leave it to the operating system
+)
+
+// record header is length and crc32 of the payload
+const walHeaderSize = 8
+
+// maxRecordSize guards the replay against corrupted length prefixes, larger records are refused on append
+const maxRecordSize = 64 << 20
+
+var ErrRecordTooLarge = errors.New("record is larger than the wal record limit")
+
+type walRecord struct {
+	LSN       uint64       `json:"lsn,omitempty"` // log sequence number, not set on the ops of a txn
+	Action    types.Action `json:"action"`
+	Key       string       `json:"key"`
+	Value     string       `json:"value,omitempty"`
+	Timestamp int64        `json:"timestamp,omitempty"`
+	ExpiresAt int64        `json:"expiresAt,omitempty"`
+	// Ops are the writes of a txn, a txn is logged as a single record so it is replayed all or nothing
+	Ops []*walRecord `json:"ops,omitempty"`
+}
+
+// WALStore is a Store decorator which appends every write to the log before it is applied,
+// store is rebuilt on start from the latest snapshot and the log records after it
+type WALStore struct {
+	logger   *zap.Logger
+	store    Store
+	fileName string
+	policy   SyncPolicy
+
+	mu    sync.Mutex // serializes appends, so the log order is the apply order
+	file  *os.File
+	lsn   uint64 // last written log sequence number
+	dirty bool   // written but not synced yet
+	err   error  // last write or sync failure, cleared by the next successful write
+
+	snapshotMu sync.Mutex // one snapshot at a time
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var (
+	_ Store   = (*WALStore)(nil)
+	_ Expirer = (*WALStore)(nil)
+	_ Peeker  = (*WALStore)(nil)
+	_ Sizer   = (*WALStore)(nil)
+
+	_ HealthChecker = (*WALStore)(nil)
+	_ Transactor    = (*WALStore)(nil)
+)
+
+var errWALClosed = errors.New("write-ahead log is closed")
+
+// NewWALStore restores the store and opens the log for writing, snapshots are taken every snapshotInterval
+// unless it is zero. syncInterval is used only by SyncInterval, it has to be positive then
+func NewWALStore(logger *zap.Logger, store Store, fileName string, policy SyncPolicy, syncInterval, snapshotInterval time.Duration) (*WALStore, error) {
+	if policy == SyncInterval && syncInterval <= 0 {
+		return nil, fmt.Errorf("wal sync interval must be positive with the %s policy: %v", policy, syncInterval)
+	}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0o664)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal file: %v", err)
+	}
+	w := &WALStore{
+		logger:   logger,
+		store:    store,
+		fileName: fileName,
+		policy:   policy,
+		file:     file,
+		done:     make(chan struct{}),
+	}
+	snapshotLSN, err := w.restoreSnapshot()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := w.replay(snapshotLSN); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if policy == SyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop(syncInterval)
+	}
+	if snapshotInterval > 0 {
+		w.wg.Add(1)
+		go w.snapshotLoop(snapshotInterval)
+	}
+	return w, nil
+}
+
+// replay applies the records written after the snapshot, a torn record at the end of the log
+// (crash while writing) is truncated
+func (w *WALStore) replay(snapshotLSN uint64) error {
+	ctx := context.Background()
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	var count int
+	w.lsn = snapshotLSN
+	for {
+		rec, n, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			w.logger.Warn("wal has a corrupted tail, truncating", zap.Int64("offset", offset), zap.Error(err))
+			if err := w.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate wal: %v", err)
+			}
+			break
+		}
+		offset += int64(n)
+		if rec.LSN == 0 {
+			rec.LSN = w.lsn + 1 // written before sequence numbers were introduced
+		}
+		if rec.LSN <= snapshotLSN {
+			continue // already part of the snapshot
+		}
+		if err := applyRecord(ctx, w.store, rec); err != nil {
+			return fmt.Errorf("failed to replay wal: %v", err)
+		}
+		w.lsn = rec.LSN
+		count++
+	}
+	if _, err := w.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek wal: %v", err)
+	}
+	w.logger.Info("wal replayed", zap.Uint64("snapshotLSN", snapshotLSN), zap.Int("records", count))
+	return nil
+}
+
+func readRecord(reader io.Reader) (*walRecord, int, error) {
+	payload, n, err := readFrame(reader, maxRecordSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec := new(walRecord)
+	if err := json.Unmarshal(payload, rec); err != nil {
+		return nil, 0, err
+	}
+	return rec, n, nil
+}
+
+// readFrame reads a checksummed payload of at most maxSize bytes, a longer length prefix is reported as corrupted.
+// io.EOF is returned only if there is no data left at all
+func readFrame(reader io.Reader, maxSize int64) ([]byte, int, error) {
+	header := make([]byte, walHeaderSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if n == 0 && errors.Is(err, io.EOF) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, fmt.Errorf("short header: %v", err)
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if int64(length) > maxSize {
+		return nil, 0, fmt.Errorf("frame length %d exceeds %d", length, maxSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, fmt.Errorf("short payload: %v", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return payload, walHeaderSize + int(length), nil
+}
+
+func writeFrame(writer io.Writer, payload []byte) error {
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+	_, err := writer.Write(buf)
+	return err
+}
+
+func applyRecord(ctx context.Context, store Store, rec *walRecord) error {
+	switch rec.Action {
+	case types.AddItem:
+		// expiry is absolute, so the items expired while the server was down are not visible after replay
+		// only the applied writes are logged, so the records are replayed unconditionally and the versions
+		// are counted up the same way as they were
+		_, err := store.Add(ctx, rec.Key, rec.Value, time.Unix(0, rec.Timestamp), fromUnixNano(rec.ExpiresAt), condition{})
+		return err
+	case types.RemoveItem:
+		_, _, err := store.Remove(ctx, rec.Key, condition{})
+		return err
+	case types.Txn:
+		transactor, ok := store.(Transactor)
+		if !ok {
+			return ErrNotSupported
+		}
+		ops := make([]txnOp, 0, len(rec.Ops))
+		for _, op := range rec.Ops {
+			ops = append(ops, txnOp{remove: op.Action == types.RemoveItem, key: op.Key, value: op.Value, timestamp: op.Timestamp, expiresAt: op.ExpiresAt})
+		}
+		_, err := transactor.Txn(ctx, ops)
+		return err
+	default:
+		return fmt.Errorf("unknown wal action %q", rec.Action)
+	}
+}
+
+// append writes the record, must be called with the lock held
+func (w *WALStore) append(rec *walRecord) error {
+	rec.LSN = w.lsn + 1
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxRecordSize {
+		return ErrRecordTooLarge
+	}
+	if err := writeFrame(w.file, payload); err != nil {
+		w.err = fmt.Errorf("failed to append to wal: %v", err)
+		return w.err
+	}
+	w.lsn = rec.LSN
+	if w.policy == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			w.err = fmt.Errorf("failed to sync wal: %v", err)
+			return w.err
+		}
+		w.err = nil
+		return nil
+	}
+	w.dirty = true
+	w.err = nil
+	return nil
+}
+
+func (w *WALStore) syncLoop(interval time.Duration) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.sync(); err != nil {
+				w.logger.Error("failed to sync wal", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (w *WALStore) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	if err := w.file.Sync(); err != nil {
+		w.err = fmt.Errorf("failed to sync wal: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Health reports the last write or sync failure of the log
+func (w *WALStore) Health() error {
+	select {
+	case <-w.done:
+		return errWALClosed
+	default:
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Add checks the condition before the record is logged, so the conflicting writes are never logged.
+// the logged write is applied unconditionally, the same as it is replayed
+func (w *WALStore) Add(ctx context.Context, key, value string, timestamp, expiresAt time.Time, cond condition) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if current, exists := w.store.Lookup(ctx, key); !cond.holds(current, exists) {
+		return current.version, ErrConflict
+	}
+	if err := w.append(&walRecord{Action: types.AddItem, Key: key, Value: value, Timestamp: timestamp.UnixNano(), ExpiresAt: unixNano(expiresAt)}); err != nil {
+		return 0, err
+	}
+	return w.store.Add(ctx, key, value, timestamp, expiresAt, condition{})
+}
+
+func (w *WALStore) Remove(ctx context.Context, key string, cond condition) (uint64, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// removing a missing key is not logged, replay would be a noop anyway
+	current, exists := w.store.Lookup(ctx, key)
+	if !exists {
+		return 0, false, nil
+	}
+	if !cond.holds(current, exists) {
+		return current.version, false, ErrConflict
+	}
+	if err := w.append(&walRecord{Action: types.RemoveItem, Key: key}); err != nil {
+		return 0, false, err
+	}
+	return w.store.Remove(ctx, key, condition{})
+}
+
+// Txn checks the conditions before the transaction is logged, the same as Add
+func (w *WALStore) Txn(ctx context.Context, ops []txnOp) ([]uint64, error) {
+	transactor, ok := w.store.(Transactor)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, _, err := stage(ops, func(key string) (item, bool) { return w.store.Lookup(ctx, key) }, w.versions()); err != nil {
+		return nil, err
+	}
+	rec := &walRecord{Action: types.Txn, Ops: make([]*walRecord, 0, len(ops))}
+	for _, op := range ops {
+		action := types.AddItem
+		if op.remove {
+			action = types.RemoveItem
+		}
+		rec.Ops = append(rec.Ops, &walRecord{Action: action, Key: op.key, Value: op.value, Timestamp: op.timestamp, ExpiresAt: op.expiresAt})
+	}
+	if err := w.append(rec); err != nil {
+		return nil, err
+	}
+	return transactor.Txn(ctx, unconditional(ops))
+}
+
+// versions counts on from the last version of the store the same way it does, so the conditions of a txn
+// on the versions it writes itself are checked the same as by the store
+func (w *WALStore) versions() func() uint64 {
+	var version uint64
+	if r, ok := w.store.(restorer); ok {
+		version = r.lastVersion()
+	}
+	return func() uint64 {
+		version++
+		return version
+	}
+}
+
+func (w *WALStore) Get(ctx context.Context, key string) (string, bool) {
+	return w.store.Get(ctx, key)
+}
+
+func (w *WALStore) Lookup(ctx context.Context, key string) (item, bool) {
+	return w.store.Lookup(ctx, key)
+}
+
+func (w *WALStore) Peek(ctx context.Context, key string) (string, bool) {
+	return peek(ctx, w.store, key)
+}
+
+func (w *WALStore) Size() (int, int64) {
+	if sizer, ok := w.store.(Sizer); ok {
+		return sizer.Size()
+	}
+	return 0, 0
+}
+
+func (w *WALStore) GetAll(ctx context.Context) []item {
+	return w.store.GetAll(ctx)
+}
+
+// Expire is not logged, expired items are filtered by their absolute expiry after replay
+func (w *WALStore) Expire(ctx context.Context, now time.Time) []item {
+	if expirer, ok := w.store.(Expirer); ok {
+		return expirer.Expire(ctx, now)
+	}
+	return nil
+}
+
+// Close flushes the log to the disk and closes the file
+func (w *WALStore) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.wg.Wait()
+		w.snapshotMu.Lock() // wait for the on demand snapshot
+		defer w.snapshotMu.Unlock()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err = w.file.Sync(); err != nil {
+			_ = w.file.Close()
+			return
+		}
+		err = w.file.Close()
+	})
+	return err
+}
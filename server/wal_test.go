@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"go.uber.org/zap"
+)
+
+func TestWALStore_Replay(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWALStore(l, NewMemStoreOptimised(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	t1, t2, t3 := time.Now(), time.Now().Add(time.Millisecond), time.Now().Add(2*time.Millisecond)
+	_, err = wal.Add(ctx, "111", "222", t1, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, err = wal.Add(ctx, "333", "444", t2, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, err = wal.Add(ctx, "555", "666", t3, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, ok, err := wal.Remove(ctx, "333", condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+	_, err = wal.Add(ctx, "111", "000", t1, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	expected := wal.GetAll(ctx)
+	assert.Equal(t, nil, wal.Close())
+
+	// simulate a crash in the middle of a write
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0o664)
+	assert.Equal(t, nil, err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, f.Close())
+
+	wal, err = NewWALStore(l, NewMemStoreOptimised(l), fileName, SyncNever, 0, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, wal.GetAll(ctx))
+	// versions are counted up again by the replay, the overwritten key is replayed to the tail
+	assert.Equal(t, []item{{key: "555", value: "666", timestamp: t3.UnixNano(), version: 3}, {key: "111", value: "000", timestamp: t1.UnixNano(), version: 4}}, wal.GetAll(ctx))
+
+	// torn tail is truncated, so the new records are readable on the next start
+	_, err = wal.Add(ctx, "777", "888", t3, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Close())
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncInterval, time.Millisecond, 0)
+	assert.Equal(t, nil, err)
+	value, ok := wal.Get(ctx, "777")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "888", value)
+	assert.Equal(t, nil, wal.Close())
+
+	// interval policy needs an interval to sync at
+	_, err = NewWALStore(l, NewMemStore(l), fileName, SyncInterval, 0, 0)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWALStore_CorruptedLength(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	_, err = wal.Add(ctx, "111", "222", time.Now(), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Close())
+
+	// corrupted length prefix is not allocated, it is truncated as a torn tail
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0o664)
+	assert.Equal(t, nil, err)
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, f.Close())
+
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	value, ok := wal.Get(ctx, "111")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "222", value)
+	_, err = wal.Add(ctx, "333", "444", time.Now(), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+
+	// record over the limit is refused instead of being truncated on the next start
+	_, err = wal.Add(ctx, "555", strings.Repeat("x", maxRecordSize), time.Now(), time.Time{}, condition{})
+	assert.Equal(t, ErrRecordTooLarge, err)
+	_, ok = wal.Get(ctx, "555")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, nil, wal.Close())
+
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncNever, 0, 0)
+	assert.Equal(t, nil, err)
+	value, ok = wal.Get(ctx, "333")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "444", value)
+	assert.Equal(t, nil, wal.Close())
+}
+
+func TestWALStore_Snapshot(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	t1 := time.Now()
+	_, err = wal.Add(ctx, "111", "222", t1, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Snapshot(ctx))
+	_, err = wal.Add(ctx, "333", "444", t1.Add(time.Millisecond), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Snapshot(ctx))
+	_, _, err = wal.Remove(ctx, "111", condition{})
+	assert.Equal(t, nil, err)
+	_, err = wal.Add(ctx, "555", "666", t1.Add(2*time.Millisecond), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Snapshot(ctx))
+	expected := wal.GetAll(ctx)
+	assert.Equal(t, nil, wal.Close())
+
+	// only the last two snapshots are kept and the log is compacted up to the older one
+	lsns, err := wal.snapshotLSNs()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{4, 2}, lsns)
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, wal.GetAll(ctx))
+	assert.Equal(t, nil, wal.Close())
+
+	// corrupted latest snapshot falls back to the previous one and the log records after it
+	latest := wal.snapshotName(4)
+	data, err := os.ReadFile(latest)
+	assert.Equal(t, nil, err)
+	data[len(data)-2] ^= 0xff
+	assert.Equal(t, nil, os.WriteFile(latest, data, 0o664))
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, wal.GetAll(ctx))
+	assert.Equal(t, nil, wal.Close())
+}
+
+func TestWALStore_Compact(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	t1 := time.Now()
+	_, err = wal.Add(ctx, "111", "222", t1, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Snapshot(ctx))
+	_, err = wal.Add(ctx, "333", "444", t1.Add(time.Millisecond), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+
+	// write while the records are copied is not blocked and is kept by the swap
+	wal.mu.Lock()
+	end, err := wal.file.Seek(0, io.SeekCurrent)
+	wal.mu.Unlock()
+	assert.Equal(t, nil, err)
+	tmp, kept, dropped, err := wal.compactTo(1, end)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, kept)
+	assert.Equal(t, 1, dropped)
+	_, err = wal.Add(ctx, "555", "666", t1.Add(2*time.Millisecond), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	wal.mu.Lock()
+	assert.Equal(t, nil, wal.swap(tmp, end))
+	wal.mu.Unlock()
+	_, err = wal.Add(ctx, "777", "888", t1.Add(3*time.Millisecond), time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	expected := wal.GetAll(ctx)
+	assert.Equal(t, nil, wal.Close())
+
+	f, err := os.Open(fileName)
+	assert.Equal(t, nil, err)
+	reader := bufio.NewReader(f)
+	var lsns []uint64
+	for {
+		rec, _, err := readRecord(reader)
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		lsns = append(lsns, rec.LSN)
+	}
+	assert.Equal(t, nil, f.Close())
+	assert.Equal(t, []uint64{2, 3, 4}, lsns)
+
+	wal, err = NewWALStore(l, NewMemStore(l), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, wal.GetAll(ctx))
+	assert.Equal(t, nil, wal.Close())
+}
+
+func TestWALStore_Versions(t *testing.T) {
+	l := zap.NewNop()
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "wal.log")
+
+	wal, err := NewWALStore(l, NewShardedStore(l, 4), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	now := time.Now()
+	for _, value := range []string{"1", "2", "3"} {
+		_, err = wal.Add(ctx, "a", value, now, time.Time{}, condition{})
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, nil, wal.Snapshot(ctx))
+	_, err = wal.Add(ctx, "a", "4", now, time.Time{}, ifVersion(3))
+	assert.Equal(t, nil, err)
+	// conflicts are not logged
+	_, err = wal.Add(ctx, "a", "5", now, time.Time{}, ifVersion(3))
+	assert.Equal(t, ErrConflict, err)
+	assert.Equal(t, nil, wal.Close())
+
+	// versions are restored from the snapshot and counted up by the replay
+	wal, err = NewWALStore(l, NewShardedStore(l, 4), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	_item, ok := wal.Lookup(ctx, "a")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "4", _item.value)
+	assert.Equal(t, uint64(4), _item.version)
+	assert.Equal(t, uint64(4), wal.lsn)
+
+	// the removed key had a version above the snapshotted items, it is not given again after a restart
+	_, err = wal.Add(ctx, "b", "1", now, time.Time{}, condition{})
+	assert.Equal(t, nil, err)
+	_, _, err = wal.Remove(ctx, "b", condition{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, wal.Snapshot(ctx))
+	assert.Equal(t, nil, wal.Close())
+	wal, err = NewWALStore(l, NewShardedStore(l, 4), fileName, SyncAlways, 0, 0)
+	assert.Equal(t, nil, err)
+	_, err = wal.Add(ctx, "b", "2", now, time.Time{}, ifVersion(5))
+	assert.Equal(t, ErrConflict, err)
+	version, err := wal.Add(ctx, "b", "2", now, time.Time{}, ifVersion(0))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(6), version)
+	assert.Equal(t, nil, wal.Close())
+}
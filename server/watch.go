@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/bhakiyakalimuthu/server-clique/types"
+)
+
+// ErrWatcherLagged is reported when a watcher does not keep up with the mutations, events are not buffered
+// beyond the watcher buffer so the hot path never waits for a slow watcher
+var ErrWatcherLagged = errors.New("watcher fell behind the mutations")
+
+// defaultWatchBuffer is the number of events a watcher can be behind before it is dropped
+const defaultWatchBuffer = 1024
+
+// Watcher receives the mutations of the store in the order they are applied
+type Watcher struct {
+	events chan types.Event
+	err    error
+}
+
+// Events is closed once the watcher is stopped, Err tells why
+func (w *Watcher) Events() <-chan types.Event {
+	return w.events
+}
+
+// Err is either the context error or ErrWatcherLagged, valid only after the events channel is closed
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// watchHub fans out the mutations to the watchers and the change callbacks, sequence numbers are assigned
+// under the lock so every watcher sees the same order
+type watchHub struct {
+	mu       sync.Mutex
+	seq      uint64
+	watchers map[*Watcher]struct{}
+	onChange []func(types.Event)
+}
+
+// OnChange registers the callback called for every mutation in order, it is called on the worker
+// applying the mutation so it must not block. used to feed the change data capture outbox
+func (s *Server) OnChange(fn func(types.Event)) {
+	s.watchers.mu.Lock()
+	defer s.watchers.mu.Unlock()
+	s.watchers.onChange = append(s.watchers.onChange, fn)
+}
+
+// Watch registers a watcher until the context is done, buffer defaults to 1024 events when it is not positive
+func (s *Server) Watch(ctx context.Context, buffer int) *Watcher {
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+	w := &Watcher{events: make(chan types.Event, buffer)}
+	h := &s.watchers
+	h.mu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[*Watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.stop(w, ctx.Err())
+	}()
+	return w
+}
+
+// active reports whether anyone is listening, the old value is looked up only then
+func (h *watchHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.watchers) > 0 || len(h.onChange) > 0
+}
+
+// publish numbers the events and sends them to every watcher, a watcher with a full buffer is stopped.
+// the events are numbered consecutively, so the events of a txn are never interleaved with the others
+func (h *watchHub) publish(events ...types.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, event := range events {
+		h.seq++
+		event.Seq = h.seq
+		for _, fn := range h.onChange {
+			fn(event)
+		}
+		for w := range h.watchers {
+			select {
+			case w.events <- event:
+			default:
+				droppedTotal.WithLabelValues(dropWatcherLagged).Inc()
+				h.stop(w, ErrWatcherLagged)
+			}
+		}
+	}
+}
+
+// stop closes the watcher if it is still registered, must be called with the lock held
+func (h *watchHub) stop(w *Watcher, err error) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	w.err = err
+	close(w.events)
+}
@@ -9,6 +9,23 @@ const (
 	RemoveItem Action = "remove"
 	GetItem    Action = "get"
 	GetAll     Action = "getall"
+	// CompareAndSwap, AddIfAbsent and RemoveIfValue are the conditional writes, the store is left unchanged
+	// with the conflict status if the condition does not hold. cas sets the value if the key is at Version,
+	// version zero matches a missing key
+	CompareAndSwap Action = "cas"
+	AddIfAbsent    Action = "add_if_absent"
+	RemoveIfValue  Action = "remove_if_value"
+	// Txn applies the Ops of the message all or nothing, no reader observes a part of them
+	Txn Action = "txn"
+	// Batch carries Messages in one delivery, the server applies them in order as if they were published
+	// one by one. Compressed holds them gzipped instead of Messages
+	Batch Action = "batch"
+	// Snapshot is an admin action, store writes a point-in-time snapshot to the disk
+	Snapshot Action = "snapshot"
+	// Expire and Evict are not accepted from the clients, they are the events of the server
+	// removing an expired key or evicting a key to stay within the store capacity
+	Expire Action = "expire"
+	Evict  Action = "evict"
 )
 
 func (a Action) String() string {
@@ -20,4 +37,132 @@ type Message struct {
 	Key       string    `json:"key"`
 	Value     string    `json:"value"`
 	Timestamp time.Time `json:"timestamp"`
+	// TTL is the time to live of an added key in milliseconds, key never expires if it is zero
+	TTL int64 `json:"ttl,omitempty"`
+	// Version is the version a cas expects the key to be at
+	Version uint64 `json:"version,omitempty"`
+	// Ops are the writes of a txn, applied in order
+	Ops []Op `json:"ops,omitempty"`
+	// Messages and Compressed are the messages of a batch, Compressed is the gzipped json array of them
+	Messages   []*Message `json:"messages,omitempty"`
+	Compressed []byte     `json:"compressed,omitempty"`
+	// ReplyTo and CorrelationID are carried as transport properties (not part of the body),
+	// ReplyTo is empty when the sender does not expect a response
+	ReplyTo       string `json:"-"`
+	CorrelationID string `json:"-"`
+	// Redelivered is set when the message was delivered before but not acknowledged
+	Redelivered bool `json:"-"`
+	// Retries is the number of times the message was requeued after failing to be processed
+	Retries int `json:"-"`
+	// AppID identifies the sending client, it is set by the queue on the consumed messages
+	AppID string `json:"-"`
+	// Headers are carried as transport headers (e.g. amqp headers), they hold the w3c trace context of the message
+	Headers map[string]string `json:"-"`
+	// Acknowledger is set by the queue when the message delivery has to be settled by the consumer
+	Acknowledger Acknowledger `json:"-"`
+}
+
+// Op is a write of a txn, Action is add or remove
+type Op struct {
+	Action Action `json:"action"`
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	TTL    int64  `json:"ttl,omitempty"`
+	// IfVersion is the version the key has to be at for the txn to be applied, zero if the key must not exist.
+	// the op is unconditional if it is nil
+	IfVersion *uint64 `json:"ifVersion,omitempty"`
+}
+
+// Acknowledger settles the delivery of a message
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+// DeadLetterer is implemented by the acknowledgers of the queues with a dead letter queue
+type DeadLetterer interface {
+	// DeadLetter forwards the message to the dead letter queue with the reason, the delivery is settled
+	DeadLetter(reason string, cause error) error
+}
+
+// Ack acknowledges the delivery, noop if the message does not need acknowledgement
+func (m *Message) Ack() error {
+	if m.Acknowledger == nil {
+		return nil
+	}
+	return m.Acknowledger.Ack()
+}
+
+// Nack rejects the delivery, message is redelivered if requeue is set
+func (m *Message) Nack(requeue bool) error {
+	if m.Acknowledger == nil {
+		return nil
+	}
+	return m.Acknowledger.Nack(requeue)
+}
+
+// DeadLetter forwards the message to the dead letter queue, it is rejected without requeue
+// if the queue has no dead letter queue
+func (m *Message) DeadLetter(reason string, cause error) error {
+	if m.Acknowledger == nil {
+		return nil
+	}
+	if deadLetterer, ok := m.Acknowledger.(DeadLetterer); ok {
+		return deadLetterer.DeadLetter(reason, cause)
+	}
+	return m.Acknowledger.Nack(false)
+}
+
+type Status string
+
+const (
+	StatusOK            Status = "ok"
+	StatusKeyNotFound   Status = "key_not_found"
+	StatusUnknownAction Status = "unknown_action"
+	StatusNotSupported  Status = "not_supported"
+	// StatusConflict is the outcome of a conditional write whose condition does not hold
+	StatusConflict Status = "conflict"
+	// StatusTooLarge is the outcome of a write which is larger than the store accepts, it fails the same way if retried
+	StatusTooLarge Status = "too_large"
+	StatusError    Status = "error"
+)
+
+func (s Status) String() string {
+	return string(s)
+}
+
+// Item is a key value pair as it is returned to the clients
+type Item struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+	Version   uint64    `json:"version,omitempty"`
+}
+
+// Response is sent back by the server for the messages which carry a ReplyTo
+type Response struct {
+	Action Action `json:"action"`
+	Status Status `json:"status"`
+	Key    string `json:"key,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Items  []Item `json:"items,omitempty"`
+	// Version is the version of the key added, removed or read, a conflict carries the current version
+	// of the key, zero if the key does not exist
+	Version   uint64    `json:"version,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Event is a mutation applied to the store, Action is one of add, remove, expire or evict
+type Event struct {
+	// Seq is the position of the event in the mutation order, it increases by one with every event
+	Seq    uint64 `json:"seq"`
+	Action Action `json:"action"`
+	Key    string `json:"key"`
+	// Value is the new value of an add, OldValue is the value before the mutation if the key existed
+	Value     string    `json:"value,omitempty"`
+	OldValue  string    `json:"oldValue,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Origin is the app id of the client which sent the mutation, empty for expire and evict
+	Origin string `json:"origin,omitempty"`
 }